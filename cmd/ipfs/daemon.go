@@ -5,6 +5,7 @@ import (
 	_ "expvar"
 	"fmt"
 	"github.com/ipfs/go-ipfs/miner"
+	minerconfig "github.com/ipfs/go-ipfs/miner/config"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
@@ -26,6 +27,7 @@ import (
 	corerepo "github.com/ipfs/go-ipfs/core/corerepo"
 	libp2p "github.com/ipfs/go-ipfs/core/node/libp2p"
 	nodeMount "github.com/ipfs/go-ipfs/fuse/node"
+	repo "github.com/ipfs/go-ipfs/repo"
 	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
 	"github.com/ipfs/go-ipfs/repo/fsrepo/migrations"
 	sockets "github.com/libp2p/go-socket-activation"
@@ -66,6 +68,8 @@ const (
 	enableMultiplexKwd        = "enable-mplex-experiment"
 	enableMining              = "enable-mining"
 	minerRole                 = "miner-role"
+	minerExportDir            = "miner-export-dir"
+	enableInspector           = "enable-inspector"
 	// apiAddrKwd    = "address-api"
 	// swarmAddrKwd  = "address-swarm"
 )
@@ -179,8 +183,10 @@ Headers.
 		cmds.BoolOption(enablePubSubKwd, "Instantiate the ipfs daemon with the experimental pubsub feature enabled."),
 		cmds.BoolOption(enableIPNSPubSubKwd, "Enable IPNS record distribution through pubsub; enables pubsub."),
 		cmds.BoolOption(enableMultiplexKwd, "DEPRECATED"),
-		cmds.BoolOption(enableMining, "Enable mining"),
-		cmds.IntOption(minerRole, "miner role, 0: main miner 1: edge miner"),
+		cmds.BoolOption(enableMining, "Enable mining. Overrides Miner.Enabled"),
+		cmds.IntOption(minerRole, "miner role, 0: main miner 1: edge miner. Overrides Miner.Role"),
+		cmds.StringOption(minerExportDir, "Directory receiving fetched files whose request asks for export. Overrides Miner.ExportDir"),
+		cmds.BoolOption(enableInspector, "Run the built-in inspector. Overrides Miner.Inspector.Enabled"),
 		// TODO: add way to override addresses. tricky part: updating the config if also --init.
 		// cmds.StringOption(apiAddrKwd, "Address for the daemon rpc API (overrides config)"),
 		// cmds.StringOption(swarmAddrKwd, "Address for the swarm socket (overrides config)"),
@@ -323,6 +329,31 @@ func daemonFunc(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment
 		log.Errorf("To disable this multiplexer, please configure `Swarm.Transports.Multiplexers'.")
 	}
 
+	// Miner flags override the Miner section of the config.
+	minerCfg, err := minerconfig.Load(repo)
+	if err != nil {
+		return err
+	}
+	if mining, _ := req.Options[enableMining].(bool); mining {
+		minerCfg.Enabled = true
+	}
+	if role, found := req.Options[minerRole].(int); found {
+		minerCfg.Role = role
+	}
+	if exportDir, found := req.Options[minerExportDir].(string); found {
+		minerCfg.ExportDir = exportDir
+	}
+	if inspecting, _ := req.Options[enableInspector].(bool); inspecting {
+		minerCfg.Inspector.Enabled = true
+	}
+	if err := minerCfg.Validate(); err != nil {
+		return fmt.Errorf("invalid %s config: %w", minerconfig.Key, err)
+	}
+
+	if err := printSwarmKeySource(repo); err != nil {
+		return err
+	}
+
 	// Start assembling node config
 	ncfg := &core.BuildCfg{
 		Repo:                        repo,
@@ -460,16 +491,14 @@ func daemonFunc(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment
 		fmt.Println("(Hit ctrl-c again to force-shutdown the daemon.)")
 	}()
 
-	enableMining, _ := req.Options[enableMining].(bool)
-	if enableMining {
-		role, found := req.Options[minerRole].(int)
-		if !found {
-			return errors.New("miner-role must be set")
-		}
-		if role != 0 && role != 1 {
-			return errors.New("miner-role must be 0 or 1")
+	if minerCfg.Enabled {
+		if err := miner.Run(req.Context, node, minerCfg); err != nil {
+			log.Errorf("failed to start miner: %s", err)
+			return err
 		}
-		miner.Run(req.Context, node, role)
+	}
+	if minerCfg.Inspector.Enabled {
+		miner.RunInspector(req.Context, node, minerCfg)
 	}
 
 	// collect long-running errors and block for shutdown
@@ -593,6 +622,28 @@ func serveHTTPApi(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, error
 	return errc, nil
 }
 
+// printSwarmKeySource prints where the swarm key of the node comes from.
+func printSwarmKeySource(r repo.Repo) error {
+	source, err := r.SwarmKeySource()
+	if err != nil {
+		return fmt.Errorf("invalid %s config: %w", repo.SwarmKeySourceKey, err)
+	}
+	switch source {
+	case repo.SwarmKeyEmbedded:
+		fmt.Println("Swarm key source: key embedded in this binary (private network)")
+		if _, err := r.GetConfigKey(repo.SwarmKeySourceKey); err != nil {
+			log.Warnf("using the embedded swarm key because the repo has no %s, set %s to make the choice explicit",
+				fsrepo.SwarmKeyFile, repo.SwarmKeySourceKey)
+		}
+	case repo.SwarmKeyRepo:
+		fmt.Printf("Swarm key source: repo file %s (private network)\n", fsrepo.SwarmKeyFile)
+	case repo.SwarmKeyPublic:
+		fmt.Println("Swarm key source: none (public network)")
+	}
+	log.Infof("swarm key source: %s", source)
+	return nil
+}
+
 // printSwarmAddrs prints the addresses of the host
 func printSwarmAddrs(node *core.IpfsNode) {
 	if !node.IsOnline {
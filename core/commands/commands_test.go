@@ -133,6 +133,11 @@ func TestCommands(t *testing.T) {
 		"/files/write",
 		"/get",
 		"/id",
+		"/inspector",
+		"/inspector/assign",
+		"/inspector/assignments",
+		"/inspector/challenge",
+		"/inspector/miners",
 		"/key",
 		"/key/gen",
 		"/key/export",
@@ -146,6 +151,17 @@ func TestCommands(t *testing.T) {
 		"/log/ls",
 		"/log/tail",
 		"/ls",
+		"/miner",
+		"/miner/heartbeat",
+		"/miner/heartbeat/now",
+		"/miner/jobs",
+		"/miner/jobs/cancel",
+		"/miner/jobs/ls",
+		"/miner/proofs",
+		"/miner/proofs/ls",
+		"/miner/role",
+		"/miner/role/set",
+		"/miner/status",
 		"/mount",
 		"/name",
 		"/name/publish",
@@ -200,6 +216,10 @@ func TestCommands(t *testing.T) {
 		"/repo",
 		"/repo/fsck",
 		"/repo/gc",
+		"/repo/gc/explain",
+		"/repo/refcount",
+		"/repo/refcount/drop",
+		"/repo/refcount/rebuild",
 		"/repo/stat",
 		"/repo/verify",
 		"/repo/version",
@@ -219,6 +239,11 @@ func TestCommands(t *testing.T) {
 		"/swarm/filters",
 		"/swarm/filters/add",
 		"/swarm/filters/rm",
+		"/swarm/key",
+		"/swarm/key/fingerprint",
+		"/swarm/key/generate",
+		"/swarm/key/install",
+		"/swarm/key/show",
 		"/swarm/peers",
 		"/tar",
 		"/tar/add",
@@ -0,0 +1,228 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	minerapi "github.com/ipfs/go-ipfs/miner/api"
+
+	cid "github.com/ipfs/go-cid"
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+const inspectorMinerOptionName = "miner"
+
+var errInspectingDisabled = errors.New("the inspector is not enabled, set Miner.Inspector.Enabled or start the daemon with --enable-inspector")
+
+// InspectorMinersOutput is output type of inspector miners command
+type InspectorMinersOutput struct {
+	Miners []minerapi.MinerInfo
+}
+
+// InspectorAssignmentsOutput is output type of inspector assignments command
+type InspectorAssignmentsOutput struct {
+	Assignments []minerapi.Assignment
+}
+
+// InspectorCmd is the 'ipfs inspector' command
+var InspectorCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Operate the built-in inspector.",
+		ShortDescription: `
+The inspector assigns files to miners, tracks their heartbeats and challenges
+them to prove they still store the assigned files. It is started with
+'ipfs daemon --enable-inspector'.
+`,
+	},
+
+	Subcommands: map[string]*cmds.Command{
+		"miners":      inspectorMinersCmd,
+		"assignments": inspectorAssignmentsCmd,
+		"assign":      inspectorAssignCmd,
+		"challenge":   inspectorChallengeCmd,
+	},
+}
+
+var inspectorMinersCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "List the miners seen by the inspector.",
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(minerHeadersOptionName, "v", "Print table headers (Peer, Role, Score, Challenges, Failures, Missed, LastHeartbeat)."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		i, err := inspectorGetInspector(env)
+		if err != nil {
+			return err
+		}
+		miners, err := i.Miners()
+		if err != nil {
+			return err
+		}
+		sort.Slice(miners, func(a, b int) bool {
+			return miners[a].Score > miners[b].Score
+		})
+		return cmds.EmitOnce(res, &InspectorMinersOutput{Miners: miners})
+	},
+	Type: InspectorMinersOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *InspectorMinersOutput) error {
+			headers, _ := req.Options[minerHeadersOptionName].(bool)
+			tw := tabwriter.NewWriter(w, 1, 2, 1, ' ', 0)
+			if headers {
+				fmt.Fprintln(tw, "Peer\tRole\tScore\tChallenges\tFailures\tMissed\tLastHeartbeat")
+			}
+			for _, m := range out.Miners {
+				last := "never"
+				if !m.LastHeartbeat.IsZero() {
+					last = m.LastHeartbeat.Format(time.RFC3339)
+				}
+				if m.Offline {
+					last += " (offline)"
+				}
+				fmt.Fprintf(tw, "%s\t%d\t%.2f\t%d\t%d\t%d\t%s\n", m.Peer, m.Role, m.Score, m.Challenges, m.Failures, m.MissedHeartbeats, last)
+			}
+			return tw.Flush()
+		}),
+	},
+}
+
+var inspectorAssignmentsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "List the files assigned to miners.",
+	},
+	Options: []cmds.Option{
+		cmds.StringOption(inspectorMinerOptionName, "m", "Only list the assignments of this miner."),
+		cmds.BoolOption(minerHeadersOptionName, "v", "Print table headers (Miner, Cid, Size, State, Local, Failures)."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		i, err := inspectorGetInspector(env)
+		if err != nil {
+			return err
+		}
+		var miner peer.ID
+		if s, _ := req.Options[inspectorMinerOptionName].(string); s != "" {
+			miner, err = peer.Decode(s)
+			if err != nil {
+				return err
+			}
+		}
+		assignments, err := i.Assignments(miner)
+		if err != nil {
+			return err
+		}
+		sort.Slice(assignments, func(a, b int) bool {
+			return assignments[a].Assigned.Before(assignments[b].Assigned)
+		})
+		return cmds.EmitOnce(res, &InspectorAssignmentsOutput{Assignments: assignments})
+	},
+	Type: InspectorAssignmentsOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *InspectorAssignmentsOutput) error {
+			headers, _ := req.Options[minerHeadersOptionName].(bool)
+			tw := tabwriter.NewWriter(w, 1, 2, 1, ' ', 0)
+			if headers {
+				fmt.Fprintln(tw, "Miner\tCid\tSize\tState\tLocal\tFailures")
+			}
+			for _, a := range out.Assignments {
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%t\t%d\n", a.Miner, a.Cid, a.Size, a.State, a.Local, a.Failures)
+			}
+			return tw.Flush()
+		}),
+	},
+}
+
+var inspectorAssignCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Ask a miner to store a file.",
+		ShortDescription: `
+Send a FetchFile request for the file to the miner. Once the miner reports the
+file as pinned, it is challenged periodically. Files pinned by the inspector
+itself are challenged for raw data, other files for Merkle proofs.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("miner", true, false, "Peer ID of the miner."),
+		cmds.StringArg("cid", true, false, "CID of the file to store."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		i, err := inspectorGetInspector(env)
+		if err != nil {
+			return err
+		}
+		miner, err := peer.Decode(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+		c, err := cid.Decode(req.Arguments[1])
+		if err != nil {
+			return err
+		}
+		a, err := i.Assign(req.Context, miner, c)
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, &a)
+	},
+	Type: minerapi.Assignment{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *minerapi.Assignment) error {
+			fmt.Fprintf(w, "assigned %s (%d bytes) to %s\n", out.Cid, out.Size, out.Miner)
+			return nil
+		}),
+	},
+}
+
+var inspectorChallengeCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Challenge a miner immediately.",
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("miner", true, false, "Peer ID of the miner."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		i, err := inspectorGetInspector(env)
+		if err != nil {
+			return err
+		}
+		miner, err := peer.Decode(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+		result, err := i.Challenge(req.Context, miner)
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, &result)
+	},
+	Type: minerapi.ChallengeResult{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *minerapi.ChallengeResult) error {
+			fmt.Fprintf(w, "%s failed %d of %d files, score %.2f\n", out.Miner, out.Failed, out.Files, out.Score)
+			return nil
+		}),
+	},
+}
+
+func inspectorGetInspector(env cmds.Environment) (minerapi.Inspector, error) {
+	nd, err := cmdenv.GetNode(env)
+	if err != nil {
+		return nil, err
+	}
+
+	if !nd.IsOnline {
+		return nil, ErrNotOnline
+	}
+
+	if nd.Inspector == nil {
+		return nil, errInspectingDisabled
+	}
+
+	return nd.Inspector, nil
+}
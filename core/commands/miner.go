@@ -0,0 +1,266 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	minerapi "github.com/ipfs/go-ipfs/miner/api"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+)
+
+const minerHeadersOptionName = "headers"
+
+var errMiningDisabled = errors.New("mining is not enabled, start the daemon with --enable-mining")
+
+// MinerJobsOutput is output type of miner jobs ls command
+type MinerJobsOutput struct {
+	Jobs []minerapi.Job
+}
+
+// MinerProofsOutput is output type of miner proofs ls command
+type MinerProofsOutput struct {
+	Proofs []minerapi.Proof
+}
+
+// MinerCmd is the 'ipfs miner' command
+var MinerCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Operate the storage miner.",
+		ShortDescription: `
+Inspect and control the storage miner running in the daemon. Mining is
+started with 'ipfs daemon --enable-mining --miner-role=<role>'.
+`,
+	},
+
+	Subcommands: map[string]*cmds.Command{
+		"status":    minerStatusCmd,
+		"jobs":      minerJobsCmd,
+		"proofs":    minerProofsCmd,
+		"heartbeat": minerHeartbeatCmd,
+		"role":      minerRoleCmd,
+	},
+}
+
+var minerStatusCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Show the miner status.",
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		m, err := minerGetMiner(env)
+		if err != nil {
+			return err
+		}
+		status, err := m.Status()
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, &status)
+	},
+	Type: minerapi.Status{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *minerapi.Status) error {
+			fmt.Fprintf(w, "Role: %d\n", out.Role)
+			fmt.Fprintf(w, "Wallet address: %s\n", out.WalletAddress)
+			if out.LastHeartbeat.IsZero() {
+				fmt.Fprintln(w, "Last heartbeat: never")
+			} else {
+				fmt.Fprintf(w, "Last heartbeat: %s\n", out.LastHeartbeat.Format(time.RFC3339))
+			}
+			states := make([]string, 0, len(out.Jobs))
+			for state := range out.Jobs {
+				states = append(states, state)
+			}
+			sort.Strings(states)
+			fmt.Fprintln(w, "Jobs:")
+			for _, state := range states {
+				fmt.Fprintf(w, "  %s: %d\n", state, out.Jobs[state])
+			}
+			return nil
+		}),
+	},
+}
+
+var minerJobsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Manage FetchFile jobs.",
+	},
+
+	Subcommands: map[string]*cmds.Command{
+		"ls":     minerJobsLsCmd,
+		"cancel": minerJobsCancelCmd,
+	},
+}
+
+var minerJobsLsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "List FetchFile jobs.",
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(minerHeadersOptionName, "v", "Print table headers (ID, State, Cid, Bytes, Attempts)."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		m, err := minerGetMiner(env)
+		if err != nil {
+			return err
+		}
+		jobs, err := m.Jobs()
+		if err != nil {
+			return err
+		}
+		sort.Slice(jobs, func(i, j int) bool {
+			return jobs[i].Created.Before(jobs[j].Created)
+		})
+		return cmds.EmitOnce(res, &MinerJobsOutput{Jobs: jobs})
+	},
+	Type: MinerJobsOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *MinerJobsOutput) error {
+			headers, _ := req.Options[minerHeadersOptionName].(bool)
+			tw := tabwriter.NewWriter(w, 1, 2, 1, ' ', 0)
+			if headers {
+				fmt.Fprintln(tw, "ID\tState\tCid\tBytes\tAttempts")
+			}
+			for _, job := range out.Jobs {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\n", job.ID, job.State, job.Cid, job.BytesFetched, job.Attempts)
+			}
+			return tw.Flush()
+		}),
+	},
+}
+
+var minerJobsCancelCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Cancel a queued or running FetchFile job.",
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("id", true, false, "ID of the job to cancel."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		m, err := minerGetMiner(env)
+		if err != nil {
+			return err
+		}
+		return m.CancelJob(req.Context, req.Arguments[0])
+	},
+}
+
+var minerProofsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Inspect answered WindowPost challenges.",
+	},
+
+	Subcommands: map[string]*cmds.Command{
+		"ls": minerProofsLsCmd,
+	},
+}
+
+var minerProofsLsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "List the most recently answered WindowPost challenges.",
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(minerHeadersOptionName, "v", "Print table headers (Time, Type, Requester, Files, Failed)."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		m, err := minerGetMiner(env)
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, &MinerProofsOutput{Proofs: m.Proofs()})
+	},
+	Type: MinerProofsOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *MinerProofsOutput) error {
+			headers, _ := req.Options[minerHeadersOptionName].(bool)
+			tw := tabwriter.NewWriter(w, 1, 2, 1, ' ', 0)
+			if headers {
+				fmt.Fprintln(tw, "Time\tType\tRequester\tFiles\tFailed")
+			}
+			for _, p := range out.Proofs {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\n", p.Time.Format(time.RFC3339), p.Type, p.Requester, p.Files, p.Failed)
+			}
+			return tw.Flush()
+		}),
+	},
+}
+
+var minerHeartbeatCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Control miner heartbeats.",
+	},
+
+	Subcommands: map[string]*cmds.Command{
+		"now": minerHeartbeatNowCmd,
+	},
+}
+
+var minerHeartbeatNowCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Publish a heartbeat immediately.",
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		m, err := minerGetMiner(env)
+		if err != nil {
+			return err
+		}
+		return m.Heartbeat(req.Context)
+	},
+}
+
+var minerRoleCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Manage the miner role.",
+	},
+
+	Subcommands: map[string]*cmds.Command{
+		"set": minerRoleSetCmd,
+	},
+}
+
+var minerRoleSetCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Change the role announced by the miner.",
+		ShortDescription: `
+Set the miner role to 0 (main miner) or 1 (edge miner). The new role is
+announced with the next heartbeat.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("role", true, false, "Miner role, 0: main miner 1: edge miner."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		m, err := minerGetMiner(env)
+		if err != nil {
+			return err
+		}
+		role, err := strconv.Atoi(req.Arguments[0])
+		if err != nil {
+			return minerapi.ErrInvalidRole
+		}
+		return m.SetRole(role)
+	},
+}
+
+func minerGetMiner(env cmds.Environment) (minerapi.Miner, error) {
+	nd, err := cmdenv.GetNode(env)
+	if err != nil {
+		return nil, err
+	}
+
+	if !nd.IsOnline {
+		return nil, ErrNotOnline
+	}
+
+	if nd.Miner == nil {
+		return nil, errMiningDisabled
+	}
+
+	return nd.Miner, nil
+}
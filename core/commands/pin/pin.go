@@ -3,9 +3,12 @@ package pin
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	bserv "github.com/ipfs/go-blockservice"
@@ -22,6 +25,8 @@ import (
 	core "github.com/ipfs/go-ipfs/core"
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
 	e "github.com/ipfs/go-ipfs/core/commands/e"
+	coreapi "github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/namedpin"
 )
 
 var PinCmd = &cmds.Command{
@@ -41,6 +46,9 @@ var PinCmd = &cmds.Command{
 
 type PinOutput struct {
 	Pins []string
+	Name string `json:",omitempty"`
+	// Names are the names removed with the pins.
+	Names []string `json:",omitempty"`
 }
 
 type AddPinOutput struct {
@@ -51,12 +59,44 @@ type AddPinOutput struct {
 const (
 	pinRecursiveOptionName = "recursive"
 	pinProgressOptionName  = "progress"
+	pinMetaOptionName      = "meta"
 )
 
+// namedPinAPI returns the named pin API of api.
+func namedPinAPI(api coreiface.CoreAPI) (coreapi.NamedPinAPI, error) {
+	named, ok := api.Pin().(coreapi.NamedPinAPI)
+	if !ok {
+		return nil, errors.New("pin names are not supported by this api")
+	}
+	return named, nil
+}
+
+// pinNameOptions returns the name and the metadata of a pin.
+func pinNameOptions(req *cmds.Request) (string, map[string]string, error) {
+	name, _ := req.Options[pinNameOptionName].(string)
+	pairs, _ := req.Options[pinMetaOptionName].([]string)
+	meta, err := namedpin.ParseMeta(pairs)
+	if err != nil {
+		return "", nil, err
+	}
+	if name == "" && len(meta) > 0 {
+		return "", nil, fmt.Errorf("--%s requires --%s", pinMetaOptionName, pinNameOptionName)
+	}
+	return name, meta, nil
+}
+
 var addPinCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline:          "Pin objects to local storage.",
 		ShortDescription: "Stores an IPFS object(s) from a given path locally to disk.",
+		LongDescription: `
+Stores an IPFS object(s) from a given path locally to disk.
+
+A single pin may be named with --name, and labeled with metadata given as
+--meta key=value. Named pins are listed with 'ipfs pin ls --name', and can
+be updated and removed by name. Naming an object that is pinned already
+reuses its pin, which is kept when its names are removed.
+`,
 	},
 
 	Arguments: []cmds.Argument{
@@ -65,6 +105,8 @@ var addPinCmd = &cmds.Command{
 	Options: []cmds.Option{
 		cmds.BoolOption(pinRecursiveOptionName, "r", "Recursively pin the object linked to by the specified object(s).").WithDefault(true),
 		cmds.BoolOption(pinProgressOptionName, "Show progress"),
+		cmds.StringOption(pinNameOptionName, "Name of the pin."),
+		cmds.StringsOption(pinMetaOptionName, "Metadata of the named pin, as key=value."),
 	},
 	Type: AddPinOutput{},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
@@ -76,10 +118,17 @@ var addPinCmd = &cmds.Command{
 		// set recursive flag
 		recursive, _ := req.Options[pinRecursiveOptionName].(bool)
 		showProgress, _ := req.Options[pinProgressOptionName].(bool)
+		name, meta, err := pinNameOptions(req)
+		if err != nil {
+			return err
+		}
 
 		if err := req.ParseBodyArgs(); err != nil {
 			return err
 		}
+		if name != "" && len(req.Arguments) != 1 {
+			return fmt.Errorf("--%s names a single pin", pinNameOptionName)
+		}
 
 		enc, err := cmdenv.GetCidEncoder(req)
 		if err != nil {
@@ -87,7 +136,7 @@ var addPinCmd = &cmds.Command{
 		}
 
 		if !showProgress {
-			added, err := pinAddMany(req.Context, api, enc, req.Arguments, recursive)
+			added, err := pinAddMany(req.Context, api, enc, req.Arguments, recursive, name, meta)
 			if err != nil {
 				return err
 			}
@@ -105,7 +154,7 @@ var addPinCmd = &cmds.Command{
 
 		ch := make(chan pinResult, 1)
 		go func() {
-			added, err := pinAddMany(ctx, api, enc, req.Arguments, recursive)
+			added, err := pinAddMany(ctx, api, enc, req.Arguments, recursive, name, meta)
 			ch <- pinResult{pins: added, err: err}
 		}()
 
@@ -181,7 +230,7 @@ var addPinCmd = &cmds.Command{
 	},
 }
 
-func pinAddMany(ctx context.Context, api coreiface.CoreAPI, enc cidenc.Encoder, paths []string, recursive bool) ([]string, error) {
+func pinAddMany(ctx context.Context, api coreiface.CoreAPI, enc cidenc.Encoder, paths []string, recursive bool, name string, meta map[string]string) ([]string, error) {
 	added := make([]string, len(paths))
 	for i, b := range paths {
 		rp, err := api.ResolvePath(ctx, path.New(b))
@@ -189,7 +238,16 @@ func pinAddMany(ctx context.Context, api coreiface.CoreAPI, enc cidenc.Encoder,
 			return nil, err
 		}
 
-		if err := api.Pin().Add(ctx, rp, options.Pin.Recursive(recursive)); err != nil {
+		if name != "" {
+			named, err := namedPinAPI(api)
+			if err != nil {
+				return nil, err
+			}
+			err = named.AddNamed(ctx, rp, name, meta, options.Pin.Recursive(recursive))
+			if err != nil {
+				return nil, err
+			}
+		} else if err := api.Pin().Add(ctx, rp, options.Pin.Recursive(recursive)); err != nil {
 			return nil, err
 		}
 		added[i] = enc.Encode(rp.Cid())
@@ -212,14 +270,19 @@ collected if needed. (By default, recursively. Use -r=false for direct pins.)
 A pin may not be removed because the specified object is not pinned or pinned
 indirectly. To determine if the object is pinned indirectly, use the command:
 ipfs pin ls -t indirect <cid>
+
+With --name, the name is removed instead, and the pin once it has no name
+left, unless it was also pinned without a name. Removing a pin removes its
+names, which are listed in the output.
 `,
 	},
 
 	Arguments: []cmds.Argument{
-		cmds.StringArg("ipfs-path", true, true, "Path to object(s) to be unpinned.").EnableStdin(),
+		cmds.StringArg("ipfs-path", false, true, "Path to object(s) to be unpinned.").EnableStdin(),
 	},
 	Options: []cmds.Option{
 		cmds.BoolOption(pinRecursiveOptionName, "r", "Recursively unpin the object linked to by the specified object(s).").WithDefault(true),
+		cmds.StringOption(pinNameOptionName, "Name of the pin to remove."),
 	},
 	Type: PinOutput{},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
@@ -231,36 +294,86 @@ ipfs pin ls -t indirect <cid>
 		// set recursive flag
 		recursive, _ := req.Options[pinRecursiveOptionName].(bool)
 
-		if err := req.ParseBodyArgs(); err != nil {
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
 			return err
 		}
 
-		enc, err := cmdenv.GetCidEncoder(req)
-		if err != nil {
+		if name, _ := req.Options[pinNameOptionName].(string); name != "" {
+			if len(req.Arguments) > 0 {
+				return fmt.Errorf("--%s removes a pin by name, without paths", pinNameOptionName)
+			}
+			named, err := namedPinAPI(api)
+			if err != nil {
+				return err
+			}
+			p, err := named.RmNamed(req.Context, name)
+			if err != nil {
+				return err
+			}
+			return cmds.EmitOnce(res, &PinOutput{Pins: []string{enc.Encode(p.Cid)}, Name: name})
+		}
+
+		if err := req.ParseBodyArgs(); err != nil {
 			return err
 		}
+		if len(req.Arguments) == 0 {
+			return errors.New("argument \"ipfs-path\" is required")
+		}
 
+		named, _ := namedPinAPI(api)
 		pins := make([]string, 0, len(req.Arguments))
+		var names []string
 		for _, b := range req.Arguments {
 			rp, err := api.ResolvePath(req.Context, path.New(b))
 			if err != nil {
 				return err
 			}
 
+			var before []namedpin.Pin
+			if named != nil {
+				if before, err = named.Names(req.Context, rp.Cid()); err != nil {
+					return err
+				}
+			}
+
 			id := enc.Encode(rp.Cid())
 			pins = append(pins, id)
 			if err := api.Pin().Rm(req.Context, rp, options.Pin.RmRecursive(recursive)); err != nil {
 				return err
 			}
+
+			if len(before) > 0 {
+				after, err := named.Names(req.Context, rp.Cid())
+				if err != nil {
+					return err
+				}
+				kept := make(map[string]bool, len(after))
+				for _, p := range after {
+					kept[p.Name] = true
+				}
+				for _, p := range before {
+					if !kept[p.Name] {
+						names = append(names, p.Name)
+					}
+				}
+			}
 		}
 
-		return cmds.EmitOnce(res, &PinOutput{pins})
+		return cmds.EmitOnce(res, &PinOutput{Pins: pins, Names: names})
 	},
 	Encoders: cmds.EncoderMap{
 		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *PinOutput) error {
+			if out.Name != "" {
+				fmt.Fprintf(w, "removed pin name %s of %s\n", out.Name, out.Pins[0])
+				return nil
+			}
 			for _, k := range out.Pins {
 				fmt.Fprintf(w, "unpinned %s\n", k)
 			}
+			for _, name := range out.Names {
+				fmt.Fprintf(w, "removed pin name %s\n", name)
+			}
 
 			return nil
 		}),
@@ -314,6 +427,15 @@ Example:
 	QmZULkCELmmk5XNfCgTnCyFgAVxBRBXyDHGGMVoLFLiXEN direct
 	$ ipfs pin ls QmZULkCELmmk5XNfCgTnCyFgAVxBRBXyDHGGMVoLFLiXEN
 	QmZULkCELmmk5XNfCgTnCyFgAVxBRBXyDHGGMVoLFLiXEN direct
+
+Use --name=<prefix> to list the named pins whose name starts with the
+prefix, with their metadata. An empty prefix lists every named pin.
+
+Example:
+	$ ipfs pin add --name=dataset/2021 --meta owner=alice QmZULkCELmmk5XNfCgTnCyFgAVxBRBXyDHGGMVoLFLiXEN
+	pinned QmZULkCELmmk5XNfCgTnCyFgAVxBRBXyDHGGMVoLFLiXEN recursively
+	$ ipfs pin ls --name=dataset/
+	QmZULkCELmmk5XNfCgTnCyFgAVxBRBXyDHGGMVoLFLiXEN recursive dataset/2021 owner=alice
 `,
 	},
 
@@ -324,6 +446,7 @@ Example:
 		cmds.StringOption(pinTypeOptionName, "t", "The type of pinned keys to list. Can be \"direct\", \"indirect\", \"recursive\", or \"all\".").WithDefault("all"),
 		cmds.BoolOption(pinQuietOptionName, "q", "Write just hashes of objects."),
 		cmds.BoolOption(pinStreamOptionName, "s", "Enable streaming of pins as they are discovered."),
+		cmds.StringOption(pinNameOptionName, "List the named pins whose name starts with this prefix."),
 	},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
 		api, err := cmdenv.GetApi(env, req)
@@ -341,6 +464,13 @@ Example:
 			return err
 		}
 
+		if prefix, ok := req.Options[pinNameOptionName].(string); ok {
+			if len(req.Arguments) > 0 {
+				return fmt.Errorf("--%s lists pins by name, without paths", pinNameOptionName)
+			}
+			return pinLsNamed(req, typeStr, api, prefix, res.Emit)
+		}
+
 		// For backward compatibility, we accumulate the pins in the same output type as before.
 		emit := res.Emit
 		lgcList := map[string]PinLsType{}
@@ -376,7 +506,7 @@ Example:
 
 			enc := json.NewEncoder(w)
 
-			if stream {
+			if stream || out.PinLsObject.Name != "" {
 				return enc.Encode(out.PinLsObject)
 			}
 
@@ -386,9 +516,11 @@ Example:
 			quiet, _ := req.Options[pinQuietOptionName].(bool)
 			stream, _ := req.Options[pinStreamOptionName].(bool)
 
-			if stream {
+			if stream || out.PinLsObject.Name != "" {
 				if quiet {
 					fmt.Fprintf(w, "%s\n", out.PinLsObject.Cid)
+				} else if out.PinLsObject.Name != "" {
+					fmt.Fprintf(w, "%s %s %s%s\n", out.PinLsObject.Cid, out.PinLsObject.Type, out.PinLsObject.Name, formatMeta(out.PinLsObject.Meta))
 				} else {
 					fmt.Fprintf(w, "%s %s\n", out.PinLsObject.Cid, out.PinLsObject.Type)
 				}
@@ -428,8 +560,25 @@ type PinLsType struct {
 
 // PinLsObject contains the description of a pin
 type PinLsObject struct {
-	Cid  string `json:",omitempty"`
-	Type string `json:",omitempty"`
+	Cid  string            `json:",omitempty"`
+	Type string            `json:",omitempty"`
+	Name string            `json:",omitempty"`
+	Meta map[string]string `json:",omitempty"`
+}
+
+// formatMeta formats metadata as space separated key=value pairs, sorted by
+// key.
+func formatMeta(meta map[string]string) string {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%s", k, meta[k])
+	}
+	return b.String()
 }
 
 func pinLsKeys(req *cmds.Request, typeStr string, api coreiface.CoreAPI, emit func(value interface{}) error) error {
@@ -525,6 +674,45 @@ func pinLsAll(req *cmds.Request, typeStr string, api coreiface.CoreAPI, emit fun
 	return nil
 }
 
+func pinLsNamed(req *cmds.Request, typeStr string, api coreiface.CoreAPI, prefix string, emit func(value interface{}) error) error {
+	enc, err := cmdenv.GetCidEncoder(req)
+	if err != nil {
+		return err
+	}
+
+	named, err := namedPinAPI(api)
+	if err != nil {
+		return err
+	}
+	pins, err := named.LsNamed(req.Context, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pins {
+		pinType := "direct"
+		if p.Recursive {
+			pinType = "recursive"
+		}
+		if typeStr != "all" && typeStr != pinType {
+			continue
+		}
+		err = emit(&PinLsOutputWrapper{
+			PinLsObject: PinLsObject{
+				Type: pinType,
+				Cid:  enc.Encode(p.Cid),
+				Name: p.Name,
+				Meta: p.Meta,
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 const (
 	pinUnpinOptionName = "unpin"
 )
@@ -541,15 +729,23 @@ derivative of an existing one, particularly for large objects. This allows a mor
 efficient DAG-traversal which fully skips already-pinned branches from the old
 object. As a requirement, the old object needs to be an existing recursive
 pin.
+
+With --name, the named pin is updated instead of the pin of from-path,
+which is then omitted, and --meta key=value pairs are merged into its
+metadata. The old pin is kept while other names have it.
 `,
 	},
 
 	Arguments: []cmds.Argument{
-		cmds.StringArg("from-path", true, false, "Path to old object."),
-		cmds.StringArg("to-path", true, false, "Path to a new object to be pinned."),
+		// Both are optional, as --name replaces from-path, and a required
+		// argument can not follow an optional one.
+		cmds.StringArg("from-path", false, false, "Path to old object."),
+		cmds.StringArg("to-path", false, false, "Path to a new object to be pinned."),
 	},
 	Options: []cmds.Option{
 		cmds.BoolOption(pinUnpinOptionName, "Remove the old pin.").WithDefault(true),
+		cmds.StringOption(pinNameOptionName, "Name of the pin to update."),
+		cmds.StringsOption(pinMetaOptionName, "Metadata to merge into the named pin, as key=value."),
 	},
 	Type: PinOutput{},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
@@ -564,6 +760,32 @@ pin.
 		}
 
 		unpin, _ := req.Options[pinUnpinOptionName].(bool)
+		name, meta, err := pinNameOptions(req)
+		if err != nil {
+			return err
+		}
+
+		if name != "" {
+			if len(req.Arguments) != 1 {
+				return fmt.Errorf("--%s updates a pin by name to to-path, without from-path", pinNameOptionName)
+			}
+			named, err := namedPinAPI(api)
+			if err != nil {
+				return err
+			}
+			to, err := api.ResolvePath(req.Context, path.New(req.Arguments[0]))
+			if err != nil {
+				return err
+			}
+			from, err := named.UpdateNamed(req.Context, name, to, meta, options.Pin.Unpin(unpin))
+			if err != nil {
+				return err
+			}
+			return cmds.EmitOnce(res, &PinOutput{Pins: []string{enc.Encode(from.Cid), enc.Encode(to.Cid())}, Name: name})
+		}
+		if len(req.Arguments) != 2 {
+			return errors.New("arguments \"from-path\" and \"to-path\" are required")
+		}
 
 		// Resolve the paths ahead of time so we can return the actual CIDs
 		from, err := api.ResolvePath(req.Context, path.New(req.Arguments[0]))
@@ -584,6 +806,10 @@ pin.
 	},
 	Encoders: cmds.EncoderMap{
 		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *PinOutput) error {
+			if out.Name != "" {
+				fmt.Fprintf(w, "updated %s from %s to %s\n", out.Name, out.Pins[0], out.Pins[1])
+				return nil
+			}
 			fmt.Fprintf(w, "updated %s to %s\n", out.Pins[0], out.Pins[1])
 			return nil
 		}),
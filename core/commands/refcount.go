@@ -0,0 +1,91 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+)
+
+// RefIndexOutput is the output type of the repo refcount commands.
+type RefIndexOutput struct {
+	Enabled bool
+	Blocks  int `json:",omitempty"`
+}
+
+var repoRefcountCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Manage the reference count index of pinned blocks.",
+		ShortDescription: `
+The refcount index counts the pins keeping each block. Once built, it is
+updated as pins are added and removed, and 'ipfs repo gc --mode=refcount'
+deletes the blocks no pin keeps without walking the DAG of every pin.
+Only the contents of the files API are still walked.
+
+Updating the index walks the DAG of each pin added or removed. The index
+is dropped when it can not be updated, and must be rebuilt to be used
+again. 'ipfs repo verify' checks it against the pins.
+`,
+	},
+	Subcommands: map[string]*cmds.Command{
+		"rebuild": repoRefcountRebuildCmd,
+		"drop":    repoRefcountDropCmd,
+	},
+}
+
+var repoRefcountRebuildCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Build the refcount index from the pins.",
+		ShortDescription: `
+Count the references of every pin from scratch and enable the index.
+Adding and removing pins waits until the index is built.
+`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		blocks, err := n.RefIndex.Rebuild(req.Context, n.Pinning)
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, &RefIndexOutput{Enabled: true, Blocks: blocks})
+	},
+	Type: RefIndexOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *RefIndexOutput) error {
+			_, err := fmt.Fprintf(w, "refcount index built, %d pinned blocks\n", out.Blocks)
+			return err
+		}),
+	},
+}
+
+var repoRefcountDropCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Delete the refcount index.",
+		ShortDescription: `
+Delete the refcount index and stop updating it. Pins are no longer
+counted until the index is rebuilt.
+`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if err := n.RefIndex.Drop(); err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, &RefIndexOutput{})
+	},
+	Type: RefIndexOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *RefIndexOutput) error {
+			_, err := fmt.Fprintln(w, "refcount index dropped")
+			return err
+		}),
+	},
+}
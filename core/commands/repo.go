@@ -10,10 +10,12 @@ import (
 	"strings"
 	"sync"
 	"text/tabwriter"
+	"time"
 
 	humanize "github.com/dustin/go-humanize"
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
 	corerepo "github.com/ipfs/go-ipfs/core/corerepo"
+	"github.com/ipfs/go-ipfs/gc"
 	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
 
 	cid "github.com/ipfs/go-cid"
@@ -34,11 +36,12 @@ var RepoCmd = &cmds.Command{
 	},
 
 	Subcommands: map[string]*cmds.Command{
-		"stat":    repoStatCmd,
-		"gc":      repoGcCmd,
-		"fsck":    repoFsckCmd,
-		"version": repoVersionCmd,
-		"verify":  repoVerifyCmd,
+		"stat":     repoStatCmd,
+		"gc":       repoGcCmd,
+		"fsck":     repoFsckCmd,
+		"version":  repoVersionCmd,
+		"verify":   repoVerifyCmd,
+		"refcount": repoRefcountCmd,
 	},
 }
 
@@ -46,11 +49,28 @@ var RepoCmd = &cmds.Command{
 type GcResult struct {
 	Key   cid.Cid
 	Error string `json:",omitempty"`
+	// DryRun is the only result of a dry run.
+	DryRun *gc.Report `json:",omitempty"`
+}
+
+// GcExplainResult is the result returned by "repo gc explain" command.
+type GcExplainResult struct {
+	Key     cid.Cid
+	Reasons []gc.Reason
 }
 
 const (
 	repoStreamErrorsOptionName = "stream-errors"
 	repoQuietOptionName        = "quiet"
+	repoGcModeOptionName       = "mode"
+	repoGcDryRunOptionName     = "dry-run"
+)
+
+// Collection modes of repo gc.
+const (
+	repoGcModeMarkSweep   = "mark-sweep"
+	repoGcModeIncremental = "incremental"
+	repoGcModeRefcount    = "refcount"
 )
 
 var repoGcCmd = &cmds.Command{
@@ -60,11 +80,30 @@ var repoGcCmd = &cmds.Command{
 'ipfs repo gc' is a plumbing command that will sweep the local
 set of stored objects and remove ones that are not pinned in
 order to reclaim hard disk space.
+
+With --mode=incremental, objects are marked while the node keeps
+adding and pinning, which only pauses for a short final phase. A
+collection that is interrupted resumes where it left off the next
+time it runs. This mode is experimental.
+
+With --mode=refcount, objects are removed when the refcount index
+counts no pin keeping them, without marking the objects of every
+pin. The index must be built first with 'ipfs repo refcount rebuild'.
+
+With --dry-run, nothing is removed. The objects that would be removed
+are listed with the bytes they take, grouped by the removed pin or
+files API path that last referenced them. Objects are marked as with
+--mode=mark-sweep. 'ipfs repo gc explain' tells why an object is kept.
 `,
 	},
+	Subcommands: map[string]*cmds.Command{
+		"explain": repoGcExplainCmd,
+	},
 	Options: []cmds.Option{
 		cmds.BoolOption(repoStreamErrorsOptionName, "Stream errors."),
 		cmds.BoolOption(repoQuietOptionName, "q", "Write minimal output."),
+		cmds.StringOption(repoGcModeOptionName, "How to find unpinned objects: mark-sweep, incremental or refcount.").WithDefault(repoGcModeMarkSweep),
+		cmds.BoolOption(repoGcDryRunOptionName, "Report the objects that would be removed without removing them."),
 	},
 	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
 		n, err := cmdenv.GetNode(env)
@@ -72,9 +111,27 @@ order to reclaim hard disk space.
 			return err
 		}
 
+		if dryRun, _ := req.Options[repoGcDryRunOptionName].(bool); dryRun {
+			report, err := corerepo.GarbageCollectDryRun(n, req.Context)
+			if err != nil {
+				return err
+			}
+			return cmds.EmitOnce(re, &GcResult{DryRun: report})
+		}
+
 		streamErrors, _ := req.Options[repoStreamErrorsOptionName].(bool)
 
-		gcOutChan := corerepo.GarbageCollectAsync(n, req.Context)
+		var gcOutChan <-chan gc.Result
+		switch mode, _ := req.Options[repoGcModeOptionName].(string); mode {
+		case repoGcModeMarkSweep:
+			gcOutChan = corerepo.GarbageCollectAsync(n, req.Context)
+		case repoGcModeIncremental:
+			gcOutChan = corerepo.IncrementalGarbageCollectAsync(n, req.Context)
+		case repoGcModeRefcount:
+			gcOutChan = corerepo.RefcountGarbageCollectAsync(n, req.Context)
+		default:
+			return fmt.Errorf("unknown gc mode %q, expected %s, %s or %s", mode, repoGcModeMarkSweep, repoGcModeIncremental, repoGcModeRefcount)
+		}
 
 		if streamErrors {
 			errs := false
@@ -116,6 +173,9 @@ order to reclaim hard disk space.
 				_, err := fmt.Fprintf(w, "Error: %s\n", gcr.Error)
 				return err
 			}
+			if gcr.DryRun != nil {
+				return writeGcReport(w, gcr.DryRun, quiet)
+			}
 
 			prefix := "removed "
 			if quiet {
@@ -128,6 +188,98 @@ order to reclaim hard disk space.
 	},
 }
 
+func writeGcReport(w io.Writer, report *gc.Report, quiet bool) error {
+	for _, g := range report.Groups {
+		if !quiet {
+			_, err := fmt.Fprintf(w, "%d objects, %s, %s\n", len(g.Blocks), humanize.Bytes(g.Bytes), describeReferrer(g.Referrer))
+			if err != nil {
+				return err
+			}
+		}
+		for _, k := range g.Blocks {
+			indent := "  "
+			if quiet {
+				indent = ""
+			}
+			if _, err := fmt.Fprintf(w, "%s%s\n", indent, k); err != nil {
+				return err
+			}
+		}
+	}
+	if quiet {
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "would remove %d objects, %s\n", report.Blocks, humanize.Bytes(report.Bytes))
+	return err
+}
+
+func describeReferrer(ref gc.Referrer) string {
+	when := ref.Time.Format(time.RFC3339)
+	switch ref.Kind {
+	case "":
+		return "not referenced by a removed pin or files path"
+	case gc.KindFiles:
+		return fmt.Sprintf("last in files path %s, changed %s", ref.Path, when)
+	default:
+		return fmt.Sprintf("last in %s %s, removed %s", ref.Kind, ref.Cid, when)
+	}
+}
+
+var repoGcExplainCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Tell why an object is kept by garbage collection.",
+		ShortDescription: `
+'ipfs repo gc explain' lists what keeps an object from being removed:
+a direct pin of the object, the recursive pins containing it with its
+path from the pin, the files API path of the object, or another root
+gc keeps the objects of. An object kept by nothing is removed by the
+next 'ipfs repo gc'.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("cid", true, false, "CID of the object to explain."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		k, err := cid.Decode(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+		reasons, err := corerepo.ExplainRetention(n, req.Context, k)
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, &GcExplainResult{Key: k, Reasons: reasons})
+	},
+	Type: GcExplainResult{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *GcExplainResult) error {
+			if len(out.Reasons) == 0 {
+				_, err := fmt.Fprintf(w, "%s is not kept, the next gc removes it\n", out.Key)
+				return err
+			}
+			for _, r := range out.Reasons {
+				var err error
+				switch {
+				case r.Kind == gc.KindFiles:
+					_, err = fmt.Fprintf(w, "kept by files path %s\n", r.Path)
+				case r.Path != "":
+					_, err = fmt.Fprintf(w, "kept by %s %s, at %s\n", r.Kind, r.Root, r.Path)
+				default:
+					_, err = fmt.Fprintf(w, "kept by %s %s\n", r.Kind, r.Root)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	},
+}
+
 const (
 	repoSizeOnlyOptionName = "size-only"
 	repoHumanOptionName    = "human"
@@ -280,6 +432,10 @@ func verifyResultChan(ctx context.Context, keys <-chan cid.Cid, bs bstore.Blocks
 var repoVerifyCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline: "Verify all blocks in repo are not corrupted.",
+		ShortDescription: `
+Rehash every block of the repo. When the refcount index is built, also
+check that it counts the references of the current pins.
+`,
 	},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
 		nd, err := cmdenv.GetNode(env)
@@ -317,9 +473,38 @@ var repoVerifyCmd = &cmds.Command{
 			return err
 		}
 
+		// Check the refcount index against the pins when it is used.
+		var refFails int
+		enabled, err := nd.RefIndex.Enabled()
+		if err != nil {
+			return err
+		}
+		if enabled {
+			mismatches, err := nd.RefIndex.Check(req.Context, nd.Pinning)
+			if err != nil && err != gc.ErrRefIndexStale {
+				return err
+			}
+			for _, m := range mismatches {
+				msg := fmt.Sprintf("refcount of %s is %d, expected %d", m.Cid, m.Count, m.Expected)
+				if err := res.Emit(&VerifyProgress{Msg: msg}); err != nil {
+					return err
+				}
+			}
+			refFails = len(mismatches)
+			if err == gc.ErrRefIndexStale {
+				if err := res.Emit(&VerifyProgress{Msg: err.Error()}); err != nil {
+					return err
+				}
+				refFails++
+			}
+		}
+
 		if fails != 0 {
 			return errors.New("verify complete, some blocks were corrupt")
 		}
+		if refFails != 0 {
+			return errors.New("verify complete, the refcount index is inconsistent, run 'ipfs repo refcount rebuild'")
+		}
 
 		return res.Emit(&VerifyProgress{Msg: "verify complete, all blocks validated."})
 	},
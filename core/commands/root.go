@@ -131,9 +131,11 @@ var rootSubcommands = map[string]*cmds.Command{
 	"diag":      DiagCmd,
 	"dns":       DNSCmd,
 	"id":        IDCmd,
+	"inspector": InspectorCmd,
 	"key":       KeyCmd,
 	"log":       LogCmd,
 	"ls":        LsCmd,
+	"miner":     MinerCmd,
 	"mount":     MountCmd,
 	"name":      name.NameCmd,
 	"object":    ocmd.ObjectCmd,
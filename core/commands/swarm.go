@@ -50,6 +50,7 @@ ipfs peers in the internet.
 		"connect":    swarmConnectCmd,
 		"disconnect": swarmDisconnectCmd,
 		"filters":    swarmFiltersCmd,
+		"key":        swarmKeyCmd,
 		"peers":      swarmPeersCmd,
 	},
 }
@@ -0,0 +1,288 @@
+package commands
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	libp2p "github.com/ipfs/go-ipfs/core/node/libp2p"
+	repo "github.com/ipfs/go-ipfs/repo"
+	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+)
+
+const (
+	swarmKeyForceOptionName = "force"
+	// maxSwarmKeySize bounds the size of a swarm key file read by install.
+	maxSwarmKeySize = 1024
+)
+
+var errSwarmKeyExists = errors.New("the repo already has a swarm key, use --force to replace it")
+
+// SwarmKeyOutput describes the swarm key in use.
+type SwarmKeyOutput struct {
+	Source      string
+	Path        string `json:",omitempty"`
+	Fingerprint string `json:",omitempty"`
+}
+
+// SwarmKeyGenerateOutput is output type of swarm key generate command
+type SwarmKeyGenerateOutput struct {
+	Key string
+}
+
+var swarmKeyCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Manage the private network swarm key.",
+		ShortDescription: `
+The swarm key limits the swarm to peers sharing the same key. The
+SwarmKeySource config key selects where it comes from:
+
+  "embedded"  the key built into this binary
+  "repo"      the swarm.key file of the repo
+  "public"    no key, join the public network
+
+When SwarmKeySource is not set, the repo file is used if it exists and the
+embedded key otherwise. Changes take effect when the daemon is restarted.
+`,
+	},
+	Subcommands: map[string]*cmds.Command{
+		"show":        swarmKeyShowCmd,
+		"generate":    swarmKeyGenerateCmd,
+		"install":     swarmKeyInstallCmd,
+		"fingerprint": swarmKeyFingerprintCmd,
+	},
+}
+
+var swarmKeyShowCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Show which swarm key is in use.",
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		cfgRoot, err := cmdenv.GetConfigRoot(env)
+		if err != nil {
+			return err
+		}
+		r, err := fsrepo.Open(cfgRoot)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		out, err := swarmKeyInfo(r, cfgRoot)
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, out)
+	},
+	Type: SwarmKeyOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *SwarmKeyOutput) error {
+			switch out.Source {
+			case repo.SwarmKeyPublic:
+				fmt.Fprintln(w, "Source: public network, no swarm key")
+				return nil
+			case repo.SwarmKeyRepo:
+				fmt.Fprintf(w, "Source: repo file %s\n", out.Path)
+			default:
+				fmt.Fprintln(w, "Source: key embedded in this binary")
+			}
+			fmt.Fprintf(w, "Fingerprint: %s\n", out.Fingerprint)
+			return nil
+		}),
+	},
+}
+
+var swarmKeyGenerateCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Generate a new swarm key.",
+		ShortDescription: `
+Print a new random swarm key. Install it on every node of the private network
+with 'ipfs swarm key install'.
+`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, &SwarmKeyGenerateOutput{
+			Key: "/key/swarm/psk/1.0.0/\n/base16/\n" + hex.EncodeToString(key[:]) + "\n",
+		})
+	},
+	Type: SwarmKeyGenerateOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *SwarmKeyGenerateOutput) error {
+			_, err := io.WriteString(w, out.Key)
+			return err
+		}),
+	},
+	Extra: CreateCmdExtras(SetDoesNotUseRepo(true)),
+}
+
+var swarmKeyInstallCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Install a swarm key in the repo.",
+		ShortDescription: `
+Write the swarm key to the swarm.key file of the repo and set SwarmKeySource
+to "repo". The daemon must be restarted to join the private network.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.FileArg("key", true, false, "The swarm key file to install.").EnableStdin(),
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(swarmKeyForceOptionName, "f", "Replace an existing swarm key."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		cfgRoot, err := cmdenv.GetConfigRoot(env)
+		if err != nil {
+			return err
+		}
+		file, err := cmdenv.GetFileArg(req.Files.Entries())
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		key, err := ioutil.ReadAll(io.LimitReader(file, maxSwarmKeySize))
+		if err != nil {
+			return err
+		}
+		fp, err := libp2p.SwarmKeyFingerprint(key)
+		if err != nil {
+			return fmt.Errorf("invalid swarm key: %w", err)
+		}
+
+		r, err := fsrepo.Open(cfgRoot)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		path := filepath.Join(cfgRoot, fsrepo.SwarmKeyFile)
+		force, _ := req.Options[swarmKeyForceOptionName].(bool)
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if force {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		f, err := os.OpenFile(path, flags, 0600)
+		if os.IsExist(err) {
+			return errSwarmKeyExists
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(key); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := r.SetConfigKey(repo.SwarmKeySourceKey, repo.SwarmKeyRepo); err != nil {
+			return err
+		}
+
+		return cmds.EmitOnce(res, &SwarmKeyOutput{
+			Source:      repo.SwarmKeyRepo,
+			Path:        path,
+			Fingerprint: fmt.Sprintf("%x", fp),
+		})
+	},
+	Type: SwarmKeyOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *SwarmKeyOutput) error {
+			fmt.Fprintf(w, "Installed swarm key %s in %s\n", out.Fingerprint, out.Path)
+			fmt.Fprintln(w, "Restart the daemon to join the private network.")
+			return nil
+		}),
+	},
+}
+
+var swarmKeyFingerprintCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Print the fingerprint of a swarm key.",
+		ShortDescription: `
+Print the fingerprint of the given swarm key file, or of the key in use when
+no file is given. Nodes with the same fingerprint share a private network.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.FileArg("key", false, false, "The swarm key file."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		if req.Files != nil {
+			file, err := cmdenv.GetFileArg(req.Files.Entries())
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			key, err := ioutil.ReadAll(io.LimitReader(file, maxSwarmKeySize))
+			if err != nil {
+				return err
+			}
+			fp, err := libp2p.SwarmKeyFingerprint(key)
+			if err != nil {
+				return fmt.Errorf("invalid swarm key: %w", err)
+			}
+			return cmds.EmitOnce(res, &SwarmKeyOutput{Fingerprint: fmt.Sprintf("%x", fp)})
+		}
+
+		cfgRoot, err := cmdenv.GetConfigRoot(env)
+		if err != nil {
+			return err
+		}
+		r, err := fsrepo.Open(cfgRoot)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		out, err := swarmKeyInfo(r, cfgRoot)
+		if err != nil {
+			return err
+		}
+		if out.Source == repo.SwarmKeyPublic {
+			return errors.New("no swarm key in use, the node joins the public network")
+		}
+		return cmds.EmitOnce(res, out)
+	},
+	Type: SwarmKeyOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *SwarmKeyOutput) error {
+			fmt.Fprintln(w, out.Fingerprint)
+			return nil
+		}),
+	},
+}
+
+func swarmKeyInfo(r repo.Repo, cfgRoot string) (*SwarmKeyOutput, error) {
+	source, err := r.SwarmKeySource()
+	if err != nil {
+		return nil, err
+	}
+	out := &SwarmKeyOutput{Source: source}
+	if source == repo.SwarmKeyPublic {
+		return out, nil
+	}
+	if source == repo.SwarmKeyRepo {
+		out.Path = filepath.Join(cfgRoot, fsrepo.SwarmKeyFile)
+	}
+	key, err := r.SwarmKey()
+	if err != nil {
+		return nil, err
+	}
+	fp, err := libp2p.SwarmKeyFingerprint(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid swarm key: %w", err)
+	}
+	out.Fingerprint = fmt.Sprintf("%x", fp)
+	return out, nil
+}
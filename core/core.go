@@ -45,6 +45,9 @@ import (
 	"github.com/ipfs/go-ipfs/core/node"
 	"github.com/ipfs/go-ipfs/core/node/libp2p"
 	"github.com/ipfs/go-ipfs/fuse/mount"
+	"github.com/ipfs/go-ipfs/gc"
+	minerapi "github.com/ipfs/go-ipfs/miner/api"
+	"github.com/ipfs/go-ipfs/namedpin"
 	"github.com/ipfs/go-ipfs/p2p"
 	"github.com/ipfs/go-ipfs/peering"
 	"github.com/ipfs/go-ipfs/repo"
@@ -64,6 +67,7 @@ type IpfsNode struct {
 
 	// Local node
 	Pinning         pin.Pinner             // the pinning manager
+	PinNames        *namedpin.Store        // the names and metadata of pins
 	Mounts          Mounts                 `optional:"true"` // current mount state, if any.
 	PrivateKey      ic.PrivKey             `optional:"true"` // the local node's private Key
 	PNetFingerprint libp2p.PNetFingerprint `optional:"true"` // fingerprint of private network
@@ -74,6 +78,10 @@ type IpfsNode struct {
 	Filestore       *filestore.Filestore      `optional:"true"` // the filestore blockstore
 	BaseBlocks      node.BaseBlocks           // the raw blockstore, no filestore wrapping
 	GCLocker        bstore.GCLocker           // the locker used to protect the blockstore during gc
+	GCBarrier       *gc.Barrier               // the write barrier of incremental gc
+	RefIndex        *gc.RefIndex              // the reference counts of pinned blocks
+	GCHistory       *gc.History               // the former pins and files roots of blocks
+	AccessIndex     *gc.AccessIndex           // the access times of blocks, nil when untracked
 	Blocks          bserv.BlockService        // the block service, get/add blocks.
 	DAG             ipld.DAGService           // the merkle dag service, get/add objects.
 	Resolver        *resolver.Resolver        // the path resolution system
@@ -99,6 +107,11 @@ type IpfsNode struct {
 	DHT      *ddht.DHT                  `optional:"true"`
 	P2P      *p2p.P2P                   `optional:"true"`
 
+	Miner     minerapi.Miner     `optional:"true"` // set once mining is started
+	Inspector minerapi.Inspector `optional:"true"` // set once inspecting is started
+
+	ShutdownHooks *node.ShutdownHooks // teardown of services started after construction
+
 	Process goprocess.Process
 	ctx     context.Context
 
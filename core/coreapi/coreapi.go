@@ -39,6 +39,7 @@ import (
 
 	"github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/core/node"
+	"github.com/ipfs/go-ipfs/namedpin"
 	"github.com/ipfs/go-ipfs/repo"
 	"github.com/ipfs/go-namesys"
 )
@@ -53,6 +54,7 @@ type CoreAPI struct {
 	blockstore blockstore.GCBlockstore
 	baseBlocks blockstore.Blockstore
 	pinning    pin.Pinner
+	pinNames   *namedpin.Store
 
 	blocks bserv.BlockService
 	dag    ipld.DAGService
@@ -164,6 +166,7 @@ func (api *CoreAPI) WithOptions(opts ...options.ApiOption) (coreiface.CoreAPI, e
 		blockstore: n.Blockstore,
 		baseBlocks: n.BaseBlocks,
 		pinning:    n.Pinning,
+		pinNames:   n.PinNames,
 
 		blocks: n.Blocks,
 		dag:    n.DAG,
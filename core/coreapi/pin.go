@@ -12,10 +12,39 @@ import (
 	coreiface "github.com/ipfs/interface-go-ipfs-core"
 	caopts "github.com/ipfs/interface-go-ipfs-core/options"
 	"github.com/ipfs/interface-go-ipfs-core/path"
+
+	"github.com/ipfs/go-ipfs/namedpin"
 )
 
 type PinAPI CoreAPI
 
+// NamedPinAPI extends coreiface.PinAPI with names and metadata of pins. The
+// PinAPI of this node implements it.
+type NamedPinAPI interface {
+	coreiface.PinAPI
+
+	// AddNamed pins p under a new name. A pin that exists already is
+	// reused, and kept when its names are removed.
+	AddNamed(ctx context.Context, p path.Path, name string, meta map[string]string, opts ...caopts.PinAddOption) error
+
+	// LsNamed returns the named pins whose name starts with prefix.
+	LsNamed(ctx context.Context, prefix string) ([]namedpin.Pin, error)
+
+	// Names returns the named pins of c. Removing the pins of c with Rm
+	// removes their names.
+	Names(ctx context.Context, c cid.Cid) ([]namedpin.Pin, error)
+
+	// UpdateNamed moves the recursive pin named name to p, merging meta
+	// into its metadata. It returns the named pin before the update.
+	UpdateNamed(ctx context.Context, name string, p path.Path, meta map[string]string, opts ...caopts.PinUpdateOption) (namedpin.Pin, error)
+
+	// RmNamed removes a name, and the pin once it has no name left unless
+	// it was also pinned without a name. It returns the removed named pin.
+	RmNamed(ctx context.Context, name string) (namedpin.Pin, error)
+}
+
+var _ NamedPinAPI = (*PinAPI)(nil)
+
 func (api *PinAPI) Add(ctx context.Context, p path.Path, opts ...caopts.PinAddOption) error {
 	dagNode, err := api.core().ResolveNode(ctx, p)
 	if err != nil {
@@ -337,3 +366,214 @@ func (api *PinAPI) pinLsAll(ctx context.Context, typeStr string) <-chan coreifac
 func (api *PinAPI) core() coreiface.CoreAPI {
 	return (*CoreAPI)(api)
 }
+
+func (api *PinAPI) AddNamed(ctx context.Context, p path.Path, name string, meta map[string]string, opts ...caopts.PinAddOption) error {
+	if err := namedpin.ValidateName(name); err != nil {
+		return err
+	}
+	if _, err := api.pinNames.Get(name); err != namedpin.ErrNotFound {
+		if err == nil {
+			return fmt.Errorf("pin: %q: %w", name, namedpin.ErrNameExists)
+		}
+		return err
+	}
+
+	dagNode, err := api.core().ResolveNode(ctx, p)
+	if err != nil {
+		return fmt.Errorf("pin: %s", err)
+	}
+
+	settings, err := caopts.PinAddOptions(opts...)
+	if err != nil {
+		return err
+	}
+
+	defer api.blockstore.PinLock().Unlock()
+
+	// The name owns the pin only if the pin is created for it, or exists
+	// only for other names.
+	owned, created, err := api.namedPinOwner(ctx, dagNode.Cid(), settings.Recursive)
+	if err != nil {
+		return err
+	}
+	if created {
+		err = api.pinning.Pin(ctx, dagNode, settings.Recursive)
+		if err != nil {
+			return fmt.Errorf("pin: %s", err)
+		}
+	}
+
+	if err := api.provider.Provide(dagNode.Cid()); err != nil {
+		return err
+	}
+
+	if err := api.pinning.Flush(ctx); err != nil {
+		return err
+	}
+
+	err = api.pinNames.Create(namedpin.Pin{
+		Name:      name,
+		Cid:       dagNode.Cid(),
+		Recursive: settings.Recursive,
+		Meta:      meta,
+		Owned:     owned,
+	})
+	if err == nil {
+		return nil
+	}
+	if created {
+		// Another pin took the name meanwhile. The pin is kept if
+		// another name reused it.
+		if uerr := api.pinning.Unpin(ctx, dagNode.Cid(), settings.Recursive); uerr != nil {
+			return fmt.Errorf("pin: %q: %w, and removing its pin failed: %s", name, err, uerr)
+		}
+		if ferr := api.pinning.Flush(ctx); ferr != nil {
+			return ferr
+		}
+	}
+	if err == namedpin.ErrNameExists {
+		return fmt.Errorf("pin: %q: %w", name, err)
+	}
+	return err
+}
+
+// namedPinOwner tells whether a new name of the recursive or direct pin of k
+// owns it, and whether the pin must be created for the name. A pin that
+// exists owns its names when only names keep it. A recursive pin replacing a
+// direct one is not owned, as removing it would remove the direct pin.
+func (api *PinAPI) namedPinOwner(ctx context.Context, k cid.Cid, recursive bool) (owned, create bool, err error) {
+	mode := pin.Direct
+	if recursive {
+		mode = pin.Recursive
+	}
+	_, pinned, err := api.pinning.IsPinnedWithType(ctx, k, mode)
+	if err != nil {
+		return false, false, err
+	}
+	if pinned {
+		owned, err := api.pinNames.Owned(k, recursive)
+		return owned, false, err
+	}
+	if recursive {
+		_, direct, err := api.pinning.IsPinnedWithType(ctx, k, pin.Direct)
+		if err != nil || direct {
+			return false, true, err
+		}
+	}
+	return true, true, nil
+}
+
+func (api *PinAPI) LsNamed(ctx context.Context, prefix string) ([]namedpin.Pin, error) {
+	return api.pinNames.List(prefix)
+}
+
+func (api *PinAPI) Names(ctx context.Context, c cid.Cid) ([]namedpin.Pin, error) {
+	return api.pinNames.Names(c)
+}
+
+func (api *PinAPI) UpdateNamed(ctx context.Context, name string, p path.Path, meta map[string]string, opts ...caopts.PinUpdateOption) (namedpin.Pin, error) {
+	settings, err := caopts.PinUpdateOptions(opts...)
+	if err != nil {
+		return namedpin.Pin{}, err
+	}
+
+	old, err := api.pinNames.Get(name)
+	if err != nil {
+		return old, fmt.Errorf("pin %q: %w", name, err)
+	}
+	if !old.Recursive {
+		return old, fmt.Errorf("pin %q is not recursive, only recursive pins can be updated", name)
+	}
+
+	tp, err := api.core().ResolvePath(ctx, p)
+	if err != nil {
+		return old, err
+	}
+
+	defer api.blockstore.PinLock().Unlock()
+
+	// The old pin stays while other names have it, and when it was also
+	// pinned without a name.
+	unpin := settings.Unpin && old.Owned
+	if unpin {
+		others, err := api.otherNames(old)
+		if err != nil {
+			return old, err
+		}
+		unpin = len(others) == 0
+	}
+	owned := old.Owned
+	if !tp.Cid().Equals(old.Cid) {
+		if owned, _, err = api.namedPinOwner(ctx, tp.Cid(), true); err != nil {
+			return old, err
+		}
+	}
+
+	err = api.pinning.Update(ctx, old.Cid, tp.Cid(), unpin)
+	if err != nil {
+		return old, err
+	}
+
+	np := old
+	np.Cid = tp.Cid()
+	np.Owned = owned
+	np.Meta = make(map[string]string, len(old.Meta)+len(meta))
+	for k, v := range old.Meta {
+		np.Meta[k] = v
+	}
+	for k, v := range meta {
+		np.Meta[k] = v
+	}
+	if err := api.pinNames.Put(np); err != nil {
+		return old, err
+	}
+
+	return old, api.pinning.Flush(ctx)
+}
+
+func (api *PinAPI) RmNamed(ctx context.Context, name string) (namedpin.Pin, error) {
+	np, err := api.pinNames.Get(name)
+	if err != nil {
+		return np, fmt.Errorf("pin %q: %w", name, err)
+	}
+
+	defer api.blockstore.PinLock().Unlock()
+
+	if err := api.pinNames.Delete(name); err != nil {
+		return np, err
+	}
+
+	others, err := api.otherNames(np)
+	if err != nil || len(others) > 0 || !np.Owned {
+		return np, err
+	}
+
+	mode := pin.Direct
+	if np.Recursive {
+		mode = pin.Recursive
+	}
+	_, pinned, err := api.pinning.IsPinnedWithType(ctx, np.Cid, mode)
+	if err != nil || !pinned {
+		return np, err
+	}
+	if err := api.pinning.Unpin(ctx, np.Cid, np.Recursive); err != nil {
+		return np, err
+	}
+
+	return np, api.pinning.Flush(ctx)
+}
+
+// otherNames returns the names other than the name of np of the same pin.
+func (api *PinAPI) otherNames(np namedpin.Pin) ([]namedpin.Pin, error) {
+	pins, err := api.pinNames.Names(np.Cid)
+	if err != nil {
+		return nil, err
+	}
+	var others []namedpin.Pin
+	for _, p := range pins {
+		if p.Name != np.Name && p.Recursive == np.Recursive {
+			others = append(others, p)
+		}
+	}
+	return others, nil
+}
@@ -0,0 +1,102 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-ipfs/core/coreapi"
+
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+func TestNamedPinOwnership(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	apis, err := NodeProvider{}.MakeAPISwarm(ctx, false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := apis[0]
+	named := api.Pin().(coreapi.NamedPinAPI)
+
+	add := func(data string) path.Resolved {
+		p, err := api.Unixfs().Add(ctx, files.NewBytesFile([]byte(data)), options.Unixfs.Pin(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	pinned := func(p path.Resolved) bool {
+		pins, err := api.Pin().Ls(ctx, options.Pin.Ls.Recursive())
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for pn := range pins {
+			if pn.Err() != nil {
+				t.Fatal(pn.Err())
+			}
+			found = found || pn.Path().Cid().Equals(p.Cid())
+		}
+		return found
+	}
+
+	// A pin created for names goes with the last of them.
+	own := add("owned")
+	for _, name := range []string{"a", "b"} {
+		if err := named.AddNamed(ctx, own, name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"a", "b"} {
+		if _, err := named.RmNamed(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pinned(own) {
+		t.Error("pin created for names kept after removing them")
+	}
+
+	// A pin added without a name is kept when its names are removed.
+	plain := add("plain")
+	if err := api.Pin().Add(ctx, plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := named.AddNamed(ctx, plain, "c", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := named.RmNamed(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if !pinned(plain) {
+		t.Error("pin added without a name removed with its name")
+	}
+
+	// Removing the pin removes its names.
+	if err := named.AddNamed(ctx, plain, "d", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Pin().Rm(ctx, plain); err != nil {
+		t.Fatal(err)
+	}
+	if pinned(plain) {
+		t.Error("pin with a name kept by rm")
+	}
+	if pins, err := named.Names(ctx, plain.Cid()); err != nil || len(pins) != 0 {
+		t.Errorf("names of a removed pin kept: %+v, %v", pins, err)
+	}
+
+	// A taken name leaves no pin behind.
+	taken := add("taken")
+	if err := named.AddNamed(ctx, own, "e", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := named.AddNamed(ctx, taken, "e", nil); err == nil {
+		t.Fatal("added a name twice")
+	}
+	if pinned(taken) {
+		t.Error("pin of a taken name kept")
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/gc"
+	gcconfig "github.com/ipfs/go-ipfs/gc/config"
 	"github.com/ipfs/go-ipfs/repo"
 
 	"github.com/dustin/go-humanize"
@@ -27,6 +29,11 @@ type GC struct {
 	StorageGC  uint64
 	SlackGB    uint64
 	Storage    uint64
+	// StorageLow is the usage partial retention policies free space down
+	// to.
+	StorageLow uint64
+	Retention  gcconfig.Retention
+	Collector  gcconfig.Collector
 }
 
 func NewGC(n *core.IpfsNode) (*GC, error) {
@@ -65,12 +72,31 @@ func NewGC(n *core.IpfsNode) (*GC, error) {
 		slackGB = 1
 	}
 
+	retention, err := gcconfig.Load(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := retention.Validate(); err != nil {
+		return nil, err
+	}
+	storageLow := storageMax * uint64(retention.Low()) / 100
+	if retention.Partial() && storageLow >= storageGC {
+		return nil, fmt.Errorf("%s.LowWatermark must be below Datastore.StorageGCWatermark", gcconfig.Key)
+	}
+	collector, err := gcconfig.LoadCollector(r)
+	if err != nil {
+		return nil, err
+	}
+
 	return &GC{
 		Node:       n,
 		Repo:       r,
 		StorageMax: storageMax,
 		StorageGC:  storageGC,
 		SlackGB:    slackGB,
+		StorageLow: storageLow,
+		Retention:  retention,
+		Collector:  collector,
 	}, nil
 }
 
@@ -88,7 +114,19 @@ func GarbageCollect(n *core.IpfsNode, ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	rmed := gc.GC(ctx, n.Blockstore, n.Repo.Datastore(), n.Pinning, roots)
+	rmed := pruneHistory(ctx, n, gc.GC(ctx, n.Blockstore, n.Repo.Datastore(), n.Pinning, roots))
+
+	return CollectResult(ctx, rmed, nil)
+}
+
+// Evict removes unpinned blocks in the order of the policy until the target
+// of the policy is freed.
+func Evict(n *core.IpfsNode, ctx context.Context, p gc.EvictPolicy) error {
+	roots, err := BestEffortRoots(n.FilesRoot)
+	if err != nil {
+		return err
+	}
+	rmed := pruneHistory(ctx, n, gc.Evict(ctx, n.Blockstore, n.Repo.Datastore(), n.Pinning, n.AccessIndex, roots, p))
 
 	return CollectResult(ctx, rmed, nil)
 }
@@ -156,7 +194,87 @@ func GarbageCollectAsync(n *core.IpfsNode, ctx context.Context) <-chan gc.Result
 		return out
 	}
 
-	return gc.GC(ctx, n.Blockstore, n.Repo.Datastore(), n.Pinning, roots)
+	return pruneHistory(ctx, n, gc.GC(ctx, n.Blockstore, n.Repo.Datastore(), n.Pinning, roots))
+}
+
+// IncrementalGarbageCollectAsync runs a collection that holds the GC lock
+// only for a short final phase, using the write barrier of the node.
+func IncrementalGarbageCollectAsync(n *core.IpfsNode, ctx context.Context) <-chan gc.Result {
+	roots, err := BestEffortRoots(n.FilesRoot)
+	if err != nil {
+		out := make(chan gc.Result, 1)
+		out <- gc.Result{Error: err}
+		close(out)
+		return out
+	}
+	if n.GCBarrier == nil {
+		out := make(chan gc.Result, 1)
+		out <- gc.Result{Error: errors.New("incremental gc requires the write barrier of the node")}
+		close(out)
+		return out
+	}
+
+	return pruneHistory(ctx, n, gc.Incremental(ctx, n.Blockstore, n.Repo.Datastore(), n.Pinning, roots, n.GCBarrier))
+}
+
+// RefcountGarbageCollectAsync runs a collection deleting the blocks without
+// references in the refcount index of the node.
+func RefcountGarbageCollectAsync(n *core.IpfsNode, ctx context.Context) <-chan gc.Result {
+	roots, err := BestEffortRoots(n.FilesRoot)
+	if err != nil {
+		out := make(chan gc.Result, 1)
+		out <- gc.Result{Error: err}
+		close(out)
+		return out
+	}
+
+	return pruneHistory(ctx, n, gc.Refcount(ctx, n.Blockstore, n.Repo.Datastore(), n.Pinning, n.RefIndex, roots))
+}
+
+// pruneHistory passes on the results of a collection, then forgets the
+// removed pins of the node whose root was collected.
+func pruneHistory(ctx context.Context, n *core.IpfsNode, rmed <-chan gc.Result) <-chan gc.Result {
+	if n.GCHistory == nil {
+		return rmed
+	}
+	out := make(chan gc.Result, 128)
+	go func() {
+		defer close(out)
+		removed := false
+		for res := range rmed {
+			removed = removed || res.KeyRemoved.Defined()
+			select {
+			case out <- res:
+			case <-ctx.Done():
+			}
+		}
+		if !removed || ctx.Err() != nil {
+			return
+		}
+		if err := n.GCHistory.Prune(n.Blockstore); err != nil {
+			log.Errorf("failed to prune the gc history: %v", err)
+		}
+	}()
+	return out
+}
+
+// GarbageCollectDryRun reports the blocks a collection would remove, grouped
+// by the former pin or files path that last referenced them.
+func GarbageCollectDryRun(n *core.IpfsNode, ctx context.Context) (*gc.Report, error) {
+	roots, err := BestEffortRoots(n.FilesRoot)
+	if err != nil {
+		return nil, err
+	}
+	return gc.DryRun(ctx, n.Blockstore, n.Pinning, n.GCHistory, roots, roots[0])
+}
+
+// ExplainRetention returns the roots that keep k from being collected.
+func ExplainRetention(n *core.IpfsNode, ctx context.Context, k cid.Cid) ([]gc.Reason, error) {
+	roots, err := BestEffortRoots(n.FilesRoot)
+	if err != nil {
+		return nil, err
+	}
+	return gc.Explain(ctx, n.Blockstore, n.Pinning, roots[0], roots[1:], k)
 }
 
 func PeriodicGC(ctx context.Context, node *core.IpfsNode) error {
@@ -204,6 +322,14 @@ func ConditionalGC(ctx context.Context, node *core.IpfsNode, offset uint64) erro
 	return gc.maybeGC(ctx, offset)
 }
 
+// collect removes every unpinned block with the configured collector.
+func (gc *GC) collect(ctx context.Context) error {
+	if gc.Collector.Incremental {
+		return CollectResult(ctx, IncrementalGarbageCollectAsync(gc.Node, ctx), nil)
+	}
+	return GarbageCollect(gc.Node, ctx)
+}
+
 func (gc *GC) maybeGC(ctx context.Context, offset uint64) error {
 	storage, err := gc.Repo.GetStorageUsage()
 	if err != nil {
@@ -218,7 +344,13 @@ func (gc *GC) maybeGC(ctx context.Context, offset uint64) error {
 		// Do GC here
 		log.Info("Watermark exceeded. Starting repo GC...")
 
-		if err := GarbageCollect(gc.Node, ctx); err != nil {
+		if gc.Retention.Partial() {
+			target := storage + offset - gc.StorageLow
+			log.Infof("Evicting %s of unpinned blocks with the %s policy", humanize.Bytes(target), gc.Retention.Policy)
+			if err := Evict(gc.Node, ctx, gc.Retention.EvictPolicy(target)); err != nil {
+				return err
+			}
+		} else if err := gc.collect(ctx); err != nil {
 			return err
 		}
 		log.Infof("Repo GC done. See `ipfs repo stat` to see how much space got freed.\n")
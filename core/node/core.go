@@ -1,6 +1,7 @@
 package node
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"time"
@@ -24,12 +25,14 @@ import (
 	"go.uber.org/fx"
 
 	"github.com/ipfs/go-ipfs/core/node/helpers"
+	"github.com/ipfs/go-ipfs/gc"
+	"github.com/ipfs/go-ipfs/namedpin"
 	"github.com/ipfs/go-ipfs/repo"
 )
 
 // BlockService creates new blockservice which provides an interface to fetch content-addressable blocks
-func BlockService(lc fx.Lifecycle, bs blockstore.Blockstore, rem exchange.Interface) blockservice.BlockService {
-	bsvc := blockservice.New(bs, rem)
+func BlockService(lc fx.Lifecycle, bs blockstore.Blockstore, rem exchange.Interface, access *gc.AccessIndex) blockservice.BlockService {
+	bsvc := blockservice.New(gc.NewReadTracker(bs, access), rem)
 
 	lc.Append(fx.Hook{
 		OnStop: func(ctx context.Context) error {
@@ -41,7 +44,7 @@ func BlockService(lc fx.Lifecycle, bs blockstore.Blockstore, rem exchange.Interf
 }
 
 // Pinning creates new pinner which tells GC which blocks should be kept
-func Pinning(bstore blockstore.Blockstore, ds format.DAGService, repo repo.Repo) (pin.Pinner, error) {
+func Pinning(bstore blockstore.Blockstore, ds format.DAGService, repo repo.Repo, barrier *gc.Barrier, refs *gc.RefIndex, history *gc.History, names *namedpin.Store) (pin.Pinner, error) {
 	rootDS := repo.Datastore()
 
 	syncFn := func() error {
@@ -60,7 +63,22 @@ func Pinning(bstore blockstore.Blockstore, ds format.DAGService, repo repo.Repo)
 		return nil, err
 	}
 
-	return pinning, nil
+	return gc.NewBarrierPinner(gc.NewRefcountPinner(gc.NewHistoryPinner(namedpin.NewPinner(pinning, names), history), refs), barrier), nil
+}
+
+// RefIndex opens the reference count index of the pinned blocks
+func RefIndex(repo repo.Repo, bs blockstore.GCBlockstore) *gc.RefIndex {
+	return gc.NewRefIndex(repo.Datastore(), bs)
+}
+
+// PinNames stores the names and metadata of pins
+func PinNames(repo repo.Repo) *namedpin.Store {
+	return namedpin.NewStore(repo.Datastore())
+}
+
+// GCHistory records the former pins and files roots of the blocks gc removes
+func GCHistory(repo repo.Repo) *gc.History {
+	return gc.NewHistory(repo.Datastore())
 }
 
 var (
@@ -103,7 +121,7 @@ func OnlineExchange(provide bool) interface{} {
 }
 
 // Files loads persisted MFS root
-func Files(mctx helpers.MetricsCtx, lc fx.Lifecycle, repo repo.Repo, dag format.DAGService) (*mfs.Root, error) {
+func Files(mctx helpers.MetricsCtx, lc fx.Lifecycle, repo repo.Repo, dag format.DAGService, history *gc.History) (*mfs.Root, error) {
 	dsk := datastore.NewKey("/local/filesroot")
 	pf := func(ctx context.Context, c cid.Cid) error {
 		rootDS := repo.Datastore()
@@ -114,10 +132,25 @@ func Files(mctx helpers.MetricsCtx, lc fx.Lifecycle, repo repo.Repo, dag format.
 			return err
 		}
 
+		prev, err := rootDS.Get(dsk)
+		if err != nil && err != datastore.ErrNotFound {
+			return err
+		}
 		if err := rootDS.Put(dsk, c.Bytes()); err != nil {
 			return err
 		}
-		return rootDS.Sync(dsk)
+		if err := rootDS.Sync(dsk); err != nil {
+			return err
+		}
+
+		if prev != nil && !bytes.Equal(prev, c.Bytes()) {
+			if pc, err := cid.Cast(prev); err == nil {
+				if err := history.RecordFilesRoot(pc); err != nil {
+					logger.Errorf("failed to record former files root %s: %v", pc, err)
+				}
+			}
+		}
+		return nil
 	}
 
 	var nd *merkledag.ProtoNode
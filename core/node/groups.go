@@ -14,6 +14,7 @@ import (
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 
 	"github.com/ipfs/go-ipfs/core/node/libp2p"
+	"github.com/ipfs/go-ipfs/gc"
 	"github.com/ipfs/go-ipfs/p2p"
 
 	offline "github.com/ipfs/go-ipfs-exchange-offline"
@@ -169,6 +170,8 @@ func Storage(bcfg *BuildCfg, cfg *config.Config) fx.Option {
 	return fx.Options(
 		fx.Provide(RepoConfig),
 		fx.Provide(Datastore),
+		fx.Provide(gc.NewBarrier),
+		fx.Provide(AccessIndex),
 		fx.Provide(BaseBlockstoreCtor(cacheOpts, bcfg.NilRepo, cfg.Datastore.HashOnRead)),
 		finalBstore,
 	)
@@ -292,8 +295,12 @@ var Core = fx.Options(
 	fx.Provide(BlockService),
 	fx.Provide(Dag),
 	fx.Provide(resolver.NewBasicResolver),
+	fx.Provide(RefIndex),
+	fx.Provide(GCHistory),
+	fx.Provide(PinNames),
 	fx.Provide(Pinning),
 	fx.Provide(Files),
+	fx.Provide(Shutdown),
 )
 
 func Networked(bcfg *BuildCfg, cfg *config.Config) fx.Option {
@@ -71,6 +71,16 @@ func PNetChecker(repo repo.Repo, ph host.Host, lc fx.Lifecycle) error {
 	return nil
 }
 
+// SwarmKeyFingerprint decodes swarmkey and returns the fingerprint of the
+// private network it defines.
+func SwarmKeyFingerprint(swarmkey []byte) (PNetFingerprint, error) {
+	psk, err := pnet.DecodeV1PSK(bytes.NewReader(swarmkey))
+	if err != nil {
+		return nil, err
+	}
+	return pnetFingerprint(psk), nil
+}
+
 func pnetFingerprint(psk pnet.PSK) []byte {
 	var pskArr [32]byte
 	copy(pskArr[:], psk)
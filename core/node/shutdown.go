@@ -0,0 +1,61 @@
+package node
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/libp2p/go-libp2p-core/host"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"go.uber.org/fx"
+)
+
+// ShutdownHooks run when the node stops, before the host and pubsub are
+// closed. Services started after the node was constructed, such as the miner,
+// register their teardown with it.
+type ShutdownHooks struct {
+	lk    sync.Mutex
+	hooks []func(context.Context) error
+}
+
+// Append registers f to run when the node stops. Hooks run in reverse order
+// of registration.
+func (s *ShutdownHooks) Append(f func(context.Context) error) {
+	s.lk.Lock()
+	s.hooks = append(s.hooks, f)
+	s.lk.Unlock()
+}
+
+func (s *ShutdownHooks) run(ctx context.Context) error {
+	s.lk.Lock()
+	hooks := s.hooks
+	s.hooks = nil
+	s.lk.Unlock()
+
+	var errs error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i](ctx); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+type shutdownIn struct {
+	fx.In
+
+	LC fx.Lifecycle
+	// The hooks must be constructed after the services they may use, so
+	// that they stop first.
+	Host   host.Host      `optional:"true"`
+	PubSub *pubsub.PubSub `optional:"true"`
+}
+
+// Shutdown creates the ShutdownHooks of the node
+func Shutdown(in shutdownIn) *ShutdownHooks {
+	s := &ShutdownHooks{}
+	in.LC.Append(fx.Hook{
+		OnStop: s.run,
+	})
+	return s
+}
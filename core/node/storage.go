@@ -1,6 +1,8 @@
 package node
 
 import (
+	"context"
+
 	"github.com/ipfs/go-datastore"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	config "github.com/ipfs/go-ipfs-config"
@@ -8,6 +10,8 @@ import (
 
 	"github.com/ipfs/go-filestore"
 	"github.com/ipfs/go-ipfs/core/node/helpers"
+	"github.com/ipfs/go-ipfs/gc"
+	gcconfig "github.com/ipfs/go-ipfs/gc/config"
 	"github.com/ipfs/go-ipfs/repo"
 	"github.com/ipfs/go-ipfs/thirdparty/cidv0v1"
 	"github.com/ipfs/go-ipfs/thirdparty/verifbs"
@@ -23,12 +27,35 @@ func Datastore(repo repo.Repo) datastore.Datastore {
 	return repo.Datastore()
 }
 
+// AccessIndex tracks the accesses of blocks when the retention policy needs
+// them, and is nil otherwise
+func AccessIndex(lc fx.Lifecycle, repo repo.Repo) (*gc.AccessIndex, error) {
+	cfg, err := gcconfig.Load(repo)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if !cfg.TracksAccess() {
+		return nil, nil
+	}
+
+	idx := gc.NewAccessIndex(repo.Datastore())
+	lc.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			return idx.Close()
+		},
+	})
+	return idx, nil
+}
+
 // BaseBlocks is the lower level blockstore without GC or Filestore layers
 type BaseBlocks blockstore.Blockstore
 
 // BaseBlockstoreCtor creates cached blockstore backed by the provided datastore
-func BaseBlockstoreCtor(cacheOpts blockstore.CacheOpts, nilRepo bool, hashOnRead bool) func(mctx helpers.MetricsCtx, repo repo.Repo, lc fx.Lifecycle) (bs BaseBlocks, err error) {
-	return func(mctx helpers.MetricsCtx, repo repo.Repo, lc fx.Lifecycle) (bs BaseBlocks, err error) {
+func BaseBlockstoreCtor(cacheOpts blockstore.CacheOpts, nilRepo bool, hashOnRead bool) func(mctx helpers.MetricsCtx, repo repo.Repo, lc fx.Lifecycle, barrier *gc.Barrier, access *gc.AccessIndex) (bs BaseBlocks, err error) {
+	return func(mctx helpers.MetricsCtx, repo repo.Repo, lc fx.Lifecycle, barrier *gc.Barrier, access *gc.AccessIndex) (bs BaseBlocks, err error) {
 		// hash security
 		bs = blockstore.NewBlockstore(repo.Datastore())
 		bs = &verifbs.VerifBS{Blockstore: bs}
@@ -42,6 +69,8 @@ func BaseBlockstoreCtor(cacheOpts blockstore.CacheOpts, nilRepo bool, hashOnRead
 
 		bs = blockstore.NewIdStore(bs)
 		bs = cidv0v1.NewBlockstore(bs)
+		bs = gc.NewBarrierBlockstore(bs, barrier)
+		bs = gc.NewWriteTracker(bs, access)
 
 		if hashOnRead { // TODO: review: this is how it was done originally, is there a reason we can't just pass this directly?
 			bs.HashOnRead(true)
@@ -61,12 +90,13 @@ func GcBlockstoreCtor(bb BaseBlocks) (gclocker blockstore.GCLocker, gcbs blockst
 }
 
 // GcBlockstoreCtor wraps GcBlockstore and adds Filestore support
-func FilestoreBlockstoreCtor(repo repo.Repo, bb BaseBlocks) (gclocker blockstore.GCLocker, gcbs blockstore.GCBlockstore, bs blockstore.Blockstore, fstore *filestore.Filestore) {
+func FilestoreBlockstoreCtor(repo repo.Repo, bb BaseBlocks, barrier *gc.Barrier, access *gc.AccessIndex) (gclocker blockstore.GCLocker, gcbs blockstore.GCBlockstore, bs blockstore.Blockstore, fstore *filestore.Filestore) {
 	gclocker = blockstore.NewGCLocker()
 
 	// hash security
 	fstore = filestore.NewFilestore(bb, repo.FileManager())
-	gcbs = blockstore.NewGCBlockstore(fstore, gclocker)
+	// filestore blocks are not written to the base blockstore
+	gcbs = blockstore.NewGCBlockstore(gc.NewWriteTracker(gc.NewBarrierBlockstore(fstore, barrier), access), gclocker)
 	gcbs = &verifbs.VerifBSGC{GCBlockstore: gcbs}
 
 	bs = gcbs
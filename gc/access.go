@@ -0,0 +1,283 @@
+package gc
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	dstore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+var accessPrefix = dstore.NewKey("/local/access")
+
+// accessFlushInterval is how often recorded accesses are written to the
+// datastore. Accesses to a block between two flushes cost a single write.
+const accessFlushInterval = time.Minute
+
+var errInvalidAccess = errors.New("invalid access record")
+
+// Access is when a block was written and last read. Zero times are unknown,
+// for blocks stored before they were tracked.
+type Access struct {
+	Written  time.Time
+	Accessed time.Time
+}
+
+type accessUpdate struct {
+	at      time.Time
+	written bool
+	deleted bool
+}
+
+// AccessIndex records when blocks are written and read in a side index of
+// the datastore, so retention policies can remove the least used blocks
+// first. Accesses are kept in memory and flushed in batches.
+type AccessIndex struct {
+	ds dstore.Batching
+
+	lk      sync.Mutex
+	pending map[cid.Cid]accessUpdate
+
+	// flushLk serializes flushes, which read and rewrite records.
+	flushLk sync.Mutex
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+// NewAccessIndex opens the access index stored in ds and starts flushing
+// accesses to it until closed.
+func NewAccessIndex(ds dstore.Batching) *AccessIndex {
+	a := &AccessIndex{
+		ds:      ds,
+		pending: make(map[cid.Cid]accessUpdate),
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *AccessIndex) run() {
+	defer close(a.closed)
+	ticker := time.NewTicker(accessFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.Flush(); err != nil {
+				log.Errorf("failed to flush block accesses: %v", err)
+			}
+		case <-a.closing:
+			return
+		}
+	}
+}
+
+// Close stops flushing in the background and flushes the pending accesses.
+func (a *AccessIndex) Close() error {
+	close(a.closing)
+	<-a.closed
+	return a.Flush()
+}
+
+func accessKey(k cid.Cid) dstore.Key {
+	return accessPrefix.ChildString(k.String())
+}
+
+func encodeAccess(acc Access) []byte {
+	buf := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, unixSeconds(acc.Written))
+	n += binary.PutUvarint(buf[n:], unixSeconds(acc.Accessed))
+	return buf[:n]
+}
+
+func decodeAccess(data []byte) (Access, error) {
+	written, n := binary.Uvarint(data)
+	if n <= 0 {
+		return Access{}, errInvalidAccess
+	}
+	accessed, m := binary.Uvarint(data[n:])
+	if m <= 0 {
+		return Access{}, errInvalidAccess
+	}
+	return Access{Written: fromUnixSeconds(written), Accessed: fromUnixSeconds(accessed)}, nil
+}
+
+func unixSeconds(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.Unix())
+}
+
+func fromUnixSeconds(s uint64) time.Time {
+	if s == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(s), 0)
+}
+
+func (a *AccessIndex) touch(k cid.Cid, written bool) {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	u := a.pending[k]
+	u.at = time.Now()
+	u.written = u.written || written
+	u.deleted = false
+	a.pending[k] = u
+}
+
+func (a *AccessIndex) forget(k cid.Cid) {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	a.pending[k] = accessUpdate{deleted: true}
+}
+
+// Flush writes the pending accesses to the datastore.
+func (a *AccessIndex) Flush() error {
+	a.flushLk.Lock()
+	defer a.flushLk.Unlock()
+
+	a.lk.Lock()
+	pending := a.pending
+	a.pending = make(map[cid.Cid]accessUpdate)
+	a.lk.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	b, err := a.ds.Batch()
+	if err != nil {
+		return err
+	}
+	for k, u := range pending {
+		key := accessKey(k)
+		if u.deleted {
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+			continue
+		}
+		var acc Access
+		data, err := a.ds.Get(key)
+		switch err {
+		case nil:
+			if acc, err = decodeAccess(data); err != nil {
+				log.Warnf("replacing invalid access record of %s", k)
+			}
+		case dstore.ErrNotFound:
+		default:
+			return err
+		}
+		acc.Accessed = u.at
+		if u.written && acc.Written.IsZero() {
+			acc.Written = u.at
+		}
+		if err := b.Put(key, encodeAccess(acc)); err != nil {
+			return err
+		}
+	}
+	return b.Commit()
+}
+
+// Accesses returns the recorded accesses of every block, flushing the
+// pending ones first.
+func (a *AccessIndex) Accesses() (map[cid.Cid]Access, error) {
+	if err := a.Flush(); err != nil {
+		return nil, err
+	}
+	res, err := a.ds.Query(query.Query{Prefix: accessPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	out := make(map[cid.Cid]Access)
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		k, err := cid.Decode(dstore.RawKey(r.Key).BaseNamespace())
+		if err != nil {
+			log.Warnf("skipping invalid access key %s", r.Key)
+			continue
+		}
+		acc, err := decodeAccess(r.Value)
+		if err != nil {
+			log.Warnf("skipping invalid access record of %s", k)
+			continue
+		}
+		out[k] = acc
+	}
+	return out, nil
+}
+
+type writeTracker struct {
+	bstore.Blockstore
+	idx *AccessIndex
+}
+
+// NewWriteTracker wraps bs so that idx records the blocks written to it and
+// forgets the blocks deleted from it. bs is returned as is when idx is nil.
+func NewWriteTracker(bs bstore.Blockstore, idx *AccessIndex) bstore.Blockstore {
+	if idx == nil {
+		return bs
+	}
+	return &writeTracker{Blockstore: bs, idx: idx}
+}
+
+func (bs *writeTracker) Put(blk blocks.Block) error {
+	if err := bs.Blockstore.Put(blk); err != nil {
+		return err
+	}
+	bs.idx.touch(blk.Cid(), true)
+	return nil
+}
+
+func (bs *writeTracker) PutMany(blks []blocks.Block) error {
+	if err := bs.Blockstore.PutMany(blks); err != nil {
+		return err
+	}
+	for _, blk := range blks {
+		bs.idx.touch(blk.Cid(), true)
+	}
+	return nil
+}
+
+func (bs *writeTracker) DeleteBlock(k cid.Cid) error {
+	if err := bs.Blockstore.DeleteBlock(k); err != nil {
+		return err
+	}
+	bs.idx.forget(k)
+	return nil
+}
+
+type readTracker struct {
+	bstore.Blockstore
+	idx *AccessIndex
+}
+
+// NewReadTracker wraps bs so that idx records the blocks read from it. Only
+// the blockstore serving content should be wrapped, so that the reads of
+// garbage collection are not counted. bs is returned as is when idx is nil.
+func NewReadTracker(bs bstore.Blockstore, idx *AccessIndex) bstore.Blockstore {
+	if idx == nil {
+		return bs
+	}
+	return &readTracker{Blockstore: bs, idx: idx}
+}
+
+func (bs *readTracker) Get(k cid.Cid) (blocks.Block, error) {
+	blk, err := bs.Blockstore.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	bs.idx.touch(k, false)
+	return blk, nil
+}
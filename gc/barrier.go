@@ -0,0 +1,129 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ErrGCRunning is returned when an incremental collection starts while
+// another one runs.
+var ErrGCRunning = errors.New("garbage collection already running")
+
+// Barrier is the write barrier of the incremental collector. While a
+// collection runs, blockstores and pinners wrapped with the barrier shade the
+// blocks they write and the pins they add, so the collection keeps them even
+// though they were unreachable when it started marking.
+type Barrier struct {
+	lk sync.Mutex
+	c  *collector
+}
+
+func NewBarrier() *Barrier {
+	return &Barrier{}
+}
+
+func (b *Barrier) attach(c *collector) error {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if b.c != nil {
+		return ErrGCRunning
+	}
+	b.c = c
+	return nil
+}
+
+func (b *Barrier) detach(c *collector) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if b.c == c {
+		b.c = nil
+	}
+}
+
+func (b *Barrier) collector() *collector {
+	if b == nil {
+		return nil
+	}
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return b.c
+}
+
+// shadeBlock is called before k is written to the blockstore.
+func (b *Barrier) shadeBlock(k cid.Cid) {
+	if c := b.collector(); c != nil {
+		c.shadeBlock(k)
+	}
+}
+
+// shadePin is called before k is pinned.
+func (b *Barrier) shadePin(ctx context.Context, k cid.Cid, recursive bool) error {
+	if c := b.collector(); c != nil {
+		return c.shadePin(ctx, k, recursive)
+	}
+	return nil
+}
+
+type barrierBlockstore struct {
+	bstore.Blockstore
+	barrier *Barrier
+}
+
+// NewBarrierBlockstore wraps bs so that the blocks written to it are kept by
+// the incremental collections of b.
+func NewBarrierBlockstore(bs bstore.Blockstore, b *Barrier) bstore.Blockstore {
+	return &barrierBlockstore{Blockstore: bs, barrier: b}
+}
+
+func (bs *barrierBlockstore) Put(blk blocks.Block) error {
+	bs.barrier.shadeBlock(blk.Cid())
+	return bs.Blockstore.Put(blk)
+}
+
+func (bs *barrierBlockstore) PutMany(blks []blocks.Block) error {
+	for _, blk := range blks {
+		bs.barrier.shadeBlock(blk.Cid())
+	}
+	return bs.Blockstore.PutMany(blks)
+}
+
+type barrierPinner struct {
+	pin.Pinner
+	barrier *Barrier
+}
+
+// NewBarrierPinner wraps pn so that the pins added to it are kept by the
+// incremental collections of b.
+func NewBarrierPinner(pn pin.Pinner, b *Barrier) pin.Pinner {
+	return &barrierPinner{Pinner: pn, barrier: b}
+}
+
+func (p *barrierPinner) Pin(ctx context.Context, node ipld.Node, recursive bool) error {
+	if err := p.barrier.shadePin(ctx, node.Cid(), recursive); err != nil {
+		return err
+	}
+	return p.Pinner.Pin(ctx, node, recursive)
+}
+
+func (p *barrierPinner) Update(ctx context.Context, from, to cid.Cid, unpin bool) error {
+	if err := p.barrier.shadePin(ctx, to, true); err != nil {
+		return err
+	}
+	return p.Pinner.Update(ctx, from, to, unpin)
+}
+
+func (p *barrierPinner) PinWithMode(c cid.Cid, mode pin.Mode) {
+	if mode == pin.Recursive || mode == pin.Direct {
+		if err := p.barrier.shadePin(context.Background(), c, mode == pin.Recursive); err != nil {
+			log.Errorf("failed to shade pin %s: %v", c, err)
+		}
+	}
+	p.Pinner.PinWithMode(c, mode)
+}
@@ -0,0 +1,153 @@
+// Package config defines the Retention and Collector sections of the repo
+// config.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-ipfs/gc"
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/ipfs/go-ipfs/repo/common"
+)
+
+// Key is the key of the Retention section in the repo config.
+const Key = "Retention"
+
+// CollectorKey is the key of the Collector section in the repo config.
+const CollectorKey = "Collector"
+
+// Policies of the collections started by the storage watermark.
+const (
+	// PolicyAll removes every unpinned block.
+	PolicyAll = "all"
+	// PolicyLRU removes the least recently used blocks first.
+	PolicyLRU = "lru"
+	// PolicyMinAge removes the blocks written before MinAge, oldest first.
+	PolicyMinAge = "min-age"
+	// PolicySize removes the largest blocks first.
+	PolicySize = "size"
+)
+
+const DefaultLowWatermark = 80
+
+// Retention configures which unpinned blocks are removed when the storage
+// watermark is exceeded. Zero values select the defaults.
+type Retention struct {
+	// Policy is one of all, lru, min-age and size. Every policy but all
+	// removes blocks only until the usage is below LowWatermark.
+	Policy string
+	// LowWatermark is the percentage of Datastore.StorageMax the partial
+	// policies free space down to.
+	LowWatermark int64
+	// MinAge keeps the blocks written more recently from the partial
+	// policies, such as "24h". The min-age policy requires it.
+	MinAge string
+}
+
+// Collector configures the collector removing every unpinned block.
+type Collector struct {
+	// Incremental runs the automatic collections with the experimental
+	// incremental collector, which does not hold the GC lock while
+	// marking.
+	Incremental bool `json:",omitempty"`
+}
+
+// Load reads the Retention section from the config of r. A missing section
+// yields the zero config.
+func Load(r repo.Repo) (Retention, error) {
+	var cfg Retention
+	return cfg, load(r, Key, &cfg)
+}
+
+// LoadCollector reads the Collector section from the config of r. A missing
+// section yields the zero config.
+func LoadCollector(r repo.Repo) (Collector, error) {
+	var cfg Collector
+	return cfg, load(r, CollectorKey, &cfg)
+}
+
+func load(r repo.Repo, key string, cfg interface{}) error {
+	v, err := r.GetConfigKey(key)
+	if errors.Is(err, common.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("failed to parse %s config: %w", key, err)
+	}
+	return nil
+}
+
+// Validate checks the config for invalid values.
+func (c Retention) Validate() error {
+	switch c.Policy {
+	case "", PolicyAll, PolicyLRU, PolicyMinAge, PolicySize:
+	default:
+		return fmt.Errorf("unknown %s.Policy %q, expected %s, %s, %s or %s", Key, c.Policy, PolicyAll, PolicyLRU, PolicyMinAge, PolicySize)
+	}
+	if c.LowWatermark < 0 || c.LowWatermark >= 100 {
+		return fmt.Errorf("%s.LowWatermark must be between 0 and 100", Key)
+	}
+	if c.MinAge != "" {
+		d, err := time.ParseDuration(c.MinAge)
+		if err != nil {
+			return fmt.Errorf("invalid %s.MinAge: %w", Key, err)
+		}
+		if d < 0 {
+			return fmt.Errorf("%s.MinAge must not be negative", Key)
+		}
+	}
+	if c.Policy == PolicyMinAge && c.Age() == 0 {
+		return fmt.Errorf("%s.MinAge is required by the %s policy", Key, PolicyMinAge)
+	}
+	return nil
+}
+
+// Partial reports whether collections remove unpinned blocks only until the
+// low watermark.
+func (c Retention) Partial() bool {
+	return c.Policy != "" && c.Policy != PolicyAll
+}
+
+// TracksAccess reports whether the policy needs the access times of blocks.
+func (c Retention) TracksAccess() bool {
+	return c.Partial() && (c.Policy != PolicySize || c.Age() > 0)
+}
+
+// Low returns the low watermark percentage.
+func (c Retention) Low() int64 {
+	if c.LowWatermark == 0 {
+		return DefaultLowWatermark
+	}
+	return c.LowWatermark
+}
+
+// Age returns the minimum age of removed blocks. The config must be valid.
+func (c Retention) Age() time.Duration {
+	d, _ := time.ParseDuration(c.MinAge)
+	return d
+}
+
+// EvictPolicy returns the eviction policy freeing target bytes. The config
+// must be valid and partial.
+func (c Retention) EvictPolicy(target uint64) gc.EvictPolicy {
+	p := gc.EvictPolicy{MinAge: c.Age(), Target: target}
+	switch c.Policy {
+	case PolicyLRU:
+		p.Order = gc.EvictLRU
+	case PolicyMinAge:
+		p.Order = gc.EvictOldest
+	case PolicySize:
+		p.Order = gc.EvictLargest
+	}
+	return p
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-ipfs/gc"
+)
+
+func TestValidate(t *testing.T) {
+	var cfg Retention
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("zero config should be valid: %v", err)
+	}
+	if cfg.Partial() || cfg.TracksAccess() || cfg.Low() != DefaultLowWatermark {
+		t.Errorf("zero config should remove every unpinned block")
+	}
+
+	cfg = Retention{Policy: PolicyMinAge, MinAge: "24h", LowWatermark: 60}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := cfg.EvictPolicy(100)
+	if p.Order != gc.EvictOldest || p.MinAge != 24*time.Hour || p.Target != 100 || !cfg.TracksAccess() {
+		t.Errorf("unexpected eviction policy %+v", p)
+	}
+	if (Retention{Policy: PolicySize}).TracksAccess() {
+		t.Error("the size policy without a minimum age should not track accesses")
+	}
+
+	for _, bad := range []Retention{
+		{Policy: "fifo"},
+		{LowWatermark: -1},
+		{LowWatermark: 100},
+		{MinAge: "old"},
+		{MinAge: "-1h"},
+		{Policy: PolicyMinAge},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", bad)
+		}
+	}
+}
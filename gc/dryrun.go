@@ -0,0 +1,410 @@
+package gc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	bserv "github.com/ipfs/go-blockservice"
+	cid "github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	unixfs "github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+)
+
+// Report is the result of a dry run: the blocks a collection would remove,
+// grouped by the former root that last referenced them.
+type Report struct {
+	Groups []ReportGroup
+	Blocks int
+	Bytes  uint64
+}
+
+// ReportGroup is a group of blocks a collection would remove. The blocks
+// no recorded referrer references have a zero Referrer.
+type ReportGroup struct {
+	Referrer Referrer
+	Blocks   []cid.Cid
+	Bytes    uint64
+}
+
+// Reason is a root retaining a block.
+type Reason struct {
+	Kind string
+	Root cid.Cid
+	// Path is the path of the block from the root, or its files API path
+	// for the files root.
+	Path string `json:",omitempty"`
+}
+
+func newDAGService(bs bstore.Blockstore) ipld.DAGService {
+	return dag.NewDAGService(bserv.New(bs, offline.Exchange(bs)))
+}
+
+// linkName returns the path element l adds to the path of nd: none for the
+// links of files and the sub-shards of sharded directories.
+func linkName(nd ipld.Node, l *ipld.Link) string {
+	pn, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return l.Name
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return l.Name
+	}
+	switch fsn.Type() {
+	case unixfs.THAMTShard:
+		// Entries are prefixed with their index in the shard.
+		width := len(fmt.Sprintf("%X", fsn.Fanout()-1))
+		if len(l.Name) <= width {
+			return ""
+		}
+		return l.Name[width:]
+	case unixfs.TFile:
+		return ""
+	}
+	return l.Name
+}
+
+type dryRun struct {
+	dserv     ipld.DAGService
+	filesRoot cid.Cid
+
+	garbage map[cid.Cid]uint64
+	direct  *cid.Set
+	visited *cid.Set
+	groups  map[string]*ReportGroup
+	dirs    map[string]bool
+}
+
+// DryRun reports the blocks a mark and sweep collection would remove, and
+// the former pin or files path of h that last referenced them. filesRoot is
+// the current root of the files API, also in bestEffortRoots. Nothing is
+// locked or written, so blocks written while it runs may be reported.
+func DryRun(ctx context.Context, bs bstore.GCBlockstore, pn pin.Pinner, h *History, bestEffortRoots []cid.Cid, filesRoot cid.Cid) (*Report, error) {
+	d := &dryRun{
+		dserv:     newDAGService(bs),
+		filesRoot: filesRoot,
+		garbage:   make(map[cid.Cid]uint64),
+		direct:    cid.NewSet(),
+		visited:   cid.NewSet(),
+		groups:    make(map[string]*ReportGroup),
+		dirs:      make(map[string]bool),
+	}
+
+	output := make(chan Result)
+	var errs []error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for res := range output {
+			errs = append(errs, res.Error)
+		}
+	}()
+	gcs, err := ColoredSet(ctx, pn, d.dserv, bestEffortRoots, output)
+	close(output)
+	<-done
+	if err != nil {
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("%s: %s", err, errs[0])
+		}
+		return nil, err
+	}
+
+	dkeys, err := pn.DirectKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range dkeys {
+		d.direct.Add(k)
+	}
+
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{}
+	for k := range keys {
+		if gcs.Has(k) {
+			continue
+		}
+		size, err := bs.GetSize(k)
+		if err != nil {
+			return nil, err
+		}
+		d.garbage[k] = uint64(size)
+		report.Blocks++
+		report.Bytes += uint64(size)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	refs, err := h.referrers()
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		if ref.Kind != KindFiles {
+			has, err := bs.Has(ref.Cid)
+			if err != nil {
+				return nil, err
+			}
+			if !has {
+				// Collected since it was unpinned. Real collections
+				// prune the record.
+				continue
+			}
+		}
+		if err := d.attribute(ctx, ref); err != nil {
+			return nil, err
+		}
+	}
+
+	var unreferenced ReportGroup
+	for k, size := range d.garbage {
+		unreferenced.Blocks = append(unreferenced.Blocks, k)
+		unreferenced.Bytes += size
+	}
+	for _, g := range d.groups {
+		report.Groups = append(report.Groups, *g)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		return report.Groups[i].Referrer.Time.After(report.Groups[j].Referrer.Time)
+	})
+	if len(unreferenced.Blocks) > 0 {
+		report.Groups = append(report.Groups, unreferenced)
+	}
+	for _, g := range report.Groups {
+		sort.Slice(g.Blocks, func(i, j int) bool {
+			return g.Blocks[i].KeyString() < g.Blocks[j].KeyString()
+		})
+	}
+	return report, nil
+}
+
+type walkItem struct {
+	k     cid.Cid
+	path  string
+	label string
+}
+
+// attribute groups the garbage blocks ref references and no more recent
+// referrer did. The blocks of a former files root are grouped by the
+// shallowest path that is no longer a directory of the files API.
+func (d *dryRun) attribute(ctx context.Context, ref Referrer) error {
+	stack := []walkItem{{k: ref.Cid, path: "/"}}
+	for len(stack) > 0 {
+		it := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !d.visited.Visit(it.k) {
+			continue
+		}
+
+		size, garbage := d.garbage[it.k]
+		if !garbage && !d.direct.Has(it.k) {
+			// Retained with all the blocks it links to.
+			continue
+		}
+		if garbage {
+			if ref.Kind == KindFiles && it.label == "" && it.path != "/" {
+				dir, err := d.isDir(ctx, it.path)
+				if err != nil {
+					return err
+				}
+				if !dir {
+					it.label = it.path
+				}
+			}
+			g := d.group(ref, it)
+			g.Blocks = append(g.Blocks, it.k)
+			g.Bytes += size
+			delete(d.garbage, it.k)
+		}
+
+		nd, err := d.dserv.Get(ctx, it.k)
+		switch err {
+		case nil:
+		case ipld.ErrNotFound:
+			continue
+		default:
+			return err
+		}
+		for _, l := range nd.Links() {
+			stack = append(stack, walkItem{
+				k:     l.Cid,
+				path:  path.Join(it.path, linkName(nd, l)),
+				label: it.label,
+			})
+		}
+	}
+	return nil
+}
+
+func (d *dryRun) group(ref Referrer, it walkItem) *ReportGroup {
+	key := ref.Kind + " " + ref.Cid.String()
+	if ref.Kind == KindFiles {
+		ref.Path = it.label
+		if ref.Path == "" {
+			ref.Path = it.path
+		}
+		key = ref.Kind + " " + ref.Path
+	}
+	g, ok := d.groups[key]
+	if !ok {
+		g = &ReportGroup{Referrer: ref}
+		d.groups[key] = g
+	}
+	return g
+}
+
+// isDir reports whether p is a directory of the current files root.
+func (d *dryRun) isDir(ctx context.Context, p string) (bool, error) {
+	if dir, ok := d.dirs[p]; ok {
+		return dir, nil
+	}
+	dir, err := d.resolveDir(ctx, p)
+	if err != nil {
+		return false, err
+	}
+	d.dirs[p] = dir
+	return dir, nil
+}
+
+func (d *dryRun) resolveDir(ctx context.Context, p string) (bool, error) {
+	if !d.filesRoot.Defined() {
+		return false, nil
+	}
+	nd, err := d.dserv.Get(ctx, d.filesRoot)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		dir, err := uio.NewDirectoryFromNode(d.dserv, nd)
+		if err != nil {
+			return false, nil
+		}
+		nd, err = dir.Find(ctx, name)
+		switch err {
+		case nil:
+		case os.ErrNotExist:
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	_, err = uio.NewDirectoryFromNode(d.dserv, nd)
+	return err == nil, nil
+}
+
+// Explain returns the roots retaining k: the direct pin of k, the recursive
+// and internal pins, the files root filesRoot and the bestEffortRoots whose
+// DAG contains k. A block with no reasons is removed by the next collection.
+func Explain(ctx context.Context, bs bstore.Blockstore, pn pin.Pinner, filesRoot cid.Cid, bestEffortRoots []cid.Cid, k cid.Cid) ([]Reason, error) {
+	has, err := bs.Has(k)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, fmt.Errorf("block %s is not in the repo", k)
+	}
+	dserv := newDAGService(bs)
+
+	var reasons []Reason
+	if _, pinned, err := pn.IsPinnedWithType(ctx, k, pin.Direct); err != nil {
+		return nil, err
+	} else if pinned {
+		reasons = append(reasons, Reason{Kind: KindDirect, Root: k})
+	}
+
+	find := func(kind string, roots []cid.Cid) error {
+		for _, root := range roots {
+			p, ok, err := findPath(ctx, dserv, root, k)
+			if err != nil {
+				return err
+			}
+			if ok {
+				reasons = append(reasons, Reason{Kind: kind, Root: root, Path: p})
+			}
+		}
+		return nil
+	}
+	rkeys, err := pn.RecursiveKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := find(KindRecursive, rkeys); err != nil {
+		return nil, err
+	}
+	ikeys, err := pn.InternalPins(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := find(KindInternal, ikeys); err != nil {
+		return nil, err
+	}
+	if filesRoot.Defined() {
+		p, ok, err := findPath(ctx, dserv, filesRoot, k)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			reasons = append(reasons, Reason{Kind: KindFiles, Root: filesRoot, Path: "/" + p})
+		}
+	}
+	if err := find(KindBestEffort, bestEffortRoots); err != nil {
+		return nil, err
+	}
+	return reasons, nil
+}
+
+// findPath returns the shortest path from root to k. Missing blocks are
+// skipped like the missing blocks of best effort roots.
+func findPath(ctx context.Context, ng ipld.NodeGetter, root, k cid.Cid) (string, bool, error) {
+	type step struct {
+		parent cid.Cid
+		name   string
+	}
+	steps := map[cid.Cid]step{root: {}}
+	queue := []cid.Cid{root}
+	for len(queue) > 0 && !k.Equals(queue[0]) {
+		c := queue[0]
+		queue = queue[1:]
+		nd, err := ng.Get(ctx, c)
+		switch err {
+		case nil:
+		case ipld.ErrNotFound:
+			continue
+		default:
+			return "", false, err
+		}
+		for _, l := range nd.Links() {
+			if _, ok := steps[l.Cid]; ok {
+				continue
+			}
+			steps[l.Cid] = step{parent: c, name: linkName(nd, l)}
+			queue = append(queue, l.Cid)
+		}
+	}
+	if len(queue) == 0 {
+		return "", false, nil
+	}
+
+	var names []string
+	for c := k; !c.Equals(root); c = steps[c].parent {
+		if name := steps[c].name; name != "" {
+			names = append(names, name)
+		}
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return strings.Join(names, "/"), true, nil
+}
@@ -0,0 +1,165 @@
+package gc
+
+import (
+	"context"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	dstore "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	unixfs "github.com/ipfs/go-unixfs"
+)
+
+// dir adds a unixfs directory with the given entries.
+func (r *testRepo) dir(t *testing.T, entries map[string]ipld.Node) *dag.ProtoNode {
+	nd := unixfs.EmptyDirNode()
+	for name, child := range entries {
+		if err := nd.AddNodeLink(name, child); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.dserv.Add(context.Background(), nd); err != nil {
+		t.Fatal(err)
+	}
+	return nd
+}
+
+func (r *testRepo) group(t *testing.T, report *Report, kind, path string, root cid.Cid) ReportGroup {
+	for _, g := range report.Groups {
+		if g.Referrer.Kind == kind && g.Referrer.Path == path && (kind == KindFiles || g.Referrer.Cid.Equals(root)) {
+			return g
+		}
+	}
+	t.Fatalf("no group for %s %s %s in %+v", kind, path, root, report.Groups)
+	return ReportGroup{}
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t, dssync.MutexWrap(dstore.NewMapDatastore()))
+
+	unpinned, unpinnedLeaf := r.tree(t, "unpinned")
+	kept, _ := r.tree(t, "kept")
+	orphan, orphanLeaf := r.tree(t, "orphan")
+	for _, nd := range []ipld.Node{unpinned, kept} {
+		if err := r.pinner.Pin(ctx, nd, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.pinner.Unpin(ctx, unpinned.Cid(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	// A files root with a directory removed since, and one still there.
+	removed, removedLeaf := r.tree(t, "removed file")
+	stays := r.dir(t, nil)
+	oldRoot := r.dir(t, map[string]ipld.Node{
+		"removed": r.dir(t, map[string]ipld.Node{"file": removed}),
+		"stays":   stays,
+	})
+	if err := r.history.RecordFilesRoot(oldRoot.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	root := r.dir(t, map[string]ipld.Node{"stays": stays})
+
+	report, err := DryRun(ctx, r.bs, r.pinner, r.history, []cid.Cid{root.Cid()}, root.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Blocks != 8 {
+		t.Errorf("reported %d blocks, expected 8", report.Blocks)
+	}
+
+	pinGroup := r.group(t, report, KindRecursive, "", unpinned.Cid())
+	if len(pinGroup.Blocks) != 2 || pinGroup.Bytes == 0 {
+		t.Errorf("unexpected blocks of the removed pin: %v", pinGroup.Blocks)
+	}
+	filesGroup := r.group(t, report, KindFiles, "/removed", cid.Undef)
+	if len(filesGroup.Blocks) != 3 {
+		t.Errorf("unexpected blocks of /removed: %v", filesGroup.Blocks)
+	}
+	r.group(t, report, KindFiles, "/", cid.Undef)
+	orphans := r.group(t, report, "", "", cid.Undef)
+	if len(orphans.Blocks) != 2 {
+		t.Errorf("unexpected unreferenced blocks: %v", orphans.Blocks)
+	}
+
+	if !r.has(t, unpinned, unpinnedLeaf, orphan, orphanLeaf, removed, removedLeaf) {
+		t.Error("dry run removed blocks")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t, dssync.MutexWrap(dstore.NewMapDatastore()))
+
+	pinned, leaf := r.tree(t, "pinned")
+	if err := r.pinner.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.pinner.Pin(ctx, leaf, false); err != nil {
+		t.Fatal(err)
+	}
+	root := r.dir(t, map[string]ipld.Node{"a": r.dir(t, map[string]ipld.Node{"b": pinned})})
+	garbage, _ := r.tree(t, "garbage")
+
+	reasons, err := Explain(ctx, r.bs, r.pinner, root.Cid(), nil, leaf.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Reason{
+		{Kind: KindDirect, Root: leaf.Cid()},
+		{Kind: KindRecursive, Root: pinned.Cid(), Path: "leaf"},
+		{Kind: KindFiles, Root: root.Cid(), Path: "/a/b/leaf"},
+	}
+	if len(reasons) != len(expected) {
+		t.Fatalf("reasons %+v, expected %+v", reasons, expected)
+	}
+	for i, reason := range reasons {
+		if reason.Kind != expected[i].Kind || !reason.Root.Equals(expected[i].Root) || reason.Path != expected[i].Path {
+			t.Errorf("reason %+v, expected %+v", reason, expected[i])
+		}
+	}
+
+	if reasons, err := Explain(ctx, r.bs, r.pinner, root.Cid(), nil, garbage.Cid()); err != nil || len(reasons) != 0 {
+		t.Errorf("garbage retained by %+v: %v", reasons, err)
+	}
+}
+
+func TestHistoryPrune(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t, dssync.MutexWrap(dstore.NewMapDatastore()))
+
+	collected, _ := r.tree(t, "collected")
+	stored, _ := r.tree(t, "stored")
+	for _, nd := range []ipld.Node{collected, stored} {
+		if err := r.pinner.Pin(ctx, nd, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.pinner.Unpin(ctx, nd.Cid(), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.bs.DeleteBlock(collected.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := DryRun(ctx, r.bs, r.pinner, r.history, nil, cid.Undef); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ds.Get(historyPinKey(collected.Cid())); err != nil {
+		t.Errorf("dry run changed the history: %v", err)
+	}
+
+	if err := r.history.Prune(r.bs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ds.Get(historyPinKey(collected.Cid())); err != dstore.ErrNotFound {
+		t.Errorf("record of the collected pin not pruned: %v", err)
+	}
+	if _, err := r.ds.Get(historyPinKey(stored.Cid())); err != nil {
+		t.Errorf("record of the stored pin pruned: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	bserv "github.com/ipfs/go-blockservice"
+	cid "github.com/ipfs/go-cid"
+	dstore "github.com/ipfs/go-datastore"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+// ErrNoAccessIndex is returned when an eviction needs access times but the
+// node does not track them.
+var ErrNoAccessIndex = errors.New("block accesses are not tracked")
+
+// EvictOrder is the order in which Evict removes unpinned blocks.
+type EvictOrder int
+
+const (
+	// EvictLRU removes the least recently read or written blocks first.
+	EvictLRU EvictOrder = iota
+	// EvictOldest removes the least recently written blocks first.
+	EvictOldest
+	// EvictLargest removes the largest blocks first.
+	EvictLargest
+)
+
+// EvictPolicy selects the unpinned blocks Evict removes.
+type EvictPolicy struct {
+	Order EvictOrder
+	// MinAge keeps the blocks written more recently.
+	MinAge time.Duration
+	// Target is the number of bytes to free. Eviction stops once the
+	// removed blocks add up to it.
+	Target uint64
+}
+
+func (p EvictPolicy) needsAccess() bool {
+	return p.Order != EvictLargest || p.MinAge > 0
+}
+
+type evictCandidate struct {
+	k    cid.Cid
+	size uint64
+	acc  Access
+}
+
+// Evict removes unpinned blocks in the order of p until p.Target bytes are
+// freed, unlike GC which removes them all. Blocks are marked like GC, holding
+// the GC lock. Blocks without recorded accesses were stored before they were
+// tracked, and are the first removed by the orders using access times.
+func Evict(ctx context.Context, bs bstore.GCBlockstore, dstor dstore.Datastore, pn pin.Pinner, idx *AccessIndex, bestEffortRoots []cid.Cid, p EvictPolicy) <-chan Result {
+	ctx, cancel := context.WithCancel(ctx)
+	output := make(chan Result, 128)
+
+	if idx == nil && p.needsAccess() {
+		output <- Result{Error: ErrNoAccessIndex}
+		close(output)
+		cancel()
+		return output
+	}
+
+	unlocker := bs.GCLock()
+	ds := dag.NewDAGService(bserv.New(bs, offline.Exchange(bs)))
+
+	go func() {
+		defer cancel()
+		defer close(output)
+		defer unlocker.Unlock()
+
+		candidates, err := evictCandidates(ctx, bs, pn, ds, idx, bestEffortRoots, p, output)
+		if err != nil {
+			select {
+			case output <- Result{Error: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+
+		errors := false
+		var freed uint64
+		for _, c := range candidates {
+			if freed >= p.Target || ctx.Err() != nil {
+				break
+			}
+			if err := bs.DeleteBlock(c.k); err != nil {
+				errors = true
+				select {
+				case output <- Result{Error: &CannotDeleteBlockError{c.k, err}}:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+			freed += c.size
+			select {
+			case output <- Result{KeyRemoved: c.k}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if errors {
+			select {
+			case output <- Result{Error: ErrCannotDeleteSomeBlocks}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		gds, ok := dstor.(dstore.GCDatastore)
+		if !ok {
+			return
+		}
+		if err := gds.CollectGarbage(); err != nil {
+			select {
+			case output <- Result{Error: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return output
+}
+
+// evictCandidates returns the unpinned blocks p allows to remove, in the
+// order to remove them.
+func evictCandidates(ctx context.Context, bs bstore.GCBlockstore, pn pin.Pinner, ng ipld.NodeGetter, idx *AccessIndex, bestEffortRoots []cid.Cid, p EvictPolicy, output chan<- Result) ([]evictCandidate, error) {
+	gcs, err := ColoredSet(ctx, pn, ng, bestEffortRoots, output)
+	if err != nil {
+		return nil, err
+	}
+	var accesses map[cid.Cid]Access
+	if idx != nil {
+		if accesses, err = idx.Accesses(); err != nil {
+			return nil, err
+		}
+	}
+
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var candidates []evictCandidate
+	for k := range keys {
+		if gcs.Has(k) {
+			continue
+		}
+		acc := accesses[k]
+		if p.MinAge > 0 && !acc.Written.IsZero() && now.Sub(acc.Written) < p.MinAge {
+			continue
+		}
+		size, err := bs.GetSize(k)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, evictCandidate{k: k, size: uint64(size), acc: acc})
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var less func(a, b evictCandidate) bool
+	switch p.Order {
+	case EvictLRU:
+		less = func(a, b evictCandidate) bool { return lastUsed(a.acc).Before(lastUsed(b.acc)) }
+	case EvictOldest:
+		less = func(a, b evictCandidate) bool { return a.acc.Written.Before(b.acc.Written) }
+	case EvictLargest:
+		less = func(a, b evictCandidate) bool { return a.size > b.size }
+	}
+	if less != nil {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return less(candidates[i], candidates[j])
+		})
+	}
+	return candidates, nil
+}
+
+func lastUsed(acc Access) time.Time {
+	if acc.Written.After(acc.Accessed) {
+		return acc.Written
+	}
+	return acc.Accessed
+}
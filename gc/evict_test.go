@@ -0,0 +1,104 @@
+package gc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	dstore "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+func TestAccessIndex(t *testing.T) {
+	ds := dssync.MutexWrap(dstore.NewMapDatastore())
+	idx := NewAccessIndex(ds)
+	bs := NewReadTracker(NewWriteTracker(newTestRepo(t, ds).bs, idx), idx)
+
+	written := blocks.NewBlock([]byte("written"))
+	deleted := blocks.NewBlock([]byte("deleted"))
+	if err := bs.PutMany([]blocks.Block{written, deleted}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.DeleteBlock(deleted.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.Get(written.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	accesses, err := idx.Accesses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accesses) != 1 {
+		t.Fatalf("unexpected accesses: %v", accesses)
+	}
+	if acc := accesses[written.Cid()]; acc.Written.IsZero() || acc.Accessed.Before(acc.Written) {
+		t.Errorf("unexpected access of the written block: %+v", acc)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(dstore.NewMapDatastore())
+	r := newTestRepo(t, ds)
+	idx := NewAccessIndex(ds)
+	defer idx.Close()
+
+	pinned, _ := r.tree(t, "pinned")
+	if err := r.pinner.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cold, coldLeaf := r.tree(t, "cold")
+	hot, hotLeaf := r.tree(t, "hot")
+	fresh, freshLeaf := r.tree(t, "fresh")
+	set := func(nd ipld.Node, written, accessed time.Duration) {
+		acc := Access{Written: now.Add(-written), Accessed: now.Add(-accessed)}
+		if err := ds.Put(accessKey(nd.Cid()), encodeAccess(acc)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set(cold, 72*time.Hour, 48*time.Hour)
+	set(coldLeaf, 72*time.Hour, 48*time.Hour)
+	set(hot, 96*time.Hour, time.Minute)
+	set(hotLeaf, 96*time.Hour, time.Minute)
+	set(fresh, time.Minute, time.Minute)
+	set(freshLeaf, time.Minute, time.Minute)
+
+	evict := func(p EvictPolicy) []ipld.Node {
+		var removed []ipld.Node
+		for res := range Evict(ctx, r.bs, ds, r.pinner, idx, nil, p) {
+			if res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			for _, nd := range []ipld.Node{cold, coldLeaf, hot, hotLeaf, fresh, freshLeaf} {
+				if nd.Cid().Equals(res.KeyRemoved) {
+					removed = append(removed, nd)
+				}
+			}
+		}
+		return removed
+	}
+
+	// The two cold blocks free enough.
+	size := uint64(len(cold.RawData()) + len(coldLeaf.RawData()))
+	if removed := evict(EvictPolicy{Order: EvictLRU, Target: size}); len(removed) != 2 || r.has(t, cold) || r.has(t, coldLeaf) {
+		t.Errorf("LRU eviction removed %d blocks, expected the cold ones", len(removed))
+	}
+	// The fresh blocks are too young to be removed.
+	if removed := evict(EvictPolicy{Order: EvictOldest, MinAge: time.Hour, Target: 1 << 20}); len(removed) != 2 || r.has(t, hot) || r.has(t, hotLeaf) {
+		t.Errorf("oldest first eviction removed %d blocks, expected the hot ones", len(removed))
+	}
+	if !r.has(t, fresh, freshLeaf, pinned) {
+		t.Error("fresh or pinned blocks were removed")
+	}
+	if removed := evict(EvictPolicy{Order: EvictLargest, Target: 1}); len(removed) != 1 || !fresh.Cid().Equals(removed[0].Cid()) {
+		t.Errorf("largest first eviction removed %v, expected the fresh root", removed)
+	}
+}
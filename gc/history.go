@@ -0,0 +1,268 @@
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	dstore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+var (
+	historyPrefix      = dstore.NewKey("/local/gc/history")
+	historyPinPrefix   = historyPrefix.ChildString("pins")
+	historyFilesPrefix = historyPrefix.ChildString("files")
+)
+
+// maxFilesRoots is the number of former files roots kept in the history.
+const maxFilesRoots = 32
+
+// The kinds of roots referencing blocks.
+const (
+	KindDirect     = "direct pin"
+	KindRecursive  = "recursive pin"
+	KindInternal   = "internal pin"
+	KindFiles      = "files"
+	KindBestEffort = "best effort root"
+)
+
+// Referrer is a former root of blocks: a pin that was removed or a former
+// root of the files API.
+type Referrer struct {
+	Kind string
+	Cid  cid.Cid
+	// Path is the files API path of the blocks, for former files roots.
+	Path string `json:",omitempty"`
+	// Time is when the root stopped referencing the blocks.
+	Time time.Time
+}
+
+type pinRecord struct {
+	Kind string
+	Time time.Time
+}
+
+// History records the former roots of blocks, so dry runs can tell what last
+// referenced the blocks a collection would remove. Removed pins are recorded
+// until pinned again or pruned after their root is collected, and the last maxFilesRoots roots of the
+// files API are recorded as they are replaced.
+type History struct {
+	ds dstore.Datastore
+	lk sync.Mutex
+}
+
+func NewHistory(ds dstore.Datastore) *History {
+	return &History{ds: ds}
+}
+
+func historyPinKey(k cid.Cid) dstore.Key {
+	return historyPinPrefix.ChildString(k.String())
+}
+
+func (h *History) recordPin(k cid.Cid, kind string) error {
+	data, err := json.Marshal(&pinRecord{Kind: kind, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	return h.ds.Put(historyPinKey(k), data)
+}
+
+func (h *History) forgetPin(k cid.Cid) error {
+	if err := h.ds.Delete(historyPinKey(k)); err != nil && err != dstore.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// Prune forgets the removed pins whose root is no longer in bs, as a
+// collection removed it.
+func (h *History) Prune(bs bstore.Blockstore) error {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	res, err := h.ds.Query(query.Query{Prefix: historyPinPrefix.String(), KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	pins, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, e := range pins {
+		k, err := cid.Decode(dstore.RawKey(e.Key).BaseNamespace())
+		if err != nil {
+			return err
+		}
+		has, err := bs.Has(k)
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+		if err := h.ds.Delete(dstore.RawKey(e.Key)); err != nil && err != dstore.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordFilesRoot records k as a former root of the files API, replaced now.
+func (h *History) RecordFilesRoot(k cid.Cid) error {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	// Zero padded so that keys sort by time.
+	key := historyFilesPrefix.ChildString(fmt.Sprintf("%020d", time.Now().UnixNano()))
+	if err := h.ds.Put(key, k.Bytes()); err != nil {
+		return err
+	}
+
+	res, err := h.ds.Query(query.Query{Prefix: historyFilesPrefix.String(), KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	roots, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	if len(roots) <= maxFilesRoots {
+		return nil
+	}
+	sort.Slice(roots, func(i, j int) bool {
+		return roots[i].Key < roots[j].Key
+	})
+	for _, e := range roots[:len(roots)-maxFilesRoots] {
+		if err := h.ds.Delete(dstore.RawKey(e.Key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// referrers returns the recorded referrers, the most recent first.
+func (h *History) referrers() ([]Referrer, error) {
+	var refs []Referrer
+
+	res, err := h.ds.Query(query.Query{Prefix: historyPinPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	pins, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range pins {
+		k, err := cid.Decode(dstore.RawKey(e.Key).BaseNamespace())
+		if err != nil {
+			return nil, err
+		}
+		var rec pinRecord
+		if err := json.Unmarshal(e.Value, &rec); err != nil {
+			return nil, fmt.Errorf("invalid history record of %s: %w", k, err)
+		}
+		refs = append(refs, Referrer{Kind: rec.Kind, Cid: k, Time: rec.Time})
+	}
+
+	res, err = h.ds.Query(query.Query{Prefix: historyFilesPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	roots, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range roots {
+		k, err := cid.Cast(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		nanos, err := strconv.ParseInt(dstore.RawKey(e.Key).BaseNamespace(), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid history key %s: %w", e.Key, err)
+		}
+		refs = append(refs, Referrer{Kind: KindFiles, Cid: k, Path: "/", Time: time.Unix(0, nanos)})
+	}
+
+	sort.SliceStable(refs, func(i, j int) bool {
+		return refs[i].Time.After(refs[j].Time)
+	})
+	return refs, nil
+}
+
+type historyPinner struct {
+	pin.Pinner
+	h *History
+}
+
+// NewHistoryPinner wraps pn so that h records the pins removed from it.
+func NewHistoryPinner(pn pin.Pinner, h *History) pin.Pinner {
+	return &historyPinner{Pinner: pn, h: h}
+}
+
+func (p *historyPinner) record(k cid.Cid, kind string) {
+	if err := p.h.recordPin(k, kind); err != nil {
+		log.Errorf("failed to record removed pin %s: %v", k, err)
+	}
+}
+
+func (p *historyPinner) forget(k cid.Cid) {
+	if err := p.h.forgetPin(k); err != nil {
+		log.Errorf("failed to forget removed pin %s: %v", k, err)
+	}
+}
+
+func (p *historyPinner) Pin(ctx context.Context, node ipld.Node, recursive bool) error {
+	if err := p.Pinner.Pin(ctx, node, recursive); err != nil {
+		return err
+	}
+	p.forget(node.Cid())
+	return nil
+}
+
+func (p *historyPinner) Unpin(ctx context.Context, c cid.Cid, recursive bool) error {
+	kind := KindDirect
+	if mode, pinned, err := p.Pinner.IsPinnedWithType(ctx, c, pin.Recursive); err == nil && pinned && mode == "recursive" {
+		kind = KindRecursive
+	}
+	if err := p.Pinner.Unpin(ctx, c, recursive); err != nil {
+		return err
+	}
+	p.record(c, kind)
+	return nil
+}
+
+func (p *historyPinner) Update(ctx context.Context, from, to cid.Cid, unpin bool) error {
+	if err := p.Pinner.Update(ctx, from, to, unpin); err != nil {
+		return err
+	}
+	p.forget(to)
+	if unpin && !from.Equals(to) {
+		p.record(from, KindRecursive)
+	}
+	return nil
+}
+
+func (p *historyPinner) PinWithMode(c cid.Cid, mode pin.Mode) {
+	p.Pinner.PinWithMode(c, mode)
+	p.forget(c)
+}
+
+func (p *historyPinner) RemovePinWithMode(c cid.Cid, mode pin.Mode) {
+	p.Pinner.RemovePinWithMode(c, mode)
+	switch mode {
+	case pin.Recursive:
+		p.record(c, KindRecursive)
+	case pin.Direct:
+		p.record(c, KindDirect)
+	}
+}
@@ -0,0 +1,672 @@
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	bserv "github.com/ipfs/go-blockservice"
+	cid "github.com/ipfs/go-cid"
+	dstore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-verifcid"
+)
+
+const (
+	// markBatch is the number of grey blocks whose links are read at once.
+	markBatch = 32
+	// checkpointInterval is how often the progress of marking is saved.
+	checkpointInterval = 10 * time.Second
+	// batchSize bounds the keys written per batch by bulk writes and
+	// deletions.
+	batchSize = 1024
+)
+
+var (
+	checkpointPrefix = dstore.NewKey("/local/gc")
+	checkpointKey    = checkpointPrefix.ChildString("state")
+	markedPrefix     = checkpointPrefix.ChildString("marked")
+)
+
+type phase int
+
+const (
+	phaseMark phase = iota
+	phaseSweep
+)
+
+// origin is how a block came to be marked. The descendants of a block share
+// its origin.
+type origin int
+
+const (
+	// originPin blocks are pinned and must be readable.
+	originPin origin = iota
+	// originBestEffort blocks are reachable from the best effort roots and
+	// may be missing.
+	originBestEffort
+	// originBarrier blocks were shaded by the barrier. They may be missing
+	// or not decode.
+	originBarrier
+)
+
+// greyNode is a marked block whose links are not marked yet.
+type greyNode struct {
+	Cid    cid.Cid
+	Origin origin `json:",omitempty"`
+}
+
+// checkpoint is the saved progress of an incremental collection. The marked
+// blocks are saved under markedPrefix.
+type checkpoint struct {
+	Grey []greyNode
+	// Missing are the unmarked blocks linked from marked ones. They are
+	// marked when the collection resumes if they were written meanwhile.
+	Missing []greyNode `json:",omitempty"`
+}
+
+// Incremental performs a mark and sweep garbage collection like GC without
+// holding the GC lock for the whole run. Blocks are marked while the node
+// keeps writing, with barrier shading the blocks written and the pins added
+// meanwhile, which must be the barrier the blockstore and pinner of the node
+// are wrapped with. The GC lock is only held to mark what changed since
+// marking started. Blocks are then swept while the node keeps writing.
+//
+// The progress of marking is saved to dstor, and a collection that is
+// interrupted resumes from it the next time it runs.
+func Incremental(ctx context.Context, bs bstore.GCBlockstore, dstor dstore.Datastore, pn pin.Pinner, bestEffortRoots []cid.Cid, barrier *Barrier) <-chan Result {
+	ctx, cancel := context.WithCancel(ctx)
+
+	output := make(chan Result, 128)
+
+	go func() {
+		defer cancel()
+		defer close(output)
+
+		fail := func(err error) {
+			select {
+			case output <- Result{Error: err}:
+			case <-ctx.Done():
+			}
+		}
+
+		c := newCollector(bs, dstor)
+		if err := barrier.attach(c); err != nil {
+			fail(err)
+			return
+		}
+		defer barrier.detach(c)
+
+		resumed, err := c.load()
+		if err != nil {
+			fail(err)
+			return
+		}
+		if resumed {
+			log.Infof("resuming garbage collection with %d marked blocks", c.marked.Len())
+		}
+
+		err = c.markRoots(ctx, pn, bestEffortRoots, output)
+		if err == nil {
+			err = c.finish(ctx, pn, bestEffortRoots, output)
+		}
+		if err != nil {
+			if serr := c.save(); serr != nil {
+				log.Errorf("failed to save garbage collection progress: %v", serr)
+			}
+			fail(err)
+			return
+		}
+
+		err = c.sweep(ctx, output)
+		if ctx.Err() != nil {
+			// The checkpoint is kept. The next run marks what
+			// changed since before sweeping again.
+			return
+		}
+		if err != nil {
+			fail(err)
+			if err != ErrCannotDeleteSomeBlocks {
+				return
+			}
+		}
+		if c.ds != nil {
+			if err := clearCheckpoint(c.ds); err != nil {
+				fail(err)
+				return
+			}
+		}
+
+		gds, ok := dstor.(dstore.GCDatastore)
+		if !ok {
+			return
+		}
+		if err := gds.CollectGarbage(); err != nil {
+			fail(err)
+		}
+	}()
+
+	return output
+}
+
+// collector is the state of an incremental collection. Blocks are white until
+// marked. Marked blocks are grey until their links are marked, then black.
+type collector struct {
+	bs bstore.GCBlockstore
+	ng ipld.NodeGetter
+	// ds saves the progress of marking, nil when the datastore can not
+	// write it atomically.
+	ds    dstore.Batching
+	saved time.Time
+
+	lk     sync.Mutex
+	phase  phase
+	marked *cid.Set
+	// kept are blocks kept without marking their links: direct pins, and
+	// blocks written during the sweep.
+	kept *cid.Set
+	grey []greyNode
+	// failed are the grey blocks whose links could not be read.
+	failed []greyNode
+	// missing are the grey blocks that were unmarked for being missing.
+	// The barrier shades them if they are written during the collection,
+	// and load checks them again, as nothing does between runs.
+	missing []greyNode
+	// unsaved and unmarked are the changes to marked since the last save.
+	unsaved  []cid.Cid
+	unmarked []cid.Cid
+}
+
+func newCollector(bs bstore.GCBlockstore, dstor dstore.Datastore) *collector {
+	bsrv := bserv.New(bs, offline.Exchange(bs))
+	c := &collector{
+		bs:     bs,
+		ng:     dag.NewDAGService(bsrv),
+		saved:  time.Now(),
+		marked: cid.NewSet(),
+		kept:   cid.NewSet(),
+	}
+	if ds, ok := dstor.(dstore.Batching); ok {
+		c.ds = ds
+	}
+	return c
+}
+
+// mark marks k without marking its links. The caller must hold lk.
+func (c *collector) mark(k cid.Cid) bool {
+	if !c.marked.Visit(k) {
+		return false
+	}
+	if c.phase == phaseMark {
+		c.unsaved = append(c.unsaved, k)
+	}
+	return true
+}
+
+// shade marks k grey unless it is marked already. The caller must hold lk.
+func (c *collector) shade(k cid.Cid, o origin) {
+	if c.mark(k) {
+		c.grey = append(c.grey, greyNode{Cid: k, Origin: o})
+	}
+}
+
+func (c *collector) shadeBlock(k cid.Cid) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.phase == phaseSweep {
+		c.kept.Add(k)
+		return
+	}
+	c.shade(k, originBarrier)
+}
+
+func (c *collector) shadePin(ctx context.Context, k cid.Cid, recursive bool) error {
+	c.lk.Lock()
+	switch {
+	case !recursive:
+		c.kept.Add(k)
+	case c.phase == phaseMark:
+		c.shade(k, originBarrier)
+	default:
+		// Marked blocks have all their links marked once sweeping
+		// starts.
+		if c.mark(k) {
+			c.lk.Unlock()
+			return c.protect(ctx, k)
+		}
+	}
+	c.lk.Unlock()
+	return nil
+}
+
+// protect marks the descendants of root during the sweep. Each block is marked
+// before it is read, so the sweep either sees it marked or deleted it before,
+// in which case the pinner fetches it again.
+func (c *collector) protect(ctx context.Context, root cid.Cid) error {
+	stack := []cid.Cid{root}
+	for len(stack) > 0 {
+		k := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		links, err := c.links(ctx, k)
+		if err == ipld.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		c.lk.Lock()
+		for _, l := range links {
+			if c.mark(l.Cid) {
+				stack = append(stack, l.Cid)
+			}
+		}
+		c.lk.Unlock()
+	}
+	return nil
+}
+
+func (c *collector) links(ctx context.Context, k cid.Cid) ([]*ipld.Link, error) {
+	if err := verifcid.ValidateCid(k); err != nil {
+		return nil, err
+	}
+	return ipld.GetLinks(ctx, c.ng, k)
+}
+
+// markRoots marks the pinned blocks and bestEffortRoots with their
+// descendants. Blocks marked already are skipped.
+func (c *collector) markRoots(ctx context.Context, pn pin.Pinner, bestEffortRoots []cid.Cid, output chan<- Result) error {
+	rkeys, err := pn.RecursiveKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if err := c.markFrom(ctx, rkeys, originPin, output); err != nil {
+		return err
+	}
+	if err := c.markFrom(ctx, bestEffortRoots, originBestEffort, output); err != nil {
+		return err
+	}
+
+	dkeys, err := pn.DirectKeys(ctx)
+	if err != nil {
+		return err
+	}
+	c.lk.Lock()
+	for _, k := range dkeys {
+		c.kept.Add(k)
+	}
+	c.lk.Unlock()
+
+	ikeys, err := pn.InternalPins(ctx)
+	if err != nil {
+		return err
+	}
+	return c.markFrom(ctx, ikeys, originPin, output)
+}
+
+func (c *collector) markFrom(ctx context.Context, roots []cid.Cid, o origin, output chan<- Result) error {
+	for _, k := range roots {
+		c.lk.Lock()
+		c.shade(k, o)
+		c.lk.Unlock()
+		if err := c.drain(ctx, output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drain marks the links of grey blocks until none are left. Blocks whose
+// links can not be read are reported and stay grey in the checkpoint.
+func (c *collector) drain(ctx context.Context, output chan<- Result) error {
+	for {
+		c.lk.Lock()
+		n := len(c.grey)
+		if n > markBatch {
+			n = markBatch
+		}
+		batch := make([]greyNode, n)
+		copy(batch, c.grey[len(c.grey)-n:])
+		c.grey = c.grey[:len(c.grey)-n]
+		c.lk.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		links := make([][]*ipld.Link, n)
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := range batch {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				links[i], errs[i] = c.links(ctx, batch[i].Cid)
+			}(i)
+		}
+		wg.Wait()
+
+		if ctx.Err() != nil {
+			c.lk.Lock()
+			c.grey = append(c.grey, batch...)
+			c.lk.Unlock()
+			return ctx.Err()
+		}
+
+		var failed []Result
+		c.lk.Lock()
+		for i, g := range batch {
+			switch err := errs[i]; {
+			case err == nil:
+				for _, l := range links[i] {
+					c.shade(l.Cid, g.Origin)
+				}
+			case g.Origin != originPin && err == ipld.ErrNotFound:
+				// Nothing is reachable through a missing block. It
+				// is marked again if it is written later.
+				c.marked.Remove(g.Cid)
+				c.unmarked = append(c.unmarked, g.Cid)
+				c.missing = append(c.missing, g)
+			case g.Origin == originBarrier:
+				log.Debugf("not marking links of %s: %v", g.Cid, err)
+			default:
+				c.failed = append(c.failed, g)
+				failed = append(failed, Result{Error: &CannotFetchLinksError{g.Cid, err}})
+			}
+		}
+		c.lk.Unlock()
+
+		for _, res := range failed {
+			select {
+			case output <- res:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if time.Since(c.saved) >= checkpointInterval {
+			if err := c.save(); err != nil {
+				log.Warnf("failed to save garbage collection progress: %v", err)
+			}
+		}
+	}
+}
+
+// finish marks what changed since marking started while holding the GC lock,
+// which waits for adds in progress to pin their content, and starts the
+// sweep. The roots are marked again for pins added without the barrier.
+func (c *collector) finish(ctx context.Context, pn pin.Pinner, bestEffortRoots []cid.Cid, output chan<- Result) error {
+	c.lk.Lock()
+	failed := len(c.failed) > 0
+	c.lk.Unlock()
+	if failed {
+		return ErrCannotFetchAllLinks
+	}
+
+	start := time.Now()
+	unlocker := c.bs.GCLock()
+	defer unlocker.Unlock()
+
+	if err := c.markRoots(ctx, pn, bestEffortRoots, output); err != nil {
+		return err
+	}
+	for {
+		// Blocks are still written while the lock is held.
+		if err := c.drain(ctx, output); err != nil {
+			return err
+		}
+		c.lk.Lock()
+		if len(c.failed) > 0 {
+			c.lk.Unlock()
+			return ErrCannotFetchAllLinks
+		}
+		if len(c.grey) == 0 {
+			c.phase = phaseSweep
+			c.lk.Unlock()
+			break
+		}
+		c.lk.Unlock()
+	}
+	if err := c.save(); err != nil {
+		log.Warnf("failed to save garbage collection progress: %v", err)
+	}
+	log.Infof("garbage collection held the GC lock for %s", time.Since(start))
+	return nil
+}
+
+// sweep deletes the blocks that are neither marked nor kept. Blocks are
+// checked and deleted while holding lk, so a block written meanwhile is either
+// shaded before or written again after it is deleted.
+func (c *collector) sweep(ctx context.Context, output chan<- Result) error {
+	keychan, err := c.bs.AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+
+	errors := false
+loop:
+	for ctx.Err() == nil { // select may not notice that we're "done".
+		select {
+		case k, ok := <-keychan:
+			if !ok {
+				break loop
+			}
+			var res Result
+			c.lk.Lock()
+			if !c.marked.Has(k) && !c.kept.Has(k) {
+				if err := c.bs.DeleteBlock(k); err != nil {
+					res.Error = &CannotDeleteBlockError{k, err}
+				} else {
+					res.KeyRemoved = k
+				}
+			}
+			c.lk.Unlock()
+			if res.Error == nil && !res.KeyRemoved.Defined() {
+				continue
+			}
+			if res.Error != nil {
+				errors = true
+			}
+			select {
+			case output <- res:
+			case <-ctx.Done():
+				break loop
+			}
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if errors {
+		return ErrCannotDeleteSomeBlocks
+	}
+	return nil
+}
+
+// save writes a checkpoint of the marked, grey and missing blocks. The
+// checkpoint is written in one batch, as a marked block must never be saved
+// without its links being marked, grey or missing.
+func (c *collector) save() error {
+	c.saved = time.Now()
+	if c.ds == nil {
+		return nil
+	}
+
+	c.lk.Lock()
+	cp := checkpoint{Grey: make([]greyNode, 0, len(c.grey)+len(c.failed))}
+	cp.Grey = append(append(cp.Grey, c.grey...), c.failed...)
+	missing := c.missing[:0]
+	for _, g := range c.missing {
+		// Written and shaded since it was found missing.
+		if !c.marked.Has(g.Cid) {
+			missing = append(missing, g)
+		}
+	}
+	c.missing = missing
+	cp.Missing = append([]greyNode(nil), missing...)
+	var puts, deletes []cid.Cid
+	for _, k := range c.unsaved {
+		if c.marked.Has(k) {
+			puts = append(puts, k)
+		}
+	}
+	for _, k := range c.unmarked {
+		if !c.marked.Has(k) {
+			deletes = append(deletes, k)
+		}
+	}
+	c.unsaved, c.unmarked = nil, nil
+	c.lk.Unlock()
+
+	err := c.commit(cp, puts, deletes)
+	if err != nil {
+		c.lk.Lock()
+		c.unsaved = append(puts, c.unsaved...)
+		c.unmarked = append(deletes, c.unmarked...)
+		c.lk.Unlock()
+	}
+	return err
+}
+
+func (c *collector) commit(cp checkpoint, puts, deletes []cid.Cid) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	b, err := c.ds.Batch()
+	if err != nil {
+		return err
+	}
+	for _, k := range deletes {
+		if err := b.Delete(markedPrefix.ChildString(k.String())); err != nil {
+			return err
+		}
+	}
+	for _, k := range puts {
+		if err := b.Put(markedPrefix.ChildString(k.String()), []byte{}); err != nil {
+			return err
+		}
+	}
+	if err := b.Put(checkpointKey, data); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// load restores the checkpoint of an interrupted collection. It returns
+// false when there is none. The missing blocks written since the checkpoint
+// are shaded, as their parents are marked already. The barrier must be
+// attached, so that the blocks written while loading are shaded too.
+func (c *collector) load() (bool, error) {
+	if c.ds == nil {
+		return false, nil
+	}
+	data, err := c.ds.Get(checkpointKey)
+	if err == dstore.ErrNotFound {
+		// Drop marks left by a collection that did not finish clearing
+		// its checkpoint.
+		return false, clearCheckpoint(c.ds)
+	}
+	if err != nil {
+		return false, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		log.Warnf("discarding invalid garbage collection checkpoint: %v", err)
+		return false, clearCheckpoint(c.ds)
+	}
+
+	res, err := c.ds.Query(query.Query{Prefix: markedPrefix.String(), KeysOnly: true})
+	if err != nil {
+		return false, err
+	}
+	defer res.Close()
+	marked := cid.NewSet()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return false, r.Error
+		}
+		k, err := cid.Decode(dstore.RawKey(r.Key).Name())
+		if err != nil {
+			return false, err
+		}
+		marked.Add(k)
+	}
+	written := make([]bool, len(cp.Missing))
+	for i, g := range cp.Missing {
+		if written[i], err = c.bs.Has(g.Cid); err != nil {
+			return false, err
+		}
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	// Blocks shaded by the barrier since it was attached stay grey.
+	if err := marked.ForEach(func(k cid.Cid) error {
+		c.marked.Add(k)
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	for _, g := range cp.Grey {
+		c.marked.Add(g.Cid)
+	}
+	c.grey = append(c.grey, cp.Grey...)
+	for i, g := range cp.Missing {
+		if written[i] {
+			c.shade(g.Cid, g.Origin)
+		} else if !c.marked.Has(g.Cid) {
+			c.missing = append(c.missing, g)
+		}
+	}
+	return true, nil
+}
+
+// clearCheckpoint removes the checkpoint of a collection. The state goes
+// first, so that leftover marks are never mistaken for progress.
+func clearCheckpoint(ds dstore.Batching) error {
+	if err := ds.Delete(checkpointKey); err != nil && err != dstore.ErrNotFound {
+		return err
+	}
+	return deletePrefix(ds, markedPrefix)
+}
+
+// deletePrefix deletes the keys under prefix in batches.
+func deletePrefix(ds dstore.Batching, prefix dstore.Key) error {
+	res, err := ds.Query(query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	b, err := ds.Batch()
+	if err != nil {
+		return err
+	}
+	n := 0
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		if err := b.Delete(dstore.RawKey(r.Key)); err != nil {
+			return err
+		}
+		if n++; n == batchSize {
+			if err := b.Commit(); err != nil {
+				return err
+			}
+			if b, err = ds.Batch(); err != nil {
+				return err
+			}
+			n = 0
+		}
+	}
+	return b.Commit()
+}
@@ -0,0 +1,247 @@
+package gc
+
+import (
+	"context"
+	"testing"
+
+	bserv "github.com/ipfs/go-blockservice"
+	cid "github.com/ipfs/go-cid"
+	dstore "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	"github.com/ipfs/go-ipfs-pinner/dspinner"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+type testRepo struct {
+	ds      dstore.Batching
+	bs      bstore.GCBlockstore
+	dserv   ipld.DAGService
+	pinner  pin.Pinner
+	barrier *Barrier
+	refs    *RefIndex
+	history *History
+	// inner is the pinner without the barrier, the refcount index and the
+	// history.
+	inner pin.Pinner
+}
+
+func newTestRepo(t *testing.T, ds dstore.Batching) *testRepo {
+	r := &testRepo{ds: ds, barrier: NewBarrier()}
+	bs := NewBarrierBlockstore(bstore.NewBlockstore(ds), r.barrier)
+	r.bs = bstore.NewGCBlockstore(bs, bstore.NewGCLocker())
+	r.dserv = dag.NewDAGService(bserv.New(r.bs, offline.Exchange(r.bs)))
+	pinner, err := dspinner.New(context.Background(), ds, r.dserv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.inner = pinner
+	r.refs = NewRefIndex(ds, r.bs)
+	r.history = NewHistory(ds)
+	r.pinner = NewBarrierPinner(NewRefcountPinner(NewHistoryPinner(pinner, r.history), r.refs), r.barrier)
+	return r
+}
+
+// tree adds a node linking to a new leaf and returns both.
+func (r *testRepo) tree(t *testing.T, name string) (*dag.ProtoNode, *dag.ProtoNode) {
+	leaf := dag.NodeWithData([]byte(name + " leaf"))
+	root := dag.NodeWithData([]byte(name))
+	if err := root.AddNodeLink("leaf", leaf); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.dserv.AddMany(context.Background(), []ipld.Node{leaf, root}); err != nil {
+		t.Fatal(err)
+	}
+	return root, leaf
+}
+
+func (r *testRepo) has(t *testing.T, nodes ...ipld.Node) bool {
+	for _, nd := range nodes {
+		ok, err := r.bs.Has(nd.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *testRepo) collect(t *testing.T, bestEffortRoots ...cid.Cid) []cid.Cid {
+	var removed []cid.Cid
+	for res := range Incremental(context.Background(), r.bs, r.ds, r.pinner, bestEffortRoots, r.barrier) {
+		if res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		removed = append(removed, res.KeyRemoved)
+	}
+	return removed
+}
+
+func TestIncremental(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t, dssync.MutexWrap(dstore.NewMapDatastore()))
+
+	pinned, pinnedLeaf := r.tree(t, "pinned")
+	direct, directLeaf := r.tree(t, "direct")
+	garbage, garbageLeaf := r.tree(t, "garbage")
+	if err := r.pinner.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.pinner.Pin(ctx, direct, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.pinner.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	removed := r.collect(t)
+	if len(removed) != 3 {
+		t.Errorf("removed %d blocks, expected 3", len(removed))
+	}
+	if !r.has(t, pinned, pinnedLeaf, direct) {
+		t.Error("pinned blocks were removed")
+	}
+	if r.has(t, directLeaf) || r.has(t, garbage) || r.has(t, garbageLeaf) {
+		t.Error("unpinned blocks were kept")
+	}
+	if _, err := r.ds.Get(checkpointKey); err != dstore.ErrNotFound {
+		t.Errorf("checkpoint not cleared: %v", err)
+	}
+}
+
+func TestIncrementalBarrier(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t, dssync.MutexWrap(dstore.NewMapDatastore()))
+	pinnedLate, pinnedLateLeaf := r.tree(t, "pinned during sweep")
+
+	c := newCollector(r.bs, r.ds)
+	if err := r.barrier.attach(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.barrier.attach(newCollector(r.bs, r.ds)); err != ErrGCRunning {
+		t.Errorf("second collection attached: %v", err)
+	}
+	output := make(chan Result, 128)
+	if err := c.markRoots(ctx, r.pinner, nil, output); err != nil {
+		t.Fatal(err)
+	}
+
+	// Written while marking, then pinned.
+	written, writtenLeaf := r.tree(t, "written")
+	if err := r.pinner.Pin(ctx, written, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.finish(ctx, r.pinner, nil, output); err != nil {
+		t.Fatal(err)
+	}
+
+	// Written and pinned while sweeping.
+	sweepWritten, _ := r.tree(t, "written during sweep")
+	if err := r.pinner.Pin(ctx, pinnedLate, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.sweep(ctx, output); err != nil {
+		t.Fatal(err)
+	}
+	r.barrier.detach(c)
+
+	if !r.has(t, written, writtenLeaf) {
+		t.Error("blocks written while marking were removed")
+	}
+	if !r.has(t, sweepWritten) {
+		t.Error("block written while sweeping was removed")
+	}
+	if !r.has(t, pinnedLate, pinnedLateLeaf) {
+		t.Error("blocks pinned while sweeping were removed")
+	}
+}
+
+func TestIncrementalResume(t *testing.T) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(dstore.NewMapDatastore())
+	r := newTestRepo(t, ds)
+	pinned, pinnedLeaf := r.tree(t, "pinned")
+	if err := r.pinner.Pin(ctx, pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.pinner.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupt a collection after marking.
+	c := newCollector(r.bs, r.ds)
+	if err := c.markRoots(ctx, r.pinner, nil, make(chan Result, 128)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pin is gone when the collection resumes. Blocks marked before
+	// the interruption are kept until the next collection.
+	r = newTestRepo(t, ds)
+	if err := r.pinner.Unpin(ctx, pinned.Cid(), true); err != nil {
+		t.Fatal(err)
+	}
+	garbage, garbageLeaf := r.tree(t, "garbage")
+	resumed := newCollector(r.bs, r.ds)
+	if ok, err := resumed.load(); err != nil || !ok {
+		t.Fatalf("checkpoint not loaded: %v", err)
+	}
+	if !resumed.marked.Has(pinned.Cid()) || !resumed.marked.Has(pinnedLeaf.Cid()) {
+		t.Fatal("marked blocks not restored")
+	}
+
+	if removed := r.collect(t); len(removed) != 2 || r.has(t, garbage) || r.has(t, garbageLeaf) {
+		t.Errorf("unexpected removals: %v", removed)
+	}
+	if !r.has(t, pinned, pinnedLeaf) {
+		t.Error("blocks marked before the interruption were removed")
+	}
+	if removed := r.collect(t); len(removed) != 2 {
+		t.Errorf("removed %d blocks on the next collection, expected 2", len(removed))
+	}
+}
+
+func TestIncrementalResumeMissing(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t, dssync.MutexWrap(dstore.NewMapDatastore()))
+
+	// A best effort root whose subtree is not fetched yet.
+	child, childLeaf := dag.NodeWithData([]byte("child")), dag.NodeWithData([]byte("child leaf"))
+	if err := child.AddNodeLink("leaf", childLeaf); err != nil {
+		t.Fatal(err)
+	}
+	root := dag.NodeWithData([]byte("root"))
+	if err := root.AddNodeLink("child", child); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.dserv.Add(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupt a collection after marking.
+	c := newCollector(r.bs, r.ds)
+	if err := c.markRoots(ctx, r.pinner, []cid.Cid{root.Cid()}, make(chan Result, 128)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fetched between the runs, without a barrier attached.
+	if err := r.dserv.AddMany(ctx, []ipld.Node{childLeaf, child}); err != nil {
+		t.Fatal(err)
+	}
+	if removed := r.collect(t, root.Cid()); len(removed) != 0 {
+		t.Errorf("unexpected removals: %v", removed)
+	}
+	if !r.has(t, root, child, childLeaf) {
+		t.Error("blocks fetched between the runs were removed")
+	}
+}
@@ -0,0 +1,555 @@
+package gc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	bserv "github.com/ipfs/go-blockservice"
+	cid "github.com/ipfs/go-cid"
+	dstore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+var (
+	refIndexPrefix   = dstore.NewKey("/local/refcount")
+	refIndexStateKey = refIndexPrefix.ChildString("state")
+	refCountPrefix   = refIndexPrefix.ChildString("blocks")
+	refPinPrefix     = refIndexPrefix.ChildString("pins")
+)
+
+var (
+	// ErrNoRefIndex is returned when the refcount index is needed but was
+	// not built.
+	ErrNoRefIndex = errors.New("the refcount index is not built, run 'ipfs repo refcount rebuild'")
+	// ErrRefIndexStale is returned when the pins counted by the refcount
+	// index are not the pins of the pinner.
+	ErrRefIndexStale = errors.New("the refcount index does not match the pins, run 'ipfs repo refcount rebuild'")
+)
+
+// RefIndex counts the pins keeping each block: the recursive pins whose DAG
+// contains it and the direct pin of the block itself. It is disabled until
+// built with Rebuild, then kept up to date by the pinner returned by
+// NewRefcountPinner.
+type RefIndex struct {
+	ds dstore.Batching
+	bs bstore.GCBlockstore
+	ng ipld.NodeGetter
+
+	lk sync.Mutex
+}
+
+// RefMismatch is a block whose stored reference count is wrong.
+type RefMismatch struct {
+	Cid      cid.Cid
+	Count    uint64
+	Expected uint64
+}
+
+func NewRefIndex(ds dstore.Batching, bs bstore.GCBlockstore) *RefIndex {
+	bsrv := bserv.New(bs, offline.Exchange(bs))
+	return &RefIndex{ds: ds, bs: bs, ng: dag.NewDAGService(bsrv)}
+}
+
+func refCountKey(k cid.Cid) dstore.Key {
+	return refCountPrefix.ChildString(k.String())
+}
+
+func encodeCount(n uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, n)]
+}
+
+func refPinKey(k cid.Cid, mode pin.Mode) dstore.Key {
+	name, _ := pin.ModeToString(mode)
+	return refPinPrefix.ChildString(name).ChildString(k.String())
+}
+
+// Enabled reports whether the index was built.
+func (r *RefIndex) Enabled() (bool, error) {
+	return r.ds.Has(refIndexStateKey)
+}
+
+// Count returns the number of pins keeping k.
+func (r *RefIndex) Count(k cid.Cid) (uint64, error) {
+	data, err := r.ds.Get(refCountKey(k))
+	if err == dstore.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, read := binary.Uvarint(data)
+	if read <= 0 {
+		return 0, fmt.Errorf("invalid reference count of %s", k)
+	}
+	return n, nil
+}
+
+// sync counts or uncounts the recursive and direct pins of k to match pn.
+func (r *RefIndex) sync(ctx context.Context, pn pin.Pinner, k cid.Cid) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	enabled, err := r.Enabled()
+	if err != nil || !enabled {
+		return err
+	}
+	for _, mode := range []pin.Mode{pin.Recursive, pin.Direct} {
+		_, pinned, err := pn.IsPinnedWithType(ctx, k, mode)
+		if err != nil {
+			return err
+		}
+		if err := r.update(ctx, k, mode, pinned); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update counts the pin of k with mode when pinned, and uncounts it
+// otherwise. The caller must hold lk.
+func (r *RefIndex) update(ctx context.Context, k cid.Cid, mode pin.Mode, pinned bool) error {
+	pinKey := refPinKey(k, mode)
+	counted, err := r.ds.Has(pinKey)
+	if err != nil || counted == pinned {
+		return err
+	}
+	set, err := r.blocks(ctx, k, mode)
+	if err != nil {
+		return err
+	}
+
+	b, err := r.ds.Batch()
+	if err != nil {
+		return err
+	}
+	err = set.ForEach(func(c cid.Cid) error {
+		n, err := r.Count(c)
+		if err != nil {
+			return err
+		}
+		switch {
+		case pinned:
+			n++
+		case n > 0:
+			n--
+		}
+		if n == 0 {
+			return b.Delete(refCountKey(c))
+		}
+		return b.Put(refCountKey(c), encodeCount(n))
+	})
+	if err != nil {
+		return err
+	}
+	if pinned {
+		err = b.Put(pinKey, []byte{})
+	} else {
+		err = b.Delete(pinKey)
+	}
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// blocks returns the blocks kept by a pin of k with mode. Blocks missing
+// from the blockstore are included without their descendants.
+func (r *RefIndex) blocks(ctx context.Context, k cid.Cid, mode pin.Mode) (*cid.Set, error) {
+	set := cid.NewSet()
+	if mode != pin.Recursive {
+		set.Add(k)
+		return set, nil
+	}
+	getLinks := func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+		links, err := ipld.GetLinks(ctx, r.ng, c)
+		if err == ipld.ErrNotFound {
+			return nil, nil
+		}
+		return links, err
+	}
+	if err := dag.Walk(ctx, getLinks, k, set.Visit, dag.Concurrent()); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// count computes the reference counts of the pins of pn.
+func (r *RefIndex) count(ctx context.Context, pn pin.Pinner) (map[cid.Cid]uint64, error) {
+	counts := make(map[cid.Cid]uint64)
+	rkeys, err := pn.RecursiveKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range rkeys {
+		set, err := r.blocks(ctx, k, pin.Recursive)
+		if err != nil {
+			return nil, err
+		}
+		_ = set.ForEach(func(c cid.Cid) error {
+			counts[c]++
+			return nil
+		})
+	}
+	dkeys, err := pn.DirectKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range dkeys {
+		counts[k]++
+	}
+	return counts, nil
+}
+
+// Rebuild counts the references of the pins of pn from scratch and enables
+// the index. It returns the number of blocks counted. The GC lock is held
+// meanwhile, so pins do not change.
+func (r *RefIndex) Rebuild(ctx context.Context, pn pin.Pinner) (int, error) {
+	unlocker := r.bs.GCLock()
+	defer unlocker.Unlock()
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	counts, err := r.count(ctx, pn)
+	if err != nil {
+		return 0, err
+	}
+	if err := r.drop(); err != nil {
+		return 0, err
+	}
+
+	b, err := r.ds.Batch()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	put := func(k dstore.Key, v []byte) error {
+		if err := b.Put(k, v); err != nil {
+			return err
+		}
+		if n++; n == batchSize {
+			if err := b.Commit(); err != nil {
+				return err
+			}
+			if b, err = r.ds.Batch(); err != nil {
+				return err
+			}
+			n = 0
+		}
+		return nil
+	}
+	for c, count := range counts {
+		if err := put(refCountKey(c), encodeCount(count)); err != nil {
+			return 0, err
+		}
+	}
+	for _, mode := range []pin.Mode{pin.Recursive, pin.Direct} {
+		keys, err := pinKeys(ctx, pn, mode)
+		if err != nil {
+			return 0, err
+		}
+		for _, k := range keys {
+			if err := put(refPinKey(k, mode), []byte{}); err != nil {
+				return 0, err
+			}
+		}
+	}
+	// The state goes last, the index is only enabled once complete.
+	if err := b.Put(refIndexStateKey, []byte{}); err != nil {
+		return 0, err
+	}
+	if err := b.Commit(); err != nil {
+		return 0, err
+	}
+	return len(counts), nil
+}
+
+// Drop deletes the index, which stays disabled until rebuilt.
+func (r *RefIndex) Drop() error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.drop()
+}
+
+// drop deletes the index. The state goes first, so that a partially deleted
+// index is never used. The caller must hold lk.
+func (r *RefIndex) drop() error {
+	if err := r.ds.Delete(refIndexStateKey); err != nil && err != dstore.ErrNotFound {
+		return err
+	}
+	return deletePrefix(r.ds, refIndexPrefix)
+}
+
+// checkPins returns ErrRefIndexStale unless the index counts the pins of pn.
+// The caller must hold lk.
+func (r *RefIndex) checkPins(ctx context.Context, pn pin.Pinner) error {
+	for _, mode := range []pin.Mode{pin.Recursive, pin.Direct} {
+		keys, err := pinKeys(ctx, pn, mode)
+		if err != nil {
+			return err
+		}
+		name, _ := pin.ModeToString(mode)
+		res, err := r.ds.Query(query.Query{Prefix: refPinPrefix.ChildString(name).String(), KeysOnly: true})
+		if err != nil {
+			return err
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			return err
+		}
+		if len(entries) != len(keys) {
+			return ErrRefIndexStale
+		}
+		for _, k := range keys {
+			counted, err := r.ds.Has(refPinKey(k, mode))
+			if err != nil {
+				return err
+			}
+			if !counted {
+				return ErrRefIndexStale
+			}
+		}
+	}
+	return nil
+}
+
+// Check compares the stored reference counts with the pins of pn. It
+// returns ErrRefIndexStale, along with the mismatches, when the index counts
+// other pins.
+func (r *RefIndex) Check(ctx context.Context, pn pin.Pinner) ([]RefMismatch, error) {
+	unlocker := r.bs.GCLock()
+	defer unlocker.Unlock()
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	enabled, err := r.Enabled()
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, ErrNoRefIndex
+	}
+	counts, err := r.count(ctx, pn)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := r.ds.Query(query.Query{Prefix: refCountPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	var mismatches []RefMismatch
+	for e := range res.Next() {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		c, err := cid.Decode(dstore.RawKey(e.Key).Name())
+		if err != nil {
+			return nil, err
+		}
+		n, _ := binary.Uvarint(e.Value)
+		if n != counts[c] {
+			mismatches = append(mismatches, RefMismatch{Cid: c, Count: n, Expected: counts[c]})
+		}
+		delete(counts, c)
+	}
+	for c, expected := range counts {
+		mismatches = append(mismatches, RefMismatch{Cid: c, Expected: expected})
+	}
+	return mismatches, r.checkPins(ctx, pn)
+}
+
+func pinKeys(ctx context.Context, pn pin.Pinner, mode pin.Mode) ([]cid.Cid, error) {
+	if mode == pin.Recursive {
+		return pn.RecursiveKeys(ctx)
+	}
+	return pn.DirectKeys(ctx)
+}
+
+// Refcount performs a garbage collection like GC that deletes the blocks no
+// pin counted by idx keeps, instead of marking the blocks of every pin. Only
+// the descendants of bestEffortRoots and of the internal pins are marked.
+func Refcount(ctx context.Context, bs bstore.GCBlockstore, dstor dstore.Datastore, pn pin.Pinner, idx *RefIndex, bestEffortRoots []cid.Cid) <-chan Result {
+	ctx, cancel := context.WithCancel(ctx)
+
+	unlocker := bs.GCLock()
+
+	output := make(chan Result, 128)
+
+	go func() {
+		defer cancel()
+		defer close(output)
+		defer unlocker.Unlock()
+
+		fail := func(err error) {
+			select {
+			case output <- Result{Error: err}:
+			case <-ctx.Done():
+			}
+		}
+
+		idx.lk.Lock()
+		defer idx.lk.Unlock()
+		enabled, err := idx.Enabled()
+		if err == nil && !enabled {
+			err = ErrNoRefIndex
+		}
+		if err == nil {
+			err = idx.checkPins(ctx, pn)
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		keep := cid.NewSet()
+		bestEffortGetLinks := func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+			links, err := ipld.GetLinks(ctx, idx.ng, c)
+			if err == ipld.ErrNotFound {
+				return nil, nil
+			}
+			return links, err
+		}
+		if err := Descendants(ctx, bestEffortGetLinks, keep, bestEffortRoots); err != nil {
+			fail(err)
+			return
+		}
+		ikeys, err := pn.InternalPins(ctx)
+		if err == nil {
+			err = Descendants(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+				return ipld.GetLinks(ctx, idx.ng, c)
+			}, keep, ikeys)
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		keychan, err := bs.AllKeysChan(ctx)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		errors := false
+	loop:
+		for ctx.Err() == nil { // select may not notice that we're "done".
+			select {
+			case k, ok := <-keychan:
+				if !ok {
+					break loop
+				}
+				if keep.Has(k) {
+					continue
+				}
+				var res Result
+				n, err := idx.Count(k)
+				switch {
+				case err != nil:
+					res.Error = err
+				case n > 0:
+					continue
+				default:
+					if err := bs.DeleteBlock(k); err != nil {
+						res.Error = &CannotDeleteBlockError{k, err}
+					} else {
+						res.KeyRemoved = k
+					}
+				}
+				if res.Error != nil {
+					errors = true
+				}
+				select {
+				case output <- res:
+				case <-ctx.Done():
+					break loop
+				}
+			case <-ctx.Done():
+				break loop
+			}
+		}
+		if errors {
+			fail(ErrCannotDeleteSomeBlocks)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		gds, ok := dstor.(dstore.GCDatastore)
+		if !ok {
+			return
+		}
+		if err := gds.CollectGarbage(); err != nil {
+			fail(err)
+		}
+	}()
+
+	return output
+}
+
+type refcountPinner struct {
+	pin.Pinner
+	idx *RefIndex
+}
+
+// NewRefcountPinner wraps pn so that idx counts the pins added to and
+// removed from it.
+func NewRefcountPinner(pn pin.Pinner, idx *RefIndex) pin.Pinner {
+	return &refcountPinner{Pinner: pn, idx: idx}
+}
+
+// sync updates the index after the pins of k changed. An index that can not
+// be updated is dropped, as it no longer matches the pins.
+func (p *refcountPinner) sync(ctx context.Context, keys ...cid.Cid) {
+	for _, k := range keys {
+		if err := p.idx.sync(ctx, p.Pinner, k); err != nil {
+			log.Errorf("dropping refcount index, failed to count pins of %s: %v", k, err)
+			if err := p.idx.Drop(); err != nil {
+				log.Errorf("failed to drop refcount index: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func (p *refcountPinner) Pin(ctx context.Context, node ipld.Node, recursive bool) error {
+	if err := p.Pinner.Pin(ctx, node, recursive); err != nil {
+		return err
+	}
+	p.sync(ctx, node.Cid())
+	return nil
+}
+
+func (p *refcountPinner) Unpin(ctx context.Context, c cid.Cid, recursive bool) error {
+	if err := p.Pinner.Unpin(ctx, c, recursive); err != nil {
+		return err
+	}
+	p.sync(ctx, c)
+	return nil
+}
+
+func (p *refcountPinner) Update(ctx context.Context, from, to cid.Cid, unpin bool) error {
+	if err := p.Pinner.Update(ctx, from, to, unpin); err != nil {
+		return err
+	}
+	p.sync(ctx, from, to)
+	return nil
+}
+
+func (p *refcountPinner) PinWithMode(c cid.Cid, mode pin.Mode) {
+	p.Pinner.PinWithMode(c, mode)
+	p.sync(context.Background(), c)
+}
+
+func (p *refcountPinner) RemovePinWithMode(c cid.Cid, mode pin.Mode) {
+	p.Pinner.RemovePinWithMode(c, mode)
+	p.sync(context.Background(), c)
+}
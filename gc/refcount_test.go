@@ -0,0 +1,101 @@
+package gc
+
+import (
+	"context"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	dstore "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	pin "github.com/ipfs/go-ipfs-pinner"
+)
+
+func (r *testRepo) collectRefcount(t *testing.T) int {
+	removed := 0
+	for res := range Refcount(context.Background(), r.bs, r.ds, r.pinner, r.refs, nil) {
+		if res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		removed++
+	}
+	return removed
+}
+
+func TestRefIndex(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t, dssync.MutexWrap(dstore.NewMapDatastore()))
+
+	for res := range Refcount(ctx, r.bs, r.ds, r.pinner, r.refs, nil) {
+		if res.Error != ErrNoRefIndex {
+			t.Errorf("collected without an index: %v", res.Error)
+		}
+	}
+
+	shared, sharedLeaf := r.tree(t, "shared")
+	if err := r.pinner.Pin(ctx, shared, true); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.refs.Rebuild(ctx, r.pinner); err != nil || n != 2 {
+		t.Fatalf("rebuild counted %d blocks: %v", n, err)
+	}
+
+	// Pins added once the index is built are counted.
+	if err := r.pinner.Pin(ctx, sharedLeaf, false); err != nil {
+		t.Fatal(err)
+	}
+	other, otherLeaf := r.tree(t, "other")
+	if err := r.pinner.Pin(ctx, other, true); err != nil {
+		t.Fatal(err)
+	}
+	for c, expected := range map[cid.Cid]uint64{
+		shared.Cid():     1,
+		sharedLeaf.Cid(): 2,
+		other.Cid():      1,
+	} {
+		if n, err := r.refs.Count(c); err != nil || n != expected {
+			t.Errorf("count of %s is %d, expected %d: %v", c, n, expected, err)
+		}
+	}
+
+	// Unpinned blocks are collected, shared ones are kept.
+	if err := r.pinner.Unpin(ctx, shared.Cid(), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.pinner.Unpin(ctx, other.Cid(), true); err != nil {
+		t.Fatal(err)
+	}
+	if removed := r.collectRefcount(t); removed != 3 {
+		t.Errorf("removed %d blocks, expected 3", removed)
+	}
+	if !r.has(t, sharedLeaf) || r.has(t, shared) || r.has(t, other) || r.has(t, otherLeaf) {
+		t.Error("unexpected blocks removed")
+	}
+	if mismatches, err := r.refs.Check(ctx, r.pinner); err != nil || len(mismatches) != 0 {
+		t.Errorf("inconsistent index: %v %v", mismatches, err)
+	}
+}
+
+func TestRefIndexStale(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t, dssync.MutexWrap(dstore.NewMapDatastore()))
+	if _, err := r.refs.Rebuild(ctx, r.pinner); err != nil {
+		t.Fatal(err)
+	}
+
+	// A pin added without the index.
+	nd, _ := r.tree(t, "bypassed")
+	r.inner.PinWithMode(nd.Cid(), pin.Recursive)
+
+	for res := range Refcount(ctx, r.bs, r.ds, r.pinner, r.refs, nil) {
+		if res.Error != ErrRefIndexStale {
+			t.Errorf("collected with a stale index: %v", res.Error)
+		}
+	}
+	mismatches, err := r.refs.Check(ctx, r.pinner)
+	if err != ErrRefIndexStale || len(mismatches) != 2 {
+		t.Errorf("unexpected check result: %v %v", mismatches, err)
+	}
+	if !r.has(t, nd) {
+		t.Error("block pinned without the index was removed")
+	}
+}
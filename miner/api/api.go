@@ -0,0 +1,133 @@
+// Package api defines the handle through which the node and its commands
+// operate a running storage miner.
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Miner roles.
+const (
+	RoleMainMiner = 0
+	RoleEdgeMiner = 1
+)
+
+var ErrInvalidRole = errors.New("miner role must be 0 (main miner) or 1 (edge miner)")
+
+// ValidRole reports whether role is a known miner role.
+func ValidRole(role int) bool {
+	return role == RoleMainMiner || role == RoleEdgeMiner
+}
+
+// Miner is a running storage miner.
+type Miner interface {
+	// Status returns a summary of the miner state.
+	Status() (Status, error)
+	// Jobs lists the FetchFile jobs known to the miner.
+	Jobs() ([]Job, error)
+	// CancelJob stops a queued or running FetchFile job.
+	CancelJob(ctx context.Context, id string) error
+	// Proofs lists the most recently answered WindowPost challenges.
+	Proofs() []Proof
+	// Heartbeat publishes a heartbeat immediately.
+	Heartbeat(ctx context.Context) error
+	// SetRole changes the role announced by the miner.
+	SetRole(role int) error
+}
+
+// Status is a summary of the miner state.
+type Status struct {
+	Role          int
+	WalletAddress string
+	// Jobs counts FetchFile jobs by state.
+	Jobs          map[string]int
+	LastHeartbeat time.Time
+}
+
+// Job is a FetchFile job.
+type Job struct {
+	ID           string
+	Cid          string
+	Requester    string
+	State        string
+	Attempts     int
+	BytesFetched uint64
+	Error        string `json:",omitempty"`
+	Created      time.Time
+	Updated      time.Time
+}
+
+// Proof records an answered WindowPost challenge.
+type Proof struct {
+	Type      string
+	Requester string
+	Nonce     string
+	// Files is the number of challenged files, Failed the number of files
+	// the miner could not answer for.
+	Files  int
+	Failed int
+	Time   time.Time
+}
+
+// Inspector is a running inspector. It assigns files to miners, tracks their
+// heartbeats and challenges them to prove they still store the files.
+type Inspector interface {
+	// Miners lists the miners seen by the inspector.
+	Miners() ([]MinerInfo, error)
+	// Assignments lists the files assigned to miner, or to all miners
+	// when miner is empty.
+	Assignments(miner peer.ID) ([]Assignment, error)
+	// Assign asks miner to fetch and pin the file c.
+	Assign(ctx context.Context, miner peer.ID, c cid.Cid) (Assignment, error)
+	// Challenge challenges miner immediately.
+	Challenge(ctx context.Context, miner peer.ID) (ChallengeResult, error)
+}
+
+// MinerInfo is what the inspector knows about a miner.
+type MinerInfo struct {
+	Peer          string
+	Role          int
+	Version       string
+	WalletAddress string
+	Addrs         []string
+	FreeSpace     uint64
+	LastSeq       uint64
+	LastHeartbeat time.Time
+	// MissedHeartbeats counts gaps in the heartbeat sequence.
+	MissedHeartbeats uint64
+	// Challenges counts challenged files, Failures the files the miner
+	// failed to prove.
+	Challenges uint64
+	Failures   uint64
+	// Score is the reliability of the miner, between 0 and 1.
+	Score float64
+	// Offline is set when the miner announced going offline for
+	// maintenance. It is not challenged until it is back.
+	Offline bool
+}
+
+// Assignment is a file assigned to a miner.
+type Assignment struct {
+	Miner string
+	Cid   string
+	Size  int64
+	// Local is set when the inspector holds its own copy of the file.
+	Local         bool
+	State         string
+	Assigned      time.Time
+	LastChallenge time.Time `json:",omitempty"`
+	Failures      int
+}
+
+// ChallengeResult is the outcome of challenging a miner.
+type ChallengeResult struct {
+	Miner  string
+	Files  int
+	Failed int
+	Score  float64
+}
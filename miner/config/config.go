@@ -0,0 +1,290 @@
+// Package config defines the Miner section of the repo config.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	minerapi "github.com/ipfs/go-ipfs/miner/api"
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/ipfs/go-ipfs/repo/common"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Key is the key of the Miner section in the repo config.
+const Key = "Miner"
+
+const (
+	DefaultHeartbeatInterval = 10 * time.Minute
+	DefaultTopicPrefix       = "v1"
+	DefaultFetchWorkers      = 4
+	DefaultPrefetchBatch     = 32
+
+	DefaultChallengeInterval  = time.Hour
+	DefaultChallengeFiles     = 4
+	DefaultChallengePositions = 8
+)
+
+// Miner configures the storage miner. Zero values select the defaults.
+type Miner struct {
+	// Enabled starts the miner with the daemon.
+	Enabled bool
+	// Role is 0 for a main miner and 1 for an edge miner.
+	Role int
+	// HeartbeatInterval is how often heartbeats are published.
+	HeartbeatInterval string
+	// TopicPrefix prefixes the pubsub topics of the miner protocol.
+	TopicPrefix string
+	// WalletAddress is announced in heartbeats.
+	WalletAddress string
+	// FetchWorkers bounds the number of FetchFile jobs running at once.
+	FetchWorkers int
+	// PrefetchBatch is the number of blocks requested at once while
+	// fetching a DAG.
+	PrefetchBatch int
+	// ExportDir receives the files whose FetchFile request asks for
+	// export. Export is disabled when empty.
+	ExportDir string
+	// Limits bounds the requests served to other peers.
+	Limits Limits
+	// Inspector configures the built-in inspector.
+	Inspector Inspector
+}
+
+// Limits bounds what other peers may ask of the miner. Zero values disable a
+// limit.
+type Limits struct {
+	// RequestRate is the number of requests per second accepted from a
+	// single peer.
+	RequestRate float64
+	// RequestBurst is the number of requests a peer may send at once. It
+	// defaults to one second worth of RequestRate.
+	RequestBurst int
+	// MaxFileSize is the size of the largest file a FetchFile may store,
+	// such as "10GB".
+	MaxFileSize string
+	// RequesterQuota is the total size of the files a single requester
+	// may have stored, such as "1TB".
+	RequesterQuota string
+	// Inspectors lists the peers allowed to send requests. Every peer is
+	// allowed when empty.
+	Inspectors []string
+}
+
+// Inspector configures the built-in inspector, which assigns files to miners
+// and challenges them. It is read when the daemon starts.
+type Inspector struct {
+	// Enabled starts the inspector with the daemon. A node can not mine
+	// and inspect at the same time.
+	Enabled bool
+	// ChallengeInterval is how often every miner is challenged.
+	ChallengeInterval string
+	// ChallengeFiles is the number of assigned files challenged at once.
+	ChallengeFiles int
+	// ChallengePositions is the number of positions challenged per file.
+	ChallengePositions int
+}
+
+// Load reads the Miner section from the config of r. A missing section
+// yields the zero config.
+func Load(r repo.Repo) (Miner, error) {
+	var cfg Miner
+	v, err := r.GetConfigKey(Key)
+	if errors.Is(err, common.ErrKeyNotFound) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse %s config: %w", Key, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the config for invalid values.
+func (c Miner) Validate() error {
+	if !minerapi.ValidRole(c.Role) {
+		return minerapi.ErrInvalidRole
+	}
+	if c.HeartbeatInterval != "" {
+		d, err := time.ParseDuration(c.HeartbeatInterval)
+		if err != nil {
+			return fmt.Errorf("invalid %s.HeartbeatInterval: %w", Key, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("%s.HeartbeatInterval must be positive", Key)
+		}
+	}
+	if strings.Contains(c.TopicPrefix, "/") {
+		return fmt.Errorf("%s.TopicPrefix must not contain '/'", Key)
+	}
+	if c.FetchWorkers < 0 {
+		return fmt.Errorf("%s.FetchWorkers must not be negative", Key)
+	}
+	if c.PrefetchBatch < 0 {
+		return fmt.Errorf("%s.PrefetchBatch must not be negative", Key)
+	}
+	if c.Enabled && c.Inspector.Enabled {
+		return fmt.Errorf("%s.Enabled and %s.Inspector.Enabled are mutually exclusive", Key, Key)
+	}
+	if err := c.Limits.Validate(); err != nil {
+		return err
+	}
+	return c.Inspector.Validate()
+}
+
+// Validate checks the limits for invalid values.
+func (c Limits) Validate() error {
+	if c.RequestRate < 0 {
+		return fmt.Errorf("%s.Limits.RequestRate must not be negative", Key)
+	}
+	if c.RequestBurst < 0 {
+		return fmt.Errorf("%s.Limits.RequestBurst must not be negative", Key)
+	}
+	if c.MaxFileSize != "" {
+		if _, err := humanize.ParseBytes(c.MaxFileSize); err != nil {
+			return fmt.Errorf("invalid %s.Limits.MaxFileSize: %w", Key, err)
+		}
+	}
+	if c.RequesterQuota != "" {
+		if _, err := humanize.ParseBytes(c.RequesterQuota); err != nil {
+			return fmt.Errorf("invalid %s.Limits.RequesterQuota: %w", Key, err)
+		}
+	}
+	for _, p := range c.Inspectors {
+		if _, err := peer.Decode(p); err != nil {
+			return fmt.Errorf("invalid peer %q in %s.Limits.Inspectors: %w", p, Key, err)
+		}
+	}
+	return nil
+}
+
+// Burst returns the number of requests a peer may send at once.
+func (c Limits) Burst() int {
+	if c.RequestBurst == 0 {
+		return int(math.Ceil(c.RequestRate))
+	}
+	return c.RequestBurst
+}
+
+// FileSize returns the size of the largest file a FetchFile may store, zero
+// for no limit. The config must be valid.
+func (c Limits) FileSize() uint64 {
+	n, _ := humanize.ParseBytes(c.MaxFileSize)
+	return n
+}
+
+// Quota returns the storage quota of a requester, zero for no limit. The
+// config must be valid.
+func (c Limits) Quota() uint64 {
+	n, _ := humanize.ParseBytes(c.RequesterQuota)
+	return n
+}
+
+// InspectorPeers returns the peers allowed to send requests, nil when every
+// peer is allowed. The config must be valid.
+func (c Limits) InspectorPeers() []peer.ID {
+	var out []peer.ID
+	for _, s := range c.Inspectors {
+		if p, err := peer.Decode(s); err == nil {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Validate checks the inspector config for invalid values.
+func (c Inspector) Validate() error {
+	if c.ChallengeInterval != "" {
+		d, err := time.ParseDuration(c.ChallengeInterval)
+		if err != nil {
+			return fmt.Errorf("invalid %s.Inspector.ChallengeInterval: %w", Key, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("%s.Inspector.ChallengeInterval must be positive", Key)
+		}
+	}
+	if c.ChallengeFiles < 0 {
+		return fmt.Errorf("%s.Inspector.ChallengeFiles must not be negative", Key)
+	}
+	if c.ChallengePositions < 0 {
+		return fmt.Errorf("%s.Inspector.ChallengePositions must not be negative", Key)
+	}
+	return nil
+}
+
+// Interval returns the challenge interval. The config must be valid.
+func (c Inspector) Interval() time.Duration {
+	d, err := time.ParseDuration(c.ChallengeInterval)
+	if err != nil || d <= 0 {
+		return DefaultChallengeInterval
+	}
+	return d
+}
+
+// Files returns the number of files challenged at once.
+func (c Inspector) Files() int {
+	if c.ChallengeFiles == 0 {
+		return DefaultChallengeFiles
+	}
+	return c.ChallengeFiles
+}
+
+// Positions returns the number of positions challenged per file.
+func (c Inspector) Positions() int {
+	if c.ChallengePositions == 0 {
+		return DefaultChallengePositions
+	}
+	return c.ChallengePositions
+}
+
+// Heartbeat returns the heartbeat interval. The config must be valid.
+func (c Miner) Heartbeat() time.Duration {
+	d, err := time.ParseDuration(c.HeartbeatInterval)
+	if err != nil || d <= 0 {
+		return DefaultHeartbeatInterval
+	}
+	return d
+}
+
+// Topics returns the topic prefix.
+func (c Miner) Topics() string {
+	if c.TopicPrefix == "" {
+		return DefaultTopicPrefix
+	}
+	return c.TopicPrefix
+}
+
+// Workers returns the number of fetch workers.
+func (c Miner) Workers() int {
+	if c.FetchWorkers == 0 {
+		return DefaultFetchWorkers
+	}
+	return c.FetchWorkers
+}
+
+// Batch returns the prefetch batch size.
+func (c Miner) Batch() int {
+	if c.PrefetchBatch == 0 {
+		return DefaultPrefetchBatch
+	}
+	return c.PrefetchBatch
+}
+
+// NeedsRestart reports whether moving from c to updated changes fields that
+// only take effect when the miner is restarted.
+func (c Miner) NeedsRestart(updated Miner) bool {
+	return c.Enabled != updated.Enabled ||
+		c.Topics() != updated.Topics() ||
+		c.Workers() != updated.Workers()
+}
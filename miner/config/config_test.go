@@ -0,0 +1,84 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	var cfg Miner
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("zero config should be valid: %v", err)
+	}
+	if cfg.Heartbeat() != DefaultHeartbeatInterval || cfg.Topics() != DefaultTopicPrefix ||
+		cfg.Workers() != DefaultFetchWorkers || cfg.Batch() != DefaultPrefetchBatch {
+		t.Errorf("zero config should select the defaults")
+	}
+
+	cfg.HeartbeatInterval = "90s"
+	if cfg.Heartbeat() != 90*time.Second {
+		t.Errorf("unexpected heartbeat interval: %v", cfg.Heartbeat())
+	}
+	if cfg.Inspector.Interval() != DefaultChallengeInterval || cfg.Inspector.Files() != DefaultChallengeFiles ||
+		cfg.Inspector.Positions() != DefaultChallengePositions {
+		t.Errorf("zero inspector config should select the defaults")
+	}
+
+	for _, bad := range []Miner{
+		{Role: 2},
+		{HeartbeatInterval: "soon"},
+		{HeartbeatInterval: "-1m"},
+		{TopicPrefix: "v1/x"},
+		{FetchWorkers: -1},
+		{PrefetchBatch: -1},
+		{Enabled: true, Inspector: Inspector{Enabled: true}},
+		{Inspector: Inspector{ChallengeInterval: "0s"}},
+		{Inspector: Inspector{ChallengePositions: -1}},
+		{Limits: Limits{RequestRate: -1}},
+		{Limits: Limits{MaxFileSize: "big"}},
+		{Limits: Limits{RequesterQuota: "-1GB"}},
+		{Limits: Limits{Inspectors: []string{"not a peer"}}},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", bad)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	var l Limits
+	if l.FileSize() != 0 || l.Quota() != 0 || l.Burst() != 0 || l.InspectorPeers() != nil {
+		t.Error("zero limits should disable every limit")
+	}
+	l = Limits{
+		RequestRate:    0.5,
+		MaxFileSize:    "10MB",
+		RequesterQuota: "1GiB",
+		Inspectors:     []string{"QmSnuWmxptJZdLJpKRarxBMS2Ju2oANVrgbr2xWbie9b2D"},
+	}
+	if err := (Miner{Limits: l}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if l.FileSize() != 10*1000*1000 || l.Quota() != 1<<30 {
+		t.Errorf("unexpected sizes: %d %d", l.FileSize(), l.Quota())
+	}
+	if l.Burst() != 1 {
+		t.Errorf("unexpected burst: %d", l.Burst())
+	}
+	if peers := l.InspectorPeers(); len(peers) != 1 || peers[0].String() != l.Inspectors[0] {
+		t.Errorf("unexpected inspectors: %v", peers)
+	}
+}
+
+func TestNeedsRestart(t *testing.T) {
+	cfg := Miner{Enabled: true}
+	if cfg.NeedsRestart(Miner{Enabled: true, HeartbeatInterval: "1m", WalletAddress: "w"}) {
+		t.Error("hot fields should not need a restart")
+	}
+	if !cfg.NeedsRestart(Miner{Enabled: true, TopicPrefix: "v2"}) {
+		t.Error("topic prefix change should need a restart")
+	}
+	if cfg.NeedsRestart(Miner{Enabled: true, FetchWorkers: DefaultFetchWorkers}) {
+		t.Error("explicit default should not need a restart")
+	}
+}
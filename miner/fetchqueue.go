@@ -0,0 +1,435 @@
+package miner
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	minerconfig "github.com/ipfs/go-ipfs/miner/config"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Fetch job states.
+const (
+	JobQueued   = "queued"
+	JobFetching = "fetching"
+	JobPinned   = "pinned"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+const (
+	maxFetchAttempts = 5
+	retryBackoff     = 30 * time.Second
+	maxRetryBackoff  = 30 * time.Minute
+	// progressInterval throttles progress reports and persistence.
+	progressInterval = 5 * time.Second
+	// jobRetention is how long finished jobs are kept in the datastore.
+	jobRetention = 7 * 24 * time.Hour
+	// reportTimeout bounds the final report of a job, which outlives the
+	// worker that ran it.
+	reportTimeout = time.Minute
+)
+
+var jobsPrefix = datastore.NewKey("/miner/jobs")
+
+var (
+	ErrJobNotFound = errors.New("fetch job not found")
+	ErrJobFinished = errors.New("fetch job already finished")
+	// ErrPermanent marks fetch errors that retrying can not fix. Jobs
+	// failing with it are not retried.
+	ErrPermanent = errors.New("permanent fetch error")
+)
+
+// FetchJob is a persisted FetchFile request.
+type FetchJob struct {
+	ID        string
+	Cid       cid.Cid
+	Requester peer.ID
+	Nonce     string
+	// Version is the wire version of the request, used for every message
+	// sent back to the requester.
+	Version int
+	// Export asks for a copy of the file in the export directory.
+	Export bool
+	// Deadline is when the stored file expires. Zero means never.
+	Deadline time.Time
+	// ExpectedSize and ExpectedBlocks describe the content the requester
+	// expects. Zero values are not checked.
+	ExpectedSize   uint64 `json:",omitempty"`
+	ExpectedBlocks uint64 `json:",omitempty"`
+	// Trace carries the context of the span of the request that queued
+	// the job, so that the spans of its attempts follow from it.
+	Trace map[string]string `json:",omitempty"`
+
+	State        string
+	Attempts     int
+	BytesFetched uint64
+	Error        string `json:",omitempty"`
+	// Status is the FetchFileResp status reported for a failed job, zero
+	// for a generic fetch error.
+	Status  int `json:",omitempty"`
+	Created time.Time
+	Updated time.Time
+}
+
+func (j *FetchJob) finished() bool {
+	return j.State == JobPinned || j.State == JobFailed || j.State == JobCanceled
+}
+
+// FetchFunc fetches and pins the content of job, calling progress with the
+// number of bytes fetched so far.
+type FetchFunc func(ctx context.Context, job *FetchJob, progress func(bytes uint64)) error
+
+// ReportFunc is called with a snapshot of job whenever its progress or state
+// changes.
+type ReportFunc func(ctx context.Context, job FetchJob)
+
+// FetchQueue runs FetchFile jobs with bounded concurrency. Jobs are persisted
+// so that unfinished ones resume after a restart.
+type FetchQueue struct {
+	ds      datastore.Datastore
+	fetch   FetchFunc
+	report  ReportFunc
+	workers int
+
+	lk      sync.Mutex
+	pending []string
+	running map[string]context.CancelFunc
+	wake    chan struct{}
+
+	cancel   context.CancelFunc
+	workerWg sync.WaitGroup
+}
+
+func NewFetchQueue(ds datastore.Datastore, workers int, fetch FetchFunc, report ReportFunc) *FetchQueue {
+	if workers <= 0 {
+		workers = minerconfig.DefaultFetchWorkers
+	}
+	return &FetchQueue{
+		ds:      namespace.Wrap(ds, jobsPrefix),
+		fetch:   fetch,
+		report:  report,
+		workers: workers,
+		running: make(map[string]context.CancelFunc),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Start requeues unfinished jobs, prunes old finished ones and starts the
+// workers. Workers stop when ctx is done.
+func (q *FetchQueue) Start(ctx context.Context) error {
+	jobs, err := q.List()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.finished() {
+			if time.Since(job.Updated) > jobRetention {
+				if err := q.ds.Delete(datastore.NewKey(job.ID)); err != nil {
+					log.Warnf("failed to prune job %s: %v", job.ID, err)
+				}
+			}
+			continue
+		}
+		job.State = JobQueued
+		if err := q.put(job); err != nil {
+			return err
+		}
+		log.Infof("resuming fetch job %s for %s", job.ID, job.Cid)
+		q.push(job.ID)
+	}
+
+	ctx, q.cancel = context.WithCancel(ctx)
+	q.workerWg.Add(q.workers)
+	for i := 0; i < q.workers; i++ {
+		go func() {
+			defer q.workerWg.Done()
+			q.worker(ctx)
+		}()
+	}
+	return nil
+}
+
+// Close stops the workers and waits until running jobs are persisted, or
+// until ctx is done. Interrupted jobs resume on the next start.
+func (q *FetchQueue) Close(ctx context.Context) error {
+	if q.cancel == nil {
+		return nil
+	}
+	q.cancel()
+	done := make(chan struct{})
+	go func() {
+		q.workerWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Enqueue persists job as a new queued job and schedules it. The request
+// fields of job must be set.
+func (q *FetchQueue) Enqueue(job *FetchJob) (*FetchJob, error) {
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	job.ID = id
+	job.State = JobQueued
+	job.Created = time.Now()
+	if err := q.put(job); err != nil {
+		return nil, err
+	}
+	q.push(id)
+	return job, nil
+}
+
+// Cancel stops the job with the given id. A running fetch is interrupted.
+func (q *FetchQueue) Cancel(ctx context.Context, id string) error {
+	q.lk.Lock()
+	job, err := q.Get(id)
+	if err != nil {
+		q.lk.Unlock()
+		return err
+	}
+	if job.finished() {
+		q.lk.Unlock()
+		return ErrJobFinished
+	}
+	job.State = JobCanceled
+	if err := q.put(job); err != nil {
+		q.lk.Unlock()
+		return err
+	}
+	cancel, running := q.running[id]
+	if running {
+		cancel()
+	}
+	q.lk.Unlock()
+
+	// A running job reports itself once its fetch returns.
+	if !running {
+		q.report(ctx, *job)
+	}
+	return nil
+}
+
+// Get returns the job with the given id.
+func (q *FetchQueue) Get(id string) (*FetchJob, error) {
+	data, err := q.ds.Get(datastore.NewKey(id))
+	if err == datastore.ErrNotFound {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	job := new(FetchJob)
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// List returns all persisted jobs.
+func (q *FetchQueue) List() ([]*FetchJob, error) {
+	res, err := q.ds.Query(query.Query{})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var jobs []*FetchJob
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		job := new(FetchJob)
+		if err := json.Unmarshal(r.Value, job); err != nil {
+			log.Warnf("skipping corrupt job %s: %v", r.Key, err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (q *FetchQueue) put(job *FetchJob) error {
+	job.Updated = time.Now()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return q.ds.Put(datastore.NewKey(job.ID), data)
+}
+
+func (q *FetchQueue) push(id string) {
+	q.lk.Lock()
+	q.pending = append(q.pending, id)
+	q.lk.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *FetchQueue) pop() (string, bool) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	if len(q.pending) == 0 {
+		return "", false
+	}
+	id := q.pending[0]
+	q.pending = q.pending[1:]
+	return id, true
+}
+
+func (q *FetchQueue) worker(ctx context.Context) {
+	for {
+		id, ok := q.pop()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.wake:
+				continue
+			}
+		}
+		// Let the next idle worker pick up remaining jobs.
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+		q.run(ctx, id)
+	}
+}
+
+func (q *FetchQueue) run(ctx context.Context, id string) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	q.lk.Lock()
+	job, err := q.Get(id)
+	if err != nil {
+		q.lk.Unlock()
+		log.Errorf("failed to load fetch job %s: %v", id, err)
+		return
+	}
+	if job.State != JobQueued {
+		q.lk.Unlock()
+		return
+	}
+	job.State = JobFetching
+	job.Attempts++
+	if err := q.put(job); err != nil {
+		log.Errorf("failed to update fetch job %s: %v", id, err)
+	}
+	q.running[id] = cancel
+	q.lk.Unlock()
+
+	var last time.Time
+	progress := func(bytes uint64) {
+		job.BytesFetched = bytes
+		if time.Since(last) < progressInterval {
+			return
+		}
+		last = time.Now()
+		q.lk.Lock()
+		if jobCtx.Err() == nil {
+			if err := q.put(job); err != nil {
+				log.Warnf("failed to update fetch job %s: %v", id, err)
+			}
+		}
+		q.lk.Unlock()
+		q.report(ctx, *job)
+	}
+
+	err = q.safeFetch(jobCtx, job, progress)
+
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	delete(q.running, id)
+	if ctx.Err() != nil && err != nil {
+		// Shutting down, the job resumes on the next start. The
+		// interrupted attempt does not count.
+		if cur, err := q.Get(id); err == nil && cur.State == JobFetching {
+			job.State = JobQueued
+			job.Attempts--
+			if err := q.put(job); err != nil {
+				log.Errorf("failed to persist fetch job %s: %v", id, err)
+			}
+		}
+		return
+	}
+	if err != nil && ctx.Err() == nil && jobCtx.Err() != nil {
+		job.State = JobCanceled
+		go q.finalReport(*job)
+		return
+	}
+	switch {
+	case err == nil:
+		job.State = JobPinned
+		job.Error = ""
+	case job.Attempts < maxFetchAttempts && !errors.Is(err, ErrPermanent):
+		job.State = JobQueued
+		job.Error = err.Error()
+		backoff := retryBackoff << (job.Attempts - 1)
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+		log.Warnf("fetch job %s failed (attempt %d), retrying in %v: %v", id, job.Attempts, backoff, err)
+		time.AfterFunc(backoff, func() { q.push(id) })
+	default:
+		job.State = JobFailed
+		job.Error = err.Error()
+		log.Errorf("fetch job %s failed: %v", id, err)
+	}
+	if err := q.put(job); err != nil {
+		log.Errorf("failed to update fetch job %s: %v", id, err)
+	}
+	if job.finished() {
+		go q.finalReport(*job)
+	}
+}
+
+// safeFetch runs the fetch function of q, failing the job permanently if it
+// panics.
+func (q *FetchQueue) safeFetch(ctx context.Context, job *FetchJob, progress func(bytes uint64)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("fetch job %s panicked: %v\n%s", job.ID, r, debug.Stack())
+			err = fmt.Errorf("%w: fetch panicked: %v", ErrPermanent, r)
+		}
+	}()
+	return q.fetch(ctx, job, progress)
+}
+
+// finalReport reports the final state of job. It does not use the worker
+// context, which is done while the queue shuts down.
+func (q *FetchQueue) finalReport(job FetchJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+	q.report(ctx, job)
+}
+
+// randomID returns a random hex identifier for jobs and message nonces.
+func randomID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
@@ -0,0 +1,204 @@
+package miner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestFetchQueueResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	c, _ := cid.Decode("bafybeickencdqw37dpz3ha36ewrh4undfjt2do52chtcky4rxkj447qhdm")
+
+	// A queue that never runs its workers leaves the job queued.
+	q := NewFetchQueue(ds, 1, nil, nil)
+	requester, err := peer.Decode("QmSnuWmxptJZdLJpKRarxBMS2Ju2oANVrgbr2xWbie9b2D")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := q.Enqueue(&FetchJob{Cid: c, Requester: requester, Nonce: "nonce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports := make(chan FetchJob, 1)
+	q = NewFetchQueue(ds, 1, func(ctx context.Context, job *FetchJob, progress func(uint64)) error {
+		progress(42)
+		return nil
+	}, func(ctx context.Context, job FetchJob) {
+		if job.finished() {
+			reports <- job
+		}
+	})
+	if err := q.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case done := <-reports:
+		if done.ID != job.ID || done.State != JobPinned || done.BytesFetched != 42 {
+			t.Errorf("unexpected job: %+v", done)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job was not resumed")
+	}
+
+	stored, err := q.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.State != JobPinned || stored.Attempts != 1 {
+		t.Errorf("unexpected stored job: %+v", stored)
+	}
+}
+
+func TestFetchQueueCloseRequeues(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	c, _ := cid.Decode("bafybeickencdqw37dpz3ha36ewrh4undfjt2do52chtcky4rxkj447qhdm")
+	requester, err := peer.Decode("QmSnuWmxptJZdLJpKRarxBMS2Ju2oANVrgbr2xWbie9b2D")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	q := NewFetchQueue(ds, 1, func(ctx context.Context, job *FetchJob, progress func(uint64)) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}, func(ctx context.Context, job FetchJob) {})
+	if err := q.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	job, err := q.Enqueue(&FetchJob{Cid: c, Requester: requester, Nonce: "nonce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job was not started")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := q.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.State != JobQueued || stored.Attempts != 0 {
+		t.Errorf("interrupted job not requeued: %+v", stored)
+	}
+}
+
+func TestFetchQueueCancelAfterFetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	c, _ := cid.Decode("bafybeickencdqw37dpz3ha36ewrh4undfjt2do52chtcky4rxkj447qhdm")
+	requester, err := peer.Decode("QmSnuWmxptJZdLJpKRarxBMS2Ju2oANVrgbr2xWbie9b2D")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fetch completes even though the job is canceled and the queue
+	// stops while it runs.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	reports := make(chan FetchJob, 1)
+	q := NewFetchQueue(ds, 1, func(ctx context.Context, job *FetchJob, progress func(uint64)) error {
+		close(started)
+		<-release
+		return nil
+	}, func(ctx context.Context, job FetchJob) {
+		if job.finished() {
+			if ctx.Err() != nil {
+				t.Errorf("report context done: %v", ctx.Err())
+			}
+			reports <- job
+		}
+	})
+	if err := q.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	job, err := q.Enqueue(&FetchJob{Cid: c, Requester: requester, Nonce: "nonce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := q.Cancel(ctx, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	close(release)
+
+	select {
+	case done := <-reports:
+		if done.State != JobPinned {
+			t.Errorf("fetched job reported %s", done.State)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job was not reported")
+	}
+	stored, err := q.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.State != JobPinned {
+		t.Errorf("fetched job stored as %s", stored.State)
+	}
+}
+
+func TestFetchQueuePanicFails(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	c, _ := cid.Decode("bafybeickencdqw37dpz3ha36ewrh4undfjt2do52chtcky4rxkj447qhdm")
+	requester, err := peer.Decode("QmSnuWmxptJZdLJpKRarxBMS2Ju2oANVrgbr2xWbie9b2D")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A panicking fetch fails the job without retrying it.
+	reports := make(chan FetchJob, 1)
+	q := NewFetchQueue(ds, 1, func(ctx context.Context, job *FetchJob, progress func(uint64)) error {
+		panic("boom")
+	}, func(ctx context.Context, job FetchJob) {
+		if job.finished() {
+			reports <- job
+		}
+	})
+	if err := q.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	job, err := q.Enqueue(&FetchJob{Cid: c, Requester: requester, Nonce: "nonce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case done := <-reports:
+		if done.State != JobFailed || done.Attempts != 1 {
+			t.Errorf("unexpected job: %+v", done)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job was not reported")
+	}
+	stored, err := q.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.State != JobFailed || stored.Error == "" {
+		t.Errorf("unexpected stored job: %+v", stored)
+	}
+}
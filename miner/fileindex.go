@@ -0,0 +1,316 @@
+package miner
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var (
+	filesPrefix           = datastore.NewKey("/miner/files")
+	minerPinsPrefix       = datastore.NewKey("/miner/pins")
+	requesterTotalsPrefix = datastore.NewKey("/miner/requesters")
+)
+
+// StoredFile is a file the miner was assigned and has pinned.
+type StoredFile struct {
+	Cid       cid.Cid
+	Requester peer.ID
+	// JobID is the FetchFile job that stored the file.
+	JobID    string
+	Assigned time.Time
+	// Size is the size of the file content.
+	Size uint64
+	// Deadline is when the file expires and is unpinned. Zero means
+	// never.
+	Deadline time.Time
+}
+
+func (f *StoredFile) expired(now time.Time) bool {
+	return !f.Deadline.IsZero() && now.After(f.Deadline)
+}
+
+// fileIndex maps the CIDs of stored files to their assignments, so that
+// challenges are checked without listing pins. A file assigned by several
+// requesters has an assignment for each, and stays pinned until the last one
+// is released. The total size of the files of each requester is kept along,
+// so that quotas are checked without listing files.
+type fileIndex struct {
+	ds datastore.Datastore
+	// minerPins holds the files pinned by fetches. The pins of other
+	// files were added by the operator and outlive their release.
+	minerPins datastore.Datastore
+	totals    datastore.Datastore
+
+	// lk serializes updates of assignments and the totals of their
+	// requesters.
+	lk sync.Mutex
+}
+
+func newFileIndex(ds datastore.Datastore) *fileIndex {
+	return &fileIndex{
+		ds:        namespace.Wrap(ds, filesPrefix),
+		minerPins: namespace.Wrap(ds, minerPinsPrefix),
+		totals:    namespace.Wrap(ds, requesterTotalsPrefix),
+	}
+}
+
+func fileKey(c cid.Cid, requester peer.ID) datastore.Key {
+	return datastore.NewKey(c.String()).ChildString(requester.String())
+}
+
+// Get returns the assignment of c by requester, or datastore.ErrNotFound.
+func (idx *fileIndex) Get(c cid.Cid, requester peer.ID) (*StoredFile, error) {
+	data, err := idx.ds.Get(fileKey(c, requester))
+	if err != nil {
+		return nil, err
+	}
+	f := new(StoredFile)
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Assignments returns the assignments of c by every requester.
+func (idx *fileIndex) Assignments(c cid.Cid) ([]*StoredFile, error) {
+	return idx.query(query.Query{Prefix: datastore.NewKey(c.String()).String()})
+}
+
+func (idx *fileIndex) Put(f *StoredFile) error {
+	idx.lk.Lock()
+	defer idx.lk.Unlock()
+	var prev uint64
+	old, err := idx.Get(f.Cid, f.Requester)
+	switch err {
+	case nil:
+		prev = old.Size
+	case datastore.ErrNotFound:
+	default:
+		return err
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if err := idx.ds.Put(fileKey(f.Cid, f.Requester), data); err != nil {
+		return err
+	}
+	if f.Size == prev {
+		return nil
+	}
+	total, err := idx.total(f.Requester)
+	if err != nil {
+		return err
+	}
+	return idx.putTotal(f.Requester, total-prev+f.Size)
+}
+
+func (idx *fileIndex) Delete(c cid.Cid, requester peer.ID) error {
+	idx.lk.Lock()
+	defer idx.lk.Unlock()
+	f, err := idx.Get(c, requester)
+	if err == datastore.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := idx.ds.Delete(fileKey(c, requester)); err != nil {
+		return err
+	}
+	total, err := idx.total(requester)
+	if err != nil {
+		return err
+	}
+	if f.Size > total {
+		f.Size = total
+	}
+	return idx.putTotal(requester, total-f.Size)
+}
+
+// MarkMinerPin records that a fetch pinned c.
+func (idx *fileIndex) MarkMinerPin(c cid.Cid) error {
+	return idx.minerPins.Put(datastore.NewKey(c.String()), []byte{})
+}
+
+// MinerPin reports whether a fetch pinned c.
+func (idx *fileIndex) MinerPin(c cid.Cid) (bool, error) {
+	return idx.minerPins.Has(datastore.NewKey(c.String()))
+}
+
+func (idx *fileIndex) ClearMinerPin(c cid.Cid) error {
+	return idx.minerPins.Delete(datastore.NewKey(c.String()))
+}
+
+// List returns the assignments of all stored files.
+func (idx *fileIndex) List() ([]*StoredFile, error) {
+	return idx.query(query.Query{})
+}
+
+func (idx *fileIndex) query(q query.Query) ([]*StoredFile, error) {
+	res, err := idx.ds.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var out []*StoredFile
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		f := new(StoredFile)
+		if err := json.Unmarshal(r.Value, f); err != nil {
+			log.Warnf("skipping corrupt file record %s: %v", r.Key, err)
+			continue
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// RequesterSize returns the total size of the files stored for requester,
+// leaving out the file except.
+func (idx *fileIndex) RequesterSize(requester peer.ID, except cid.Cid) (uint64, error) {
+	idx.lk.Lock()
+	defer idx.lk.Unlock()
+	total, err := idx.total(requester)
+	if err != nil {
+		return 0, err
+	}
+	f, err := idx.Get(except, requester)
+	switch {
+	case err == datastore.ErrNotFound:
+	case err != nil:
+		return 0, err
+	case f.Size > total:
+		total = 0
+	default:
+		total -= f.Size
+	}
+	return total, nil
+}
+
+func (idx *fileIndex) total(requester peer.ID) (uint64, error) {
+	data, err := idx.totals.Get(datastore.NewKey(requester.String()))
+	if err == datastore.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil || len(data) != 8 {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+func (idx *fileIndex) putTotal(requester peer.ID, total uint64) error {
+	k := datastore.NewKey(requester.String())
+	if total == 0 {
+		return idx.totals.Delete(k)
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], total)
+	return idx.totals.Put(k, buf[:])
+}
+
+// migrate moves the records keyed by CID alone, written before files could
+// have several requesters, under the key of their requester. Their files
+// were pinned by the fetch that stored them. The totals of requesters are
+// recomputed, they may be off after a crash between updating a file and its
+// requester.
+func (idx *fileIndex) migrate() error {
+	res, err := idx.ds.Query(query.Query{})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		k := datastore.RawKey(e.Key)
+		if len(k.Namespaces()) != 1 {
+			continue
+		}
+		f := new(StoredFile)
+		if err := json.Unmarshal(e.Value, f); err != nil {
+			log.Warnf("skipping corrupt file record %s: %v", e.Key, err)
+			continue
+		}
+		if err := idx.ds.Put(fileKey(f.Cid, f.Requester), e.Value); err != nil {
+			return err
+		}
+		if err := idx.MarkMinerPin(f.Cid); err != nil {
+			return err
+		}
+		if err := idx.ds.Delete(k); err != nil {
+			return err
+		}
+	}
+	return idx.rebuildTotals()
+}
+
+func (idx *fileIndex) rebuildTotals() error {
+	idx.lk.Lock()
+	defer idx.lk.Unlock()
+	all, err := idx.List()
+	if err != nil {
+		return err
+	}
+	totals := make(map[peer.ID]uint64)
+	for _, f := range all {
+		totals[f.Requester] += f.Size
+	}
+
+	res, err := idx.totals.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := idx.totals.Delete(datastore.RawKey(e.Key)); err != nil {
+			return err
+		}
+	}
+	for p, total := range totals {
+		if err := idx.putTotal(p, total); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileSize returns the content size of the UnixFS file root, reading only
+// the root block.
+func fileSize(ctx context.Context, ng ipld.NodeGetter, root cid.Cid) (uint64, error) {
+	nd, err := ng.Get(ctx, root)
+	if err != nil {
+		return 0, err
+	}
+	switch n := nd.(type) {
+	case *merkledag.RawNode:
+		return uint64(len(n.RawData())), nil
+	case *merkledag.ProtoNode:
+		fsn, err := unixfs.FSNodeFromBytes(n.Data())
+		if err != nil {
+			return 0, err
+		}
+		return fsn.FileSize(), nil
+	default:
+		return 0, ErrUnsupportedBlock
+	}
+}
@@ -0,0 +1,183 @@
+package miner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	"github.com/ipfs/go-merkledag"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	"github.com/ipfs/go-unixfs/importer"
+	"github.com/libp2p/go-libp2p-core/peer"
+	testutil "github.com/libp2p/go-libp2p-core/test"
+)
+
+func TestFileIndex(t *testing.T) {
+	ctx := context.Background()
+	dserv := mdtest.Mock()
+
+	data := make([]byte, 10000)
+	root, err := importer.BuildDagFromReader(dserv, chunker.NewSizeSplitter(bytes.NewReader(data), 512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := fileSize(ctx, dserv, root.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != uint64(len(data)) {
+		t.Fatalf("got size %d, want %d", size, len(data))
+	}
+
+	requester, err := peer.Decode("QmSnuWmxptJZdLJpKRarxBMS2Ju2oANVrgbr2xWbie9b2D")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := newFileIndex(dssync.MutexWrap(datastore.NewMapDatastore()))
+	if _, err := idx.Get(root.Cid(), requester); err != datastore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	assigned := time.Now().Round(0)
+	if err := idx.Put(&StoredFile{Cid: root.Cid(), Requester: requester, JobID: "job", Assigned: assigned, Size: size}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := idx.Get(root.Cid(), requester)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Cid != root.Cid() || f.JobID != "job" || f.Size != size || !f.Assigned.Equal(assigned) {
+		t.Errorf("unexpected stored file: %+v", f)
+	}
+	all, err := idx.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 {
+		t.Errorf("listed %d files, want 1", len(all))
+	}
+	if err := idx.Delete(root.Cid(), requester); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.Get(root.Cid(), requester); err != datastore.ErrNotFound {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+
+	// Files assigned by several requesters have an assignment each.
+	other, err := peer.Decode("QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []peer.ID{requester, other} {
+		if err := idx.Put(&StoredFile{Cid: root.Cid(), Requester: p, Size: size}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f, err := idx.Get(root.Cid(), other); err != nil || f.Requester != other {
+		t.Fatalf("unexpected assignment %+v, %v", f, err)
+	}
+	if err := idx.Delete(root.Cid(), requester); err != nil {
+		t.Fatal(err)
+	}
+	left, err := idx.Assignments(root.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || left[0].Requester != other {
+		t.Errorf("unexpected assignments: %+v", left)
+	}
+}
+
+func TestFileIndexMigrate(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	requester, err := peer.Decode("QmSnuWmxptJZdLJpKRarxBMS2Ju2oANVrgbr2xWbie9b2D")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd := merkledag.NodeWithData([]byte("file"))
+	data, err := json.Marshal(&StoredFile{Cid: nd.Cid(), Requester: requester, Size: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A record keyed by CID alone.
+	if err := ds.Put(filesPrefix.ChildString(nd.Cid().String()), data); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := newFileIndex(ds)
+	if err := idx.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := idx.Get(nd.Cid(), requester)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Size != 4 {
+		t.Errorf("unexpected stored file: %+v", f)
+	}
+	if owned, err := idx.MinerPin(nd.Cid()); err != nil || !owned {
+		t.Errorf("migrated file should be pinned by the miner: %v", err)
+	}
+	if all, err := idx.List(); err != nil || len(all) != 1 {
+		t.Errorf("expected 1 stored file after migration, got %d, %v", len(all), err)
+	}
+}
+
+func TestRequesterSize(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	idx := newFileIndex(ds)
+	requester, other := testutil.RandPeerIDFatal(t), testutil.RandPeerIDFatal(t)
+	a := merkledag.NodeWithData([]byte("a")).Cid()
+	b := merkledag.NodeWithData([]byte("b")).Cid()
+
+	for _, f := range []*StoredFile{
+		{Cid: a, Requester: requester, Size: 100},
+		{Cid: b, Requester: requester, Size: 20},
+		{Cid: a, Requester: other, Size: 100},
+		// Renewing a file does not count it twice.
+		{Cid: b, Requester: requester, Size: 20},
+	} {
+		if err := idx.Put(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := func(p peer.ID, except cid.Cid) uint64 {
+		t.Helper()
+		n, err := idx.RequesterSize(p, except)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := size(requester, cid.Undef); n != 120 {
+		t.Errorf("got %d bytes, want 120", n)
+	}
+	if n := size(requester, a); n != 20 {
+		t.Errorf("got %d bytes without the excepted file, want 20", n)
+	}
+	if err := idx.Delete(a, requester); err != nil {
+		t.Fatal(err)
+	}
+	if n := size(requester, cid.Undef); n != 20 {
+		t.Errorf("got %d bytes after delete, want 20", n)
+	}
+	if n := size(other, cid.Undef); n != 100 {
+		t.Errorf("got %d bytes for other requester, want 100", n)
+	}
+
+	// Totals are recomputed on start.
+	if err := idx.totals.Put(datastore.NewKey(requester.String()), []byte{0, 0, 0, 0, 0, 0, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := newFileIndex(ds).migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if n := size(requester, cid.Undef); n != 20 {
+		t.Errorf("got %d bytes after rebuild, want 20", n)
+	}
+}
@@ -0,0 +1,81 @@
+package miner
+
+import (
+	"context"
+	"time"
+
+	minerapi "github.com/ipfs/go-ipfs/miner/api"
+)
+
+var _ minerapi.Miner = (*Miner)(nil)
+
+func (m *Miner) Status() (minerapi.Status, error) {
+	jobs, err := m.handler.jobs.List()
+	if err != nil {
+		return minerapi.Status{}, err
+	}
+	counts := make(map[string]int)
+	for _, job := range jobs {
+		counts[job.State]++
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return minerapi.Status{
+		Role:          m.role,
+		WalletAddress: m.walletAddress,
+		Jobs:          counts,
+		LastHeartbeat: m.lastHeartbeat,
+	}, nil
+}
+
+func (m *Miner) Jobs() ([]minerapi.Job, error) {
+	jobs, err := m.handler.jobs.List()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]minerapi.Job, len(jobs))
+	for i, job := range jobs {
+		out[i] = minerapi.Job{
+			ID:           job.ID,
+			Cid:          job.Cid.String(),
+			Requester:    job.Requester.String(),
+			State:        job.State,
+			Attempts:     job.Attempts,
+			BytesFetched: job.BytesFetched,
+			Error:        job.Error,
+			Created:      job.Created,
+			Updated:      job.Updated,
+		}
+	}
+	return out, nil
+}
+
+func (m *Miner) CancelJob(ctx context.Context, id string) error {
+	return m.handler.jobs.Cancel(ctx, id)
+}
+
+func (m *Miner) Proofs() []minerapi.Proof {
+	return m.handler.proofs.List()
+}
+
+func (m *Miner) Heartbeat(ctx context.Context) error {
+	return m.heartbeat(ctx)
+}
+
+func (m *Miner) SetRole(role int) error {
+	if !minerapi.ValidRole(role) {
+		return minerapi.ErrInvalidRole
+	}
+	m.lk.Lock()
+	m.role = role
+	m.lk.Unlock()
+	log.Infof("miner role set to %d", role)
+	return nil
+}
+
+func (m *Miner) markHeartbeat() {
+	m.lk.Lock()
+	m.lastHeartbeat = time.Now()
+	m.lk.Unlock()
+}
@@ -0,0 +1,131 @@
+package miner
+
+import (
+	"context"
+	"encoding/binary"
+
+	version "github.com/ipfs/go-ipfs"
+	"github.com/ipfs/go-ipfs/core/corerepo"
+	"github.com/ipfs/go-ipfs/miner/proto"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+)
+
+var heartbeatSeqKey = datastore.NewKey("/miner/heartbeat/seq")
+
+// nextHeartbeatSeq increments and persists the heartbeat sequence number.
+func (m *Miner) nextHeartbeatSeq() (uint64, error) {
+	m.seqLk.Lock()
+	defer m.seqLk.Unlock()
+	ds := m.node.Repo.Datastore()
+	var seq uint64
+	data, err := ds.Get(heartbeatSeqKey)
+	switch err {
+	case nil:
+		if len(data) == 8 {
+			seq = binary.BigEndian.Uint64(data)
+		}
+	case datastore.ErrNotFound:
+	default:
+		return 0, err
+	}
+	seq++
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], seq)
+	return seq, ds.Put(heartbeatSeqKey, buf[:])
+}
+
+func (m *Miner) heartbeatData(ctx context.Context) (proto.MinerHartBeat, error) {
+	m.lk.Lock()
+	hb := proto.MinerHartBeat{
+		Role:          m.role,
+		Version:       version.CurrentVersionNumber,
+		WalletAddress: m.walletAddress,
+	}
+	m.lk.Unlock()
+
+	for _, addr := range m.node.PeerHost.Addrs() {
+		hb.Addrs = append(hb.Addrs, addr.String())
+	}
+
+	size, err := corerepo.RepoSize(ctx, m.node)
+	if err != nil {
+		return hb, err
+	}
+	hb.RepoSize = size.RepoSize
+	hb.StorageMax = size.StorageMax
+	if size.StorageMax != corerepo.NoLimit && size.StorageMax > size.RepoSize {
+		hb.FreeSpace = size.StorageMax - size.RepoSize
+	}
+
+	jobs, err := m.handler.jobs.List()
+	if err != nil {
+		return hb, err
+	}
+	for _, job := range jobs {
+		if !job.finished() {
+			hb.PendingJobs++
+		}
+	}
+	stored, err := m.handler.files.List()
+	if err != nil {
+		return hb, err
+	}
+	// Files assigned by several requesters are pinned once.
+	pinned := make(map[cid.Cid]struct{}, len(stored))
+	for _, f := range stored {
+		if _, ok := pinned[f.Cid]; ok {
+			continue
+		}
+		pinned[f.Cid] = struct{}{}
+		hb.PinnedBytes += f.Size
+	}
+	hb.FreedBytes, err = m.handler.freed.Get()
+	if err != nil {
+		return hb, err
+	}
+
+	hb.Seq, err = m.nextHeartbeatSeq()
+	return hb, err
+}
+
+func (m *Miner) heartbeat(ctx context.Context) error {
+	m.lk.Lock()
+	closing := m.closing
+	m.lk.Unlock()
+	if closing {
+		// Close announces the miner going offline.
+		return nil
+	}
+	return m.publishHeartbeat(ctx, false)
+}
+
+// publishHeartbeat publishes a heartbeat, announcing that the miner goes
+// offline when offline is set.
+func (m *Miner) publishHeartbeat(ctx context.Context, offline bool) error {
+	hb, err := m.heartbeatData(ctx)
+	if err != nil {
+		heartbeatFailuresMetric.Inc()
+		log.Errorf("failed to collect heartbeat data:%v", err.Error())
+		return err
+	}
+	hb.Offline = offline
+	msgResp := proto.Message{
+		Type: proto.MsgMinerHeartBeat,
+		Data: hb,
+	}
+	err = m.PublishMessage(ctx, proto.MinerHeartBeatTopic(m.topics), &msgResp)
+	if err != nil {
+		heartbeatFailuresMetric.Inc()
+		log.Errorf("failed to publish:%v", err.Error())
+		return err
+	}
+	// Only what was reported is cleared, files released meanwhile are
+	// reported with the next heartbeat.
+	if err := m.handler.freed.Sub(hb.FreedBytes); err != nil {
+		log.Errorf("failed to reset freed bytes: %v", err)
+	}
+	m.markHeartbeat()
+	return nil
+}
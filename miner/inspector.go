@@ -0,0 +1,779 @@
+package miner
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreapi"
+	minerapi "github.com/ipfs/go-ipfs/miner/api"
+	minerconfig "github.com/ipfs/go-ipfs/miner/config"
+	"github.com/ipfs/go-ipfs/miner/proto"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Assignment states.
+const (
+	AssignmentPending = "pending"
+	AssignmentStored  = "stored"
+	AssignmentFailed  = "failed"
+)
+
+const (
+	// challengeTimeout bounds a single challenge round trip.
+	challengeTimeout = 5 * time.Minute
+	// maxProofPositions bounds the positions proven by a single
+	// WindowPostProof response. Each proof carries a whole leaf block, so
+	// the response fits in a message frame even with leaves of the largest
+	// size chunkers produce.
+	maxProofPositions = maxMessageSize/chunker.ChunkSizeLimit - 1
+	// scoreWeight is the weight of the latest challenged file in the
+	// reliability score of a miner.
+	scoreWeight = 0.1
+)
+
+var (
+	inspectorMinersPrefix      = datastore.NewKey("/miner/inspector/miners")
+	inspectorAssignmentsPrefix = datastore.NewKey("/miner/inspector/assignments")
+)
+
+var (
+	ErrNothingToChallenge = errors.New("miner stores no assigned files")
+	ErrNotAFile           = errors.New("only files can be assigned")
+	ErrUnexpectedResponse = errors.New("unexpected response")
+	ErrStaleHeartbeat     = errors.New("heartbeat older than the last one received")
+)
+
+// minerRecord is the persisted state of a miner seen by the inspector.
+type minerRecord struct {
+	Peer             peer.ID
+	Role             int
+	Version          string
+	WalletAddress    string
+	Addrs            []string
+	FreeSpace        uint64
+	LastSeq          uint64
+	LastHeartbeat    time.Time
+	MissedHeartbeats uint64
+	Challenges       uint64
+	Failures         uint64
+	Score            float64
+	// Offline is set when the miner announced going offline, until its
+	// next heartbeat.
+	Offline bool
+}
+
+func (r *minerRecord) info() minerapi.MinerInfo {
+	return minerapi.MinerInfo{
+		Peer:             r.Peer.String(),
+		Role:             r.Role,
+		Version:          r.Version,
+		WalletAddress:    r.WalletAddress,
+		Addrs:            r.Addrs,
+		FreeSpace:        r.FreeSpace,
+		LastSeq:          r.LastSeq,
+		LastHeartbeat:    r.LastHeartbeat,
+		MissedHeartbeats: r.MissedHeartbeats,
+		Challenges:       r.Challenges,
+		Failures:         r.Failures,
+		Score:            r.Score,
+		Offline:          r.Offline,
+	}
+}
+
+// sequence checks that a heartbeat numbered seq and sent at sent follows the
+// last one of r, and counts the heartbeats missed in between. Heartbeats are
+// ordered by their sequence number. A lower number sent after the last
+// heartbeat means the miner lost its repo and restarted the sequence, and
+// is accepted without counting missed heartbeats. Heartbeats without
+// sequence number are ordered by the time they were sent.
+func (r *minerRecord) sequence(seq uint64, sent time.Time) error {
+	switch {
+	case seq == 0 || r.LastSeq == 0:
+		if !r.LastHeartbeat.IsZero() && !sent.After(r.LastHeartbeat) {
+			return ErrReplayedMessage
+		}
+	case seq == r.LastSeq:
+		return ErrReplayedMessage
+	case seq > r.LastSeq:
+		r.MissedHeartbeats += seq - r.LastSeq - 1
+	case sent.After(r.LastHeartbeat):
+		log.Warnf("heartbeat sequence of %v restarted at %d after %d", r.Peer, seq, r.LastSeq)
+	default:
+		return ErrStaleHeartbeat
+	}
+	return nil
+}
+
+// record applies the outcome of one challenged file to the score of r.
+func (r *minerRecord) record(ok bool) {
+	result := 0.0
+	if ok {
+		result = 1
+	} else {
+		r.Failures++
+	}
+	if r.Challenges == 0 {
+		r.Score = result
+	} else {
+		r.Score += scoreWeight * (result - r.Score)
+	}
+	r.Challenges++
+}
+
+// assignment is a file the inspector asked a miner to store.
+type assignment struct {
+	Miner peer.ID
+	Cid   cid.Cid
+	Size  int64
+	// Local is set when the inspector pins its own copy of the file, in
+	// which case the miner is challenged for raw data instead of proofs.
+	Local bool
+	// Nonce is the nonce of the FetchFile request.
+	Nonce         string
+	State         string
+	Assigned      time.Time
+	LastChallenge time.Time
+	Failures      int
+}
+
+func (a *assignment) key() datastore.Key {
+	return datastore.NewKey(a.Miner.String()).ChildString(a.Cid.String())
+}
+
+func (a *assignment) info() minerapi.Assignment {
+	return minerapi.Assignment{
+		Miner:         a.Miner.String(),
+		Cid:           a.Cid.String(),
+		Size:          a.Size,
+		Local:         a.Local,
+		State:         a.State,
+		Assigned:      a.Assigned,
+		LastChallenge: a.LastChallenge,
+		Failures:      a.Failures,
+	}
+}
+
+// Inspector assigns files to miners, tracks their heartbeats and periodically
+// challenges them with randomized WindowPost requests.
+type Inspector struct {
+	ctx    context.Context
+	node   *core.IpfsNode
+	api    iface.CoreAPI
+	cfg    minerconfig.Inspector
+	topics string
+
+	// lk serializes updates of the persisted records.
+	lk          sync.Mutex
+	miners      datastore.Datastore
+	assignments datastore.Datastore
+}
+
+var _ minerapi.Inspector = (*Inspector)(nil)
+
+// RunInspector starts the inspector on node. It stops when ctx is done.
+func RunInspector(ctx context.Context, node *core.IpfsNode, cfg minerconfig.Miner) {
+	api, err := coreapi.NewCoreAPI(node, options.Api.FetchBlocks(true))
+	if err != nil {
+		log.Errorf("failed to create core api: %v", err)
+		return
+	}
+	ds := node.Repo.Datastore()
+	i := &Inspector{
+		ctx:         ctx,
+		node:        node,
+		api:         api,
+		cfg:         cfg.Inspector,
+		topics:      cfg.Topics(),
+		miners:      namespace.Wrap(ds, inspectorMinersPrefix),
+		assignments: namespace.Wrap(ds, inspectorAssignmentsPrefix),
+	}
+	if err := i.trackHeartbeats(ctx); err != nil {
+		log.Errorf("failed to track heartbeats: %v", err)
+		return
+	}
+	node.Inspector = i
+
+	node.PeerHost.SetStreamHandler(proto.V1ProtocolID, i.handleStream)
+	go func() {
+		<-ctx.Done()
+		node.PeerHost.RemoveStreamHandler(proto.V1ProtocolID)
+	}()
+
+	go i.Run(ctx)
+}
+
+// Run challenges every miner holding stored assignments once per challenge
+// interval.
+func (i *Inspector) Run(ctx context.Context) {
+	ticker := time.NewTicker(i.cfg.Interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			i.challengeAll(ctx)
+		}
+	}
+}
+
+func (i *Inspector) challengeAll(ctx context.Context) {
+	all, err := i.listAssignments("")
+	if err != nil {
+		log.Errorf("failed to list assignments: %v", err)
+		return
+	}
+	miners := make(map[peer.ID]struct{})
+	for _, a := range all {
+		if a.State == AssignmentStored {
+			miners[a.Miner] = struct{}{}
+		}
+	}
+	for p := range miners {
+		i.lk.Lock()
+		rec, err := i.getMiner(p)
+		i.lk.Unlock()
+		if err != nil {
+			log.Errorf("failed to load miner %v: %v", p, err)
+			continue
+		}
+		if rec.Offline {
+			log.Infof("not challenging %v, offline for maintenance", p)
+			continue
+		}
+		res, err := i.Challenge(ctx, p)
+		if err != nil {
+			log.Warnf("failed to challenge %v: %v", p, err)
+			continue
+		}
+		log.Infof("challenged %v: %d/%d files failed, score %.2f", p, res.Failed, res.Files, res.Score)
+	}
+}
+
+// trackHeartbeats records the heartbeats published by miners.
+func (i *Inspector) trackHeartbeats(ctx context.Context) error {
+	topic, err := i.node.PubSub.Join(proto.MinerHeartBeatTopic(i.topics))
+	if err != nil {
+		return err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		topic.Close()
+		return err
+	}
+	log.Infof("subscribe: %v", proto.MinerHeartBeatTopic(i.topics))
+
+	go func() {
+		defer topic.Close()
+		defer sub.Cancel()
+		for {
+			pmsg, err := sub.Next(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Errorf("failed get message: %v", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			msg, err := proto.DecodeMessage(pmsg.Data)
+			if err != nil {
+				log.Warnf("failed to decode heartbeat: %v", err)
+				continue
+			}
+			if err := i.onHeartbeat(pmsg.GetFrom(), &msg); err != nil {
+				log.Warnf("drop heartbeat from %v: %v", pmsg.GetFrom(), err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (i *Inspector) onHeartbeat(from peer.ID, msg *proto.Message) error {
+	if err := verifyFresh(from, msg); err != nil {
+		return err
+	}
+	hb, ok := msg.Data.(proto.MinerHartBeat)
+	if msg.Type != proto.MsgMinerHeartBeat || !ok {
+		return ErrUnexpectedResponse
+	}
+	sent := time.Unix(msg.Timestamp, 0)
+
+	i.lk.Lock()
+	defer i.lk.Unlock()
+	rec, err := i.getMiner(from)
+	if err != nil {
+		return err
+	}
+	if err := rec.sequence(hb.Seq, sent); err != nil {
+		return err
+	}
+	rec.Role = hb.Role
+	rec.Version = hb.Version
+	rec.WalletAddress = hb.WalletAddress
+	rec.Addrs = hb.Addrs
+	rec.FreeSpace = hb.FreeSpace
+	rec.LastSeq = hb.Seq
+	rec.LastHeartbeat = sent
+	rec.Offline = hb.Offline
+	return i.putMiner(rec)
+}
+
+func (i *Inspector) handleStream(s network.Stream) {
+	serveStream(i.ctx, s, i)
+}
+
+// Handle accepts the FetchFile responses of miners. Progress and responses
+// of one request share its nonce, so nonces are not checked for replays.
+func (i *Inspector) Handle(ctx context.Context, receivedFrom peer.ID, msg *proto.Message) error {
+	if err := verifyFresh(receivedFrom, msg); err != nil {
+		log.Warnf("drop message %v from %v: %v", msg.Type, receivedFrom, err)
+		return err
+	}
+	switch msg.Type {
+	case proto.MsgFetchFileResponse:
+		resp, _ := msg.Data.(proto.FetchFileResp)
+		return i.onFetchFileResp(receivedFrom, msg.Nonce, resp)
+	case proto.MsgFetchFileProgress:
+		progress, _ := msg.Data.(proto.FetchFileProgress)
+		log.Debugf("%v fetched %d bytes of %v", receivedFrom, progress.BytesFetched, progress.Cid)
+	default:
+		log.Warnf("message type not register: %v", msg.Type)
+	}
+	return nil
+}
+
+func (i *Inspector) onFetchFileResp(from peer.ID, nonce string, resp proto.FetchFileResp) error {
+	i.lk.Lock()
+	defer i.lk.Unlock()
+	a, err := i.getAssignment(from, resp.Cid)
+	if err == datastore.ErrNotFound {
+		log.Warnf("ignoring response of %v for unassigned file %v", from, resp.Cid)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if a.Nonce != nonce || a.State != AssignmentPending {
+		return nil
+	}
+	if resp.Status == proto.StatusOK {
+		a.State = AssignmentStored
+	} else {
+		a.State = AssignmentFailed
+		log.Warnf("%v failed to store %v: status %d", from, resp.Cid, resp.Status)
+	}
+	return i.putAssignment(a)
+}
+
+// Assign asks miner to fetch and pin c. The file size is read from the root
+// of c, and the assignment is local when the inspector pins c itself.
+func (i *Inspector) Assign(ctx context.Context, miner peer.ID, c cid.Cid) (minerapi.Assignment, error) {
+	p := path.IpfsPath(c)
+	node, err := i.api.Unixfs().Get(ctx, p)
+	if err != nil {
+		return minerapi.Assignment{}, err
+	}
+	f, ok := node.(files.File)
+	if !ok {
+		node.Close()
+		return minerapi.Assignment{}, ErrNotAFile
+	}
+	size, err := f.Size()
+	f.Close()
+	if err != nil {
+		return minerapi.Assignment{}, err
+	}
+	_, local, err := i.api.Pin().IsPinned(ctx, p, options.Pin.IsPinned.Recursive())
+	if err != nil {
+		return minerapi.Assignment{}, err
+	}
+	nonce, err := randomID()
+	if err != nil {
+		return minerapi.Assignment{}, err
+	}
+
+	a := &assignment{
+		Miner:    miner,
+		Cid:      c,
+		Size:     size,
+		Local:    local,
+		Nonce:    nonce,
+		State:    AssignmentPending,
+		Assigned: time.Now(),
+	}
+	i.lk.Lock()
+	err = i.putAssignment(a)
+	i.lk.Unlock()
+	if err != nil {
+		return minerapi.Assignment{}, err
+	}
+
+	msg := proto.Message{
+		Type:    proto.MsgFetchFile,
+		Nonce:   nonce,
+		Data:    proto.FetchFileReq{Cid: c, ExpectedSize: uint64(size)},
+		Version: proto.WireVersionCBOR,
+	}
+	if err := sendMessage(ctx, i.node, miner, &msg); err != nil {
+		i.lk.Lock()
+		if err := i.assignments.Delete(a.key()); err != nil {
+			log.Warnf("failed to remove assignment: %v", err)
+		}
+		i.lk.Unlock()
+		return minerapi.Assignment{}, err
+	}
+	return a.info(), nil
+}
+
+// Challenge picks random stored assignments of miner and random positions in
+// them. Files the inspector holds are challenged for raw data, which is
+// compared with the local copy, the others for Merkle proofs against their
+// root. Every challenged file updates the score of the miner.
+func (i *Inspector) Challenge(ctx context.Context, miner peer.ID) (minerapi.ChallengeResult, error) {
+	all, err := i.listAssignments(miner)
+	if err != nil {
+		return minerapi.ChallengeResult{}, err
+	}
+	var stored []*assignment
+	for _, a := range all {
+		if a.State == AssignmentStored && a.Size > 0 {
+			stored = append(stored, a)
+		}
+	}
+	if len(stored) == 0 {
+		return minerapi.ChallengeResult{}, ErrNothingToChallenge
+	}
+	picked, err := pickAssignments(stored, i.cfg.Files())
+	if err != nil {
+		return minerapi.ChallengeResult{}, err
+	}
+
+	var local, remote []proto.WindowPostReqItem
+	byCid := make(map[cid.Cid]*assignment, len(picked))
+	for _, a := range picked {
+		positions, err := randomPositions(a.Size, i.cfg.Positions())
+		if err != nil {
+			return minerapi.ChallengeResult{}, err
+		}
+		item := proto.WindowPostReqItem{FileCid: a.Cid, Positions: positions}
+		if a.Local {
+			local = append(local, item)
+		} else {
+			remote = append(remote, item)
+		}
+		byCid[a.Cid] = a
+	}
+
+	passed := make(map[cid.Cid]bool, len(picked))
+	if len(local) > 0 {
+		i.challengeData(ctx, miner, local, passed)
+	}
+	if len(remote) > 0 {
+		i.challengeProofs(ctx, miner, remote, passed)
+	}
+
+	i.lk.Lock()
+	defer i.lk.Unlock()
+	rec, err := i.getMiner(miner)
+	if err != nil {
+		return minerapi.ChallengeResult{}, err
+	}
+	res := minerapi.ChallengeResult{Miner: miner.String(), Files: len(picked)}
+	now := time.Now()
+	for c, a := range byCid {
+		ok := passed[c]
+		rec.record(ok)
+		a.LastChallenge = now
+		if !ok {
+			a.Failures++
+			res.Failed++
+		}
+		if err := i.putAssignment(a); err != nil {
+			return res, err
+		}
+	}
+	res.Score = rec.Score
+	return res, i.putMiner(rec)
+}
+
+// challengeData requests the raw bytes of items and compares them with the
+// local copy.
+func (i *Inspector) challengeData(ctx context.Context, miner peer.ID, items []proto.WindowPostReqItem, passed map[cid.Cid]bool) {
+	resp, err := i.request(ctx, miner, proto.MsgWindowPost, proto.WindowPostReq{Items: items}, proto.MsgWindowPostResponse)
+	if err != nil {
+		log.Warnf("WindowPost challenge of %v failed: %v", miner, err)
+		return
+	}
+	// The local copy is read from the blockstore only, a missing block
+	// fails the comparison instead of being fetched from the network.
+	api, err := i.api.WithOptions(options.Api.Offline(true))
+	if err != nil {
+		log.Errorf("failed to create offline API: %v", err)
+		return
+	}
+	data, _ := resp.Data.(proto.WindowPostResp)
+	for j, item := range items {
+		if j >= len(data.Items) {
+			break
+		}
+		got := data.Items[j]
+		if got.FileCid != item.FileCid || len(got.Data) != len(item.Positions) || len(got.Failed) > 0 {
+			continue
+		}
+		want, err := readPositions(ctx, api.Dag(), item.FileCid, item.Positions)
+		if err != nil {
+			log.Errorf("failed to read local copy of %v: %v", item.FileCid, err)
+			continue
+		}
+		passed[item.FileCid] = bytes.Equal(got.Data, want)
+	}
+}
+
+// challengeProofs requests Merkle proofs for items and verifies them. Every
+// request carries at most maxProofPositions positions of a single file, so
+// that the proofs fit in a message frame. A file passes when the proofs of
+// all its positions are valid.
+func (i *Inspector) challengeProofs(ctx context.Context, miner peer.ID, items []proto.WindowPostReqItem, passed map[cid.Cid]bool) {
+	for _, item := range items {
+		ok := true
+		for _, part := range splitPositions(item, maxProofPositions) {
+			if err := i.challengeProof(ctx, miner, part); err != nil {
+				log.Warnf("WindowPostProof challenge of %v for %v failed: %v", miner, item.FileCid, err)
+				ok = false
+				break
+			}
+		}
+		passed[item.FileCid] = ok
+	}
+}
+
+func (i *Inspector) challengeProof(ctx context.Context, miner peer.ID, item proto.WindowPostReqItem) error {
+	resp, err := i.request(ctx, miner, proto.MsgWindowPostProof, proto.WindowPostProofReq{Items: []proto.WindowPostReqItem{item}}, proto.MsgWindowPostProofResponse)
+	if err != nil {
+		return err
+	}
+	data, _ := resp.Data.(proto.WindowPostProofResp)
+	if len(data.Items) != 1 {
+		return fmt.Errorf("%w: %d items for 1 file", ErrUnexpectedResponse, len(data.Items))
+	}
+	return verifyProofItem(item, data.Items[0])
+}
+
+// splitPositions splits the positions of item into items of at most n
+// positions.
+func splitPositions(item proto.WindowPostReqItem, n int) []proto.WindowPostReqItem {
+	var parts []proto.WindowPostReqItem
+	for start := 0; start < len(item.Positions); start += n {
+		end := start + n
+		if end > len(item.Positions) {
+			end = len(item.Positions)
+		}
+		parts = append(parts, proto.WindowPostReqItem{FileCid: item.FileCid, Positions: item.Positions[start:end]})
+	}
+	return parts
+}
+
+// verifyProofItem checks that got proves every challenged position of item.
+func verifyProofItem(item proto.WindowPostReqItem, got proto.WindowPostProofRespItem) error {
+	if got.FileCid != item.FileCid {
+		return fmt.Errorf("%w: proof for %v", ErrUnexpectedResponse, got.FileCid)
+	}
+	if len(got.Proofs) != len(item.Positions) {
+		return fmt.Errorf("%w: %d proofs for %d positions", ErrUnexpectedResponse, len(got.Proofs), len(item.Positions))
+	}
+	for j, proof := range got.Proofs {
+		if proof.Position != item.Positions[j] {
+			return fmt.Errorf("%w: proof for position %d instead of %d", ErrUnexpectedResponse, proof.Position, item.Positions[j])
+		}
+	}
+	_, err := VerifyWindowPostProof(got)
+	return err
+}
+
+// request sends a challenge to miner and returns its authenticated response.
+func (i *Inspector) request(ctx context.Context, miner peer.ID, msgType string, data interface{}, respType string) (proto.Message, error) {
+	nonce, err := randomID()
+	if err != nil {
+		return proto.Message{}, err
+	}
+	msg := proto.Message{
+		Type:    msgType,
+		Nonce:   nonce,
+		Data:    data,
+		Version: proto.WireVersionCBOR,
+	}
+	ctx, cancel := context.WithTimeout(ctx, challengeTimeout)
+	defer cancel()
+	resp, err := roundTrip(ctx, i.node, miner, &msg)
+	if err != nil {
+		return resp, err
+	}
+	if err := verifyFresh(miner, &resp); err != nil {
+		return resp, err
+	}
+	if resp.Type != respType || resp.Nonce != nonce {
+		return resp, ErrUnexpectedResponse
+	}
+	return resp, nil
+}
+
+// Miners lists the miners known to the inspector.
+func (i *Inspector) Miners() ([]minerapi.MinerInfo, error) {
+	res, err := i.miners.Query(query.Query{})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var out []minerapi.MinerInfo
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		rec := new(minerRecord)
+		if err := json.Unmarshal(r.Value, rec); err != nil {
+			log.Warnf("skipping corrupt miner record %s: %v", r.Key, err)
+			continue
+		}
+		out = append(out, rec.info())
+	}
+	return out, nil
+}
+
+// Assignments lists the files assigned to miner, or to all miners when miner
+// is empty.
+func (i *Inspector) Assignments(miner peer.ID) ([]minerapi.Assignment, error) {
+	all, err := i.listAssignments(miner)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]minerapi.Assignment, len(all))
+	for j, a := range all {
+		out[j] = a.info()
+	}
+	return out, nil
+}
+
+func (i *Inspector) listAssignments(miner peer.ID) ([]*assignment, error) {
+	q := query.Query{}
+	if miner != "" {
+		q.Prefix = datastore.NewKey(miner.String()).String()
+	}
+	res, err := i.assignments.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var out []*assignment
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		a := new(assignment)
+		if err := json.Unmarshal(r.Value, a); err != nil {
+			log.Warnf("skipping corrupt assignment %s: %v", r.Key, err)
+			continue
+		}
+		if miner != "" && a.Miner != miner {
+			continue
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+func (i *Inspector) getMiner(p peer.ID) (*minerRecord, error) {
+	data, err := i.miners.Get(datastore.NewKey(p.String()))
+	if err == datastore.ErrNotFound {
+		return &minerRecord{Peer: p}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec := new(minerRecord)
+	return rec, json.Unmarshal(data, rec)
+}
+
+func (i *Inspector) putMiner(rec *minerRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return i.miners.Put(datastore.NewKey(rec.Peer.String()), data)
+}
+
+func (i *Inspector) getAssignment(miner peer.ID, c cid.Cid) (*assignment, error) {
+	a := &assignment{Miner: miner, Cid: c}
+	data, err := i.assignments.Get(a.key())
+	if err != nil {
+		return nil, err
+	}
+	return a, json.Unmarshal(data, a)
+}
+
+func (i *Inspector) putAssignment(a *assignment) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return i.assignments.Put(a.key(), data)
+}
+
+// pickAssignments returns up to n of all, chosen uniformly at random.
+func pickAssignments(all []*assignment, n int) ([]*assignment, error) {
+	picked := append([]*assignment{}, all...)
+	if n > len(picked) {
+		n = len(picked)
+	}
+	for j := 0; j < n; j++ {
+		k, err := randInt(int64(len(picked) - j))
+		if err != nil {
+			return nil, err
+		}
+		picked[j], picked[j+int(k)] = picked[j+int(k)], picked[j]
+	}
+	return picked[:n], nil
+}
+
+// randomPositions returns n random positions in a file of the given size.
+func randomPositions(size int64, n int) ([]int64, error) {
+	positions := make([]int64, n)
+	for j := range positions {
+		pos, err := randInt(size)
+		if err != nil {
+			return nil, err
+		}
+		positions[j] = pos
+	}
+	return positions, nil
+}
+
+// randInt returns a uniform random integer in [0, n). Challenges must not be
+// predictable by miners.
+func randInt(n int64) (int64, error) {
+	v, err := rand.Int(rand.Reader, big.NewInt(n))
+	if err != nil {
+		return 0, err
+	}
+	return v.Int64(), nil
+}
@@ -0,0 +1,224 @@
+package miner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	files "github.com/ipfs/go-ipfs-files"
+	minerconfig "github.com/ipfs/go-ipfs/miner/config"
+	"github.com/ipfs/go-ipfs/miner/proto"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	"github.com/ipfs/go-unixfs/importer"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestVerifyProofItem(t *testing.T) {
+	ctx := context.Background()
+	dserv := mdtest.Mock()
+
+	data := make([]byte, 16*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+	root, err := importer.BuildDagFromReader(dserv, chunker.NewSizeSplitter(bytes.NewReader(data), 512))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	positions, err := randomPositions(int64(len(data)), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := proto.WindowPostReqItem{FileCid: root.Cid(), Positions: positions}
+	proofs, err := ProvePositions(ctx, dserv, root.Cid(), positions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := proto.WindowPostProofRespItem{FileCid: root.Cid(), Proofs: proofs}
+	if err := verifyProofItem(item, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Proofs for other positions than the challenged ones are rejected.
+	other := item
+	other.Positions = append([]int64{}, positions...)
+	other.Positions[0] = (positions[0] + 1) % int64(len(data))
+	if err := verifyProofItem(other, resp); !errors.Is(err, ErrUnexpectedResponse) {
+		t.Errorf("expected ErrUnexpectedResponse, got %v", err)
+	}
+
+	short := proto.WindowPostProofRespItem{FileCid: root.Cid(), Proofs: proofs[1:]}
+	if err := verifyProofItem(item, short); !errors.Is(err, ErrUnexpectedResponse) {
+		t.Errorf("expected ErrUnexpectedResponse, got %v", err)
+	}
+}
+
+func TestChallengeDefaultConfig(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tp := newTestPair(t, ctx)
+
+	// Files in 256 KiB chunks, more than the challenged ones.
+	rng := rand.New(rand.NewSource(3))
+	for j := 0; j < minerconfig.DefaultChallengeFiles+1; j++ {
+		data := make([]byte, 3<<20)
+		rng.Read(data)
+		p, err := tp.minerAPI.Unixfs().Add(ctx, files.NewBytesFile(data), options.Unixfs.Chunker("size-262144"), options.Unixfs.Pin(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := &assignment{
+			Miner: tp.miner.Identity,
+			Cid:   p.Cid(),
+			Size:  int64(len(data)),
+			State: AssignmentStored,
+		}
+		if err := tp.inspector.putAssignment(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := tp.inspector.Challenge(ctx, tp.miner.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Files != minerconfig.DefaultChallengeFiles || res.Failed != 0 || res.Score != 1 {
+		t.Errorf("unexpected challenge result: %+v", res)
+	}
+}
+
+func TestSplitPositions(t *testing.T) {
+	item := proto.WindowPostReqItem{Positions: []int64{1, 2, 3, 4, 5, 6, 7, 8}}
+	parts := splitPositions(item, 3)
+	if len(parts) != 3 || len(parts[0].Positions) != 3 || len(parts[2].Positions) != 2 || parts[2].Positions[1] != 8 {
+		t.Errorf("unexpected parts: %+v", parts)
+	}
+}
+
+func TestMinerRecordScore(t *testing.T) {
+	var rec minerRecord
+	rec.record(true)
+	if rec.Score != 1 || rec.Challenges != 1 || rec.Failures != 0 {
+		t.Fatalf("unexpected record: %+v", rec)
+	}
+	rec.record(false)
+	if rec.Score != 1-scoreWeight || rec.Failures != 1 {
+		t.Fatalf("unexpected record: %+v", rec)
+	}
+	for i := 0; i < 100; i++ {
+		rec.record(false)
+	}
+	if rec.Score > 0.01 {
+		t.Errorf("score should approach 0 after repeated failures: %v", rec.Score)
+	}
+}
+
+func TestHeartbeatSequence(t *testing.T) {
+	now := time.Now()
+	rec := minerRecord{Peer: "miner"}
+	accept := func(seq uint64, sent time.Time) error {
+		t.Helper()
+		if err := rec.sequence(seq, sent); err != nil {
+			return err
+		}
+		rec.LastSeq = seq
+		rec.LastHeartbeat = sent
+		return nil
+	}
+
+	if err := accept(1, now); err != nil {
+		t.Fatal(err)
+	}
+	// Heartbeats sent within the same second are ordered by sequence.
+	if err := accept(2, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := accept(2, now); err != ErrReplayedMessage {
+		t.Fatalf("expected ErrReplayedMessage, got %v", err)
+	}
+	if err := accept(5, now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if rec.MissedHeartbeats != 2 {
+		t.Errorf("expected 2 missed heartbeats, got %d", rec.MissedHeartbeats)
+	}
+	// A heartbeat delivered late is dropped.
+	if err := accept(4, now); err != ErrStaleHeartbeat {
+		t.Fatalf("expected ErrStaleHeartbeat, got %v", err)
+	}
+	// A miner that lost its repo starts over.
+	if err := accept(1, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := accept(2, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if rec.MissedHeartbeats != 2 {
+		t.Errorf("a restarted sequence should not count missed heartbeats, got %d", rec.MissedHeartbeats)
+	}
+}
+
+func TestOnHeartbeat(t *testing.T) {
+	priv, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &Inspector{miners: dssync.MutexWrap(datastore.NewMapDatastore())}
+	send := func(seq uint64) error {
+		msg := proto.Message{Type: proto.MsgMinerHeartBeat, Data: proto.MinerHartBeat{Seq: seq}}
+		if err := msg.Sign(priv); err != nil {
+			t.Fatal(err)
+		}
+		return i.onHeartbeat(from, &msg)
+	}
+	for seq := uint64(1); seq <= 3; seq++ {
+		if err := send(seq); err != nil {
+			t.Fatalf("heartbeat %d: %v", seq, err)
+		}
+	}
+	if err := send(3); err != ErrReplayedMessage {
+		t.Fatalf("expected ErrReplayedMessage, got %v", err)
+	}
+	rec, err := i.getMiner(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.LastSeq != 3 || rec.MissedHeartbeats != 0 {
+		t.Errorf("unexpected record: %+v", rec)
+	}
+}
+
+func TestPickAssignments(t *testing.T) {
+	all := make([]*assignment, 10)
+	for i := range all {
+		all[i] = &assignment{Size: int64(i)}
+	}
+	picked, err := pickAssignments(all, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(picked) != 4 {
+		t.Fatalf("picked %d assignments, want 4", len(picked))
+	}
+	seen := make(map[*assignment]bool)
+	for _, a := range picked {
+		if seen[a] {
+			t.Fatal("assignment picked twice")
+		}
+		seen[a] = true
+	}
+	if picked, _ := pickAssignments(all[:2], 4); len(picked) != 2 {
+		t.Errorf("picked %d assignments, want 2", len(picked))
+	}
+}
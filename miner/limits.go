@@ -0,0 +1,199 @@
+package miner
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	minerconfig "github.com/ipfs/go-ipfs/miner/config"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// maxBuckets bounds the number of peers whose request rate is tracked. Idle
+// peers are forgotten first.
+const maxBuckets = 4096
+
+var (
+	ErrNotAllowed  = errors.New("peer is not an allowed inspector")
+	ErrRateLimited = errors.New("request rate limit exceeded")
+	// ErrFileTooLarge is returned when a file exceeds the largest file
+	// size accepted.
+	ErrFileTooLarge = fmt.Errorf("%w: file too large", ErrPermanent)
+	// ErrQuotaExceeded is returned when storing a file would exceed the
+	// storage quota of its requester.
+	ErrQuotaExceeded = fmt.Errorf("%w: requester quota exceeded", ErrPermanent)
+)
+
+// Limits bounds what other peers may ask of the miner. Zero values disable a
+// limit.
+type Limits struct {
+	// RequestRate is the number of requests per second accepted from a
+	// single peer and RequestBurst the number accepted at once.
+	RequestRate  float64
+	RequestBurst int
+	// MaxFileSize is the size of the largest file stored.
+	MaxFileSize uint64
+	// RequesterQuota is the total size of the files stored for a single
+	// requester.
+	RequesterQuota uint64
+	// Inspectors are the peers requests are accepted from. Every peer is
+	// allowed when nil.
+	Inspectors map[peer.ID]struct{}
+}
+
+func limitsFromConfig(cfg minerconfig.Limits) Limits {
+	l := Limits{
+		RequestRate:    cfg.RequestRate,
+		RequestBurst:   cfg.Burst(),
+		MaxFileSize:    cfg.FileSize(),
+		RequesterQuota: cfg.Quota(),
+	}
+	if peers := cfg.InspectorPeers(); len(peers) > 0 {
+		l.Inspectors = make(map[peer.ID]struct{}, len(peers))
+		for _, p := range peers {
+			l.Inspectors[p] = struct{}{}
+		}
+	}
+	return l
+}
+
+// maxFetchBytes bounds the block data fetched for a file of at most size
+// bytes. It leaves room for the DAG structure around the file content.
+func maxFetchBytes(size uint64) uint64 {
+	if size > math.MaxUint64/2 {
+		return math.MaxUint64
+	}
+	return size + size/4
+}
+
+// tokenBucket refills at rate tokens per second up to burst tokens.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) level(now time.Time, rate float64, burst int) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*rate
+	if tokens > float64(burst) {
+		tokens = float64(burst)
+	}
+	return tokens
+}
+
+// requestLimiter applies Limits to the requests of each peer.
+type requestLimiter struct {
+	lk      sync.Mutex
+	limits  Limits
+	buckets map[peer.ID]*tokenBucket
+}
+
+func newRequestLimiter(l Limits) *requestLimiter {
+	return &requestLimiter{limits: l, buckets: make(map[peer.ID]*tokenBucket)}
+}
+
+func (r *requestLimiter) Limits() Limits {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.limits
+}
+
+// SetLimits replaces the limits. Request rates are tracked afresh.
+func (r *requestLimiter) SetLimits(l Limits) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.limits = l
+	r.buckets = make(map[peer.ID]*tokenBucket)
+}
+
+// Allow checks that p may send a request now and counts the request against
+// its rate. It returns ErrNotAllowed or ErrRateLimited otherwise.
+func (r *requestLimiter) Allow(p peer.ID, now time.Time) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if r.limits.Inspectors != nil {
+		if _, ok := r.limits.Inspectors[p]; !ok {
+			return ErrNotAllowed
+		}
+	}
+	rate, burst := r.limits.RequestRate, r.limits.RequestBurst
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	b, ok := r.buckets[p]
+	if !ok {
+		if len(r.buckets) >= maxBuckets {
+			r.forgetIdle(now, rate, burst)
+		}
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		r.buckets[p] = b
+	}
+	b.tokens = b.level(now, rate, burst)
+	b.last = now
+	if b.tokens < 1 {
+		return ErrRateLimited
+	}
+	b.tokens--
+	return nil
+}
+
+// forgetIdle drops the buckets that refilled completely, which behave like
+// new ones, or an arbitrary one when none did. The caller must hold lk.
+func (r *requestLimiter) forgetIdle(now time.Time, rate float64, burst int) {
+	for p, b := range r.buckets {
+		if b.level(now, rate, burst) >= float64(burst) {
+			delete(r.buckets, p)
+		}
+	}
+	for p := range r.buckets {
+		if len(r.buckets) < maxBuckets {
+			break
+		}
+		delete(r.buckets, p)
+	}
+}
+
+// checkFileSize checks a file of size bytes against the size limit, and
+// against the quota of a requester already storing stored bytes. A requester
+// that reached its quota can not store files of unknown, zero, size.
+func (l Limits) checkFileSize(size, stored uint64) error {
+	if l.MaxFileSize != 0 && size > l.MaxFileSize {
+		return fmt.Errorf("%w: %d bytes, at most %d accepted", ErrFileTooLarge, size, l.MaxFileSize)
+	}
+	if l.RequesterQuota != 0 && (stored >= l.RequesterQuota || size > l.RequesterQuota-stored) {
+		return fmt.Errorf("%w: %d bytes stored, %d requested, quota %d", ErrQuotaExceeded, stored, size, l.RequesterQuota)
+	}
+	return nil
+}
+
+// fetchLimit bounds the content fetched by a job.
+type fetchLimit struct {
+	// Size is the size of the largest file the job may store, zero for no
+	// limit.
+	Size uint64
+	// Err is the error reported for larger files.
+	Err error
+}
+
+// exceeded reports whether fetched bytes of blocks exceed what a file within
+// the limit needs.
+func (f fetchLimit) exceeded(fetched uint64) bool {
+	return f.Size != 0 && fetched > maxFetchBytes(f.Size)
+}
+
+// fetchLimit returns the limit of a fetch for a requester storing stored
+// bytes. The requester must be below its quota.
+func (l Limits) fetchLimit(stored uint64) fetchLimit {
+	if l.RequesterQuota != 0 {
+		left := l.RequesterQuota - stored
+		if l.MaxFileSize == 0 || left < l.MaxFileSize {
+			return fetchLimit{Size: left, Err: ErrQuotaExceeded}
+		}
+	}
+	return fetchLimit{Size: l.MaxFileSize, Err: ErrFileTooLarge}
+}
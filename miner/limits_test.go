@@ -0,0 +1,84 @@
+package miner
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	a, err := peer.Decode("QmSnuWmxptJZdLJpKRarxBMS2Ju2oANVrgbr2xWbie9b2D")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := peer.ID("other")
+	now := time.Now()
+
+	l := newRequestLimiter(Limits{})
+	for i := 0; i < 100; i++ {
+		if err := l.Allow(a, now); err != nil {
+			t.Fatalf("zero limits should allow every request: %v", err)
+		}
+	}
+
+	l.SetLimits(Limits{RequestRate: 2, RequestBurst: 3})
+	for i := 0; i < 3; i++ {
+		if err := l.Allow(a, now); err != nil {
+			t.Fatalf("request %d within burst rejected: %v", i, err)
+		}
+	}
+	if err := l.Allow(a, now); err != ErrRateLimited {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+	if err := l.Allow(b, now); err != nil {
+		t.Fatalf("rate should be tracked per peer: %v", err)
+	}
+	if err := l.Allow(a, now.Add(500*time.Millisecond)); err != nil {
+		t.Fatalf("a token should have refilled: %v", err)
+	}
+	if err := l.Allow(a, now.Add(500*time.Millisecond)); err != ErrRateLimited {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+
+	l.SetLimits(Limits{Inspectors: map[peer.ID]struct{}{a: {}}})
+	if err := l.Allow(a, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Allow(b, now); err != ErrNotAllowed {
+		t.Fatalf("expected ErrNotAllowed, got %v", err)
+	}
+}
+
+func TestCheckFileSize(t *testing.T) {
+	l := Limits{MaxFileSize: 100, RequesterQuota: 250}
+	for _, c := range []struct {
+		size, stored uint64
+		err          error
+	}{
+		{size: 100, stored: 150},
+		{size: 0, stored: 249},
+		{size: 101, stored: 0, err: ErrFileTooLarge},
+		{size: 100, stored: 151, err: ErrQuotaExceeded},
+		{size: 0, stored: 250, err: ErrQuotaExceeded},
+	} {
+		err := l.checkFileSize(c.size, c.stored)
+		if c.err == nil && err != nil || c.err != nil && !errors.Is(err, c.err) {
+			t.Errorf("size %d stored %d: expected %v, got %v", c.size, c.stored, c.err, err)
+		}
+		if err != nil && !errors.Is(err, ErrPermanent) {
+			t.Errorf("limit errors should be permanent: %v", err)
+		}
+	}
+
+	if f := l.fetchLimit(200); f.Size != 50 || f.Err != ErrQuotaExceeded {
+		t.Errorf("unexpected fetch limit: %+v", f)
+	}
+	if f := l.fetchLimit(0); f.Size != 100 || f.Err != ErrFileTooLarge {
+		t.Errorf("unexpected fetch limit: %+v", f)
+	}
+	if f := (Limits{}).fetchLimit(0); f.exceeded(1 << 40) {
+		t.Error("zero limits should not bound fetches")
+	}
+}
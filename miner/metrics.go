@@ -0,0 +1,96 @@
+package miner
+
+import (
+	"errors"
+
+	prometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// Proof failure reasons.
+const (
+	failureNotPinned  = "not_pinned"
+	failureOutOfRange = "out_of_range"
+	failureOther      = "other"
+)
+
+var (
+	messagesReceivedMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "miner",
+		Name:      "messages_received_total",
+		Help:      "Number of miner protocol messages received, by message type.",
+	}, []string{"type"})
+
+	handlerErrorsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "miner",
+		Name:      "handler_errors_total",
+		Help:      "Number of miner protocol messages whose handling failed, by message type.",
+	}, []string{"type"})
+
+	fetchDurationMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ipfs",
+		Subsystem: "miner",
+		Name:      "fetch_duration_seconds",
+		Help:      "Duration of FetchFile job attempts, by outcome.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"status"})
+
+	fetchSizeMetric = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "ipfs",
+		Subsystem: "miner",
+		Name:      "fetch_size_bytes",
+		Help:      "Bytes fetched by successful FetchFile jobs.",
+		Buckets:   prometheus.ExponentialBuckets(1<<10, 4, 12),
+	})
+
+	windowPostChallengesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "miner",
+		Name:      "windowpost_challenges_total",
+		Help:      "Number of WindowPost challenges answered, by message type.",
+	}, []string{"type"})
+
+	windowPostDurationMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ipfs",
+		Subsystem: "miner",
+		Name:      "windowpost_duration_seconds",
+		Help:      "Time taken to answer WindowPost challenges, by message type.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"type"})
+
+	proofFailuresMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "miner",
+		Name:      "proof_failures_total",
+		Help:      "Number of challenged files the miner could not answer for, by reason.",
+	}, []string{"reason"})
+
+	heartbeatFailuresMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "miner",
+		Name:      "heartbeat_failures_total",
+		Help:      "Number of heartbeats that could not be published.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		messagesReceivedMetric,
+		handlerErrorsMetric,
+		fetchDurationMetric,
+		fetchSizeMetric,
+		windowPostChallengesMetric,
+		windowPostDurationMetric,
+		proofFailuresMetric,
+		heartbeatFailuresMetric,
+	)
+}
+
+// proofFailure classifies err for proofFailuresMetric.
+func proofFailure(err error) string {
+	if errors.Is(err, ErrOutOfRange) {
+		return failureOutOfRange
+	}
+	return failureOther
+}
@@ -2,57 +2,201 @@ package miner
 
 import (
 	"context"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
 	"github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/core/coreapi"
+	minerconfig "github.com/ipfs/go-ipfs/miner/config"
 	"github.com/ipfs/go-ipfs/miner/proto"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipfs/interface-go-ipfs-core/options"
+	"reflect"
 	"runtime/debug"
+	"sync"
 	"time"
 )
 
 var log = logging.Logger("miner")
 
-func Run(ctx context.Context, node *core.IpfsNode, role int) {
+const (
+	// configPollInterval is how often the Miner config is checked for
+	// changes.
+	configPollInterval = time.Minute / 2
+	// closeTimeout bounds each step of stopping the miner: draining
+	// in-flight requests, persisting fetch jobs and announcing going
+	// offline. Every step gets the full timeout, so a slow one does not
+	// keep the next from running.
+	closeTimeout = 30 * time.Second
+)
+
+// Run starts the miner on node. It stops when ctx is done or the node stops,
+// whichever comes first.
+func Run(ctx context.Context, node *core.IpfsNode, cfg minerconfig.Miner) error {
+	loaded, err := minerconfig.Load(node.Repo)
+	if err != nil {
+		return err
+	}
+	// The miner outlives ctx until Close has drained it.
+	mctx, cancel := context.WithCancel(node.Context())
 	miner := &Miner{
-		node: node,
-		role: role,
+		ctx:           mctx,
+		cancel:        cancel,
+		node:          node,
+		topics:        cfg.Topics(),
+		cfg:           cfg,
+		loaded:        loaded,
+		role:          cfg.Role,
+		walletAddress: cfg.WalletAddress,
 	}
 	api, err := coreapi.NewCoreAPI(node, options.Api.FetchBlocks(true))
 	if err != nil {
-		log.Errorf("")
-		return
+		cancel()
+		return err
 	}
-	miner.handler = NewV1Handler(api, miner)
+	handler := NewV1Handler(api, miner, node.Repo.Datastore(), fetchOptions(cfg))
+	handler.setLimits(limitsFromConfig(cfg.Limits))
+	if err := handler.Start(mctx); err != nil {
+		cancel()
+		return err
+	}
+	miner.handler = handler
+	if err := miner.subscribe(); err != nil {
+		cancel()
+		return err
+	}
+	node.Miner = miner
+
+	node.PeerHost.SetStreamHandler(proto.V1ProtocolID, miner.handleStream)
+	if node.ShutdownHooks != nil {
+		node.ShutdownHooks.Append(func(context.Context) error {
+			return miner.Close()
+		})
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := miner.Close(); err != nil {
+				log.Errorf("failed to close miner: %v", err)
+			}
+		case <-mctx.Done():
+		}
+	}()
 
-	go miner.Run(ctx)
+	go miner.Run(mctx)
+	return nil
+}
+
+func fetchOptions(cfg minerconfig.Miner) FetchOptions {
+	return FetchOptions{
+		Workers:       cfg.Workers(),
+		PrefetchBatch: cfg.Batch(),
+		ExportDir:     cfg.ExportDir,
+	}
 }
 
 type Miner struct {
-	node          *core.IpfsNode
-	walletAddress string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	node    *core.IpfsNode
+	topics  string
+	handler *V1Handler
+
+	// unsubscribe stops reading the internal topic.
+	unsubscribe context.CancelFunc
+	// inflight counts the requests being handled. No request is added
+	// once closing is set.
+	inflight  sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+	// seqLk serializes incrementing the heartbeat sequence number.
+	seqLk sync.Mutex
+
+	lk sync.Mutex
+	// cfg is the config in effect and loaded the config last read from
+	// the repo. Changes to loaded are applied to cfg on reload.
+	cfg           minerconfig.Miner
+	loaded        minerconfig.Miner
 	role          int
-	handler       MessageHandler
+	walletAddress string
+	lastHeartbeat time.Time
+	closing       bool
 }
 
 func (m *Miner) Run(ctx context.Context) {
-	m.subscribe()
 	m.heartbeat(ctx)
 
-	ticker := time.NewTicker(time.Minute * 10)
-	defer ticker.Stop()
+	interval := m.heartbeatInterval()
+	ticker := time.NewTicker(interval)
+	defer func() {
+		ticker.Stop()
+	}()
+	reload := time.NewTicker(configPollInterval)
+	defer reload.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
 			m.heartbeat(ctx)
+		case <-reload.C:
+			m.reloadConfig()
+			if d := m.heartbeatInterval(); d != interval {
+				ticker.Stop()
+				interval = d
+				ticker = time.NewTicker(interval)
+			}
 		}
 	}
 }
 
+func (m *Miner) heartbeatInterval() time.Duration {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.cfg.Heartbeat()
+}
+
+// reloadConfig applies changes of the Miner config made since the last
+// reload. Fields that need a restart keep their running value.
+func (m *Miner) reloadConfig() {
+	updated, err := minerconfig.Load(m.node.Repo)
+	if err != nil {
+		log.Errorf("failed to load config: %v", err)
+		return
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if reflect.DeepEqual(updated, m.loaded) {
+		return
+	}
+	m.loaded = updated
+	if err := updated.Validate(); err != nil {
+		log.Errorf("ignoring invalid %s config: %v", minerconfig.Key, err)
+		return
+	}
+	if m.cfg.NeedsRestart(updated) {
+		log.Warnf("changes to %s.Enabled, TopicPrefix and FetchWorkers take effect after a restart", minerconfig.Key)
+		updated.Enabled = m.cfg.Enabled
+		updated.TopicPrefix = m.cfg.TopicPrefix
+		updated.FetchWorkers = m.cfg.FetchWorkers
+	}
+	if updated.Role != m.cfg.Role {
+		m.role = updated.Role
+	}
+	if !reflect.DeepEqual(updated.Limits, m.cfg.Limits) {
+		m.handler.setLimits(limitsFromConfig(updated.Limits))
+	}
+	m.walletAddress = updated.WalletAddress
+	m.cfg = updated
+	m.handler.setOptions(fetchOptions(updated))
+	log.Infof("reloaded %s config", minerconfig.Key)
+}
+
+// subscribe accepts requests published on the internal topic from requesters
+// that have not moved to proto.V1ProtocolID streams. Responses are always sent
+// over streams.
 func (m *Miner) subscribe() error {
-	topic, err := m.node.PubSub.Join(proto.V1InternalTopic(m.node.Identity.String()))
+	topic, err := m.node.PubSub.Join(proto.InternalTopic(m.topics, m.node.Identity.String()))
 	if err != nil {
 		log.Errorf("failed to create sub topic: %v", err)
 		return err
@@ -60,20 +204,32 @@ func (m *Miner) subscribe() error {
 	sub, err := topic.Subscribe()
 	if err != nil {
 		log.Errorf("failed to subscribe: %v", err)
+		topic.Close()
 		return err
 	}
-	log.Infof("subscribe: %v", proto.V1InternalTopic(m.node.Identity.String()))
+	log.Infof("subscribe: %v", proto.InternalTopic(m.topics, m.node.Identity.String()))
 
+	ctx, cancel := context.WithCancel(m.ctx)
+	m.unsubscribe = cancel
 	go func() {
+		defer topic.Close()
+		defer sub.Cancel()
 		for {
-			pmsg, err := sub.Next(context.Background())
+			pmsg, err := sub.Next(ctx)
 			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
 				log.Errorf("failed get message: %v", err)
 				time.Sleep(time.Second)
 				continue
 			}
+			if !m.track() {
+				return
+			}
 			log.Infof("received message from %v: %v", pmsg.ReceivedFrom.String(), pmsg.String())
 			go func() {
+				defer m.inflight.Done()
 				defer func() {
 					if err := recover(); err != nil {
 						log.Errorf("%v", string(debug.Stack()))
@@ -84,7 +240,7 @@ func (m *Miner) subscribe() error {
 					log.Errorf("failed to decode message: %v", err)
 					return
 				}
-				err = m.handler.Handle(context.TODO(), pmsg.ReceivedFrom, &msg)
+				err = handleMessage(m.ctx, m.handler, pmsg.ReceivedFrom, &msg, transportPubSub)
 				if err != nil {
 					log.Errorf("failed to handler message: %v", err)
 				}
@@ -94,7 +250,78 @@ func (m *Miner) subscribe() error {
 	return nil
 }
 
+// track counts a request as in flight. It returns false once the miner is
+// closing, in which case the request must be dropped.
+func (m *Miner) track() bool {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if m.closing {
+		return false
+	}
+	m.inflight.Add(1)
+	return true
+}
+
+// Close stops the miner. It stops accepting requests, waits up to
+// closeTimeout for the requests being handled, persists unfinished fetch jobs
+// so that they resume on the next start, and publishes a heartbeat announcing
+// that the miner goes offline.
+func (m *Miner) Close() error {
+	m.closeOnce.Do(func() {
+		m.closeErr = m.close()
+	})
+	return m.closeErr
+}
+
+func (m *Miner) close() error {
+	m.lk.Lock()
+	m.closing = true
+	m.lk.Unlock()
+	log.Info("stopping miner")
+
+	m.node.PeerHost.RemoveStreamHandler(proto.V1ProtocolID)
+	m.unsubscribe()
+
+	// Requests still running after the timeout are canceled below.
+	drained := make(chan struct{})
+	go func() {
+		m.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(closeTimeout):
+		log.Warnf("canceling requests still running after %v", closeTimeout)
+	}
+
+	var errs error
+	if err := closeStep(m.handler.jobs.Close); err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("failed to persist fetch jobs: %w", err))
+	}
+	err := closeStep(func(ctx context.Context) error {
+		return m.publishHeartbeat(ctx, true)
+	})
+	if err != nil {
+		errs = multierror.Append(errs, fmt.Errorf("failed to announce going offline: %w", err))
+	}
+	m.cancel()
+	return errs
+}
+
+// closeStep runs a step of stopping the miner in a fresh context bounded by
+// closeTimeout.
+func closeStep(step func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	return step(ctx)
+}
+
 func (m *Miner) PublishMessage(ctx context.Context, topic string, msg *proto.Message) error {
+	err := msg.Sign(m.node.PrivateKey)
+	if err != nil {
+		log.Errorf("failed to sign message: %v", err)
+		return err
+	}
 	data, err := msg.EncodeMessage()
 	if err != nil {
 		log.Errorf("failed to encode message: %v", err)
@@ -111,20 +338,5 @@ func (m *Miner) PublishMessage(ctx context.Context, topic string, msg *proto.Mes
 	if err != nil {
 		log.Errorf("failed publish message: %v", err)
 	}
-	return nil
-}
-
-func (m *Miner) heartbeat(ctx context.Context) error {
-	msgResp := proto.Message{
-		Type: proto.MsgMinerHeartBeat,
-		Data: proto.MinerHartBeat{
-			Role: m.role,
-		},
-	}
-	err := m.PublishMessage(ctx, proto.V1MinerHeartBeatTopic(), &msgResp)
-	if err != nil {
-		log.Errorf("failed to publish:%v", err.Error())
-		return err
-	}
-	return nil
+	return err
 }
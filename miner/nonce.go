@@ -0,0 +1,73 @@
+package miner
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ErrTooManyNonces is returned when a sender has more unexpired nonces than
+// the cache keeps for a single peer.
+var ErrTooManyNonces = errors.New("too many requests from peer within the message age window")
+
+// nonceCache remembers the nonces of each sender until the messages carrying
+// them are too old to be accepted, so that a nonce is never forgotten while
+// it could still be replayed. Each sender may have at most perSender
+// unexpired nonces, so no peer can make the cache forget the nonces of
+// another.
+type nonceCache struct {
+	lk        sync.Mutex
+	perSender int
+	seen      map[peer.ID]map[string]time.Time
+	lastPrune time.Time
+}
+
+func newNonceCache(perSender int) *nonceCache {
+	return &nonceCache{
+		perSender: perSender,
+		seen:      make(map[peer.ID]map[string]time.Time),
+	}
+}
+
+// Add records the nonce of a message from sender that stops being accepted
+// at expires. It returns ErrReplayedMessage for a nonce already seen and
+// ErrTooManyNonces when sender has perSender unexpired nonces.
+func (c *nonceCache) Add(sender peer.ID, nonce string, expires, now time.Time) error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if now.Sub(c.lastPrune) > time.Minute {
+		for p, nonces := range c.seen {
+			if pruneNonces(nonces, now) == 0 {
+				delete(c.seen, p)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	nonces, ok := c.seen[sender]
+	if !ok {
+		nonces = make(map[string]time.Time)
+		c.seen[sender] = nonces
+	}
+	if exp, ok := nonces[nonce]; ok && now.Before(exp) {
+		return ErrReplayedMessage
+	}
+	if len(nonces) >= c.perSender && pruneNonces(nonces, now) >= c.perSender {
+		return ErrTooManyNonces
+	}
+	nonces[nonce] = expires
+	return nil
+}
+
+// pruneNonces removes the expired nonces and returns how many remain.
+func pruneNonces(nonces map[string]time.Time, now time.Time) int {
+	for n, exp := range nonces {
+		if !now.Before(exp) {
+			delete(nonces, n)
+		}
+	}
+	return len(nonces)
+}
@@ -0,0 +1,45 @@
+package miner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestNonceCache(t *testing.T) {
+	c := newNonceCache(2)
+	now := time.Now()
+	expires := now.Add(maxMessageAge)
+	a, b := peer.ID("a"), peer.ID("b")
+
+	if err := c.Add(a, "1", expires, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add(a, "1", expires, now); err != ErrReplayedMessage {
+		t.Fatalf("expected ErrReplayedMessage, got %v", err)
+	}
+	if err := c.Add(a, "2", expires, now); err != nil {
+		t.Fatal(err)
+	}
+	// A full sender is refused instead of forgetting its nonces.
+	if err := c.Add(a, "3", expires, now); err != ErrTooManyNonces {
+		t.Fatalf("expected ErrTooManyNonces, got %v", err)
+	}
+	if err := c.Add(a, "1", expires, now); err != ErrReplayedMessage {
+		t.Fatalf("expected ErrReplayedMessage, got %v", err)
+	}
+	// Other senders are not affected.
+	if err := c.Add(b, "1", expires, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nonces are forgotten once their messages are stale.
+	later := expires.Add(time.Second)
+	if err := c.Add(a, "3", later.Add(maxMessageAge), later); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add(a, "1", later.Add(maxMessageAge), later); err != nil {
+		t.Fatal(err)
+	}
+}
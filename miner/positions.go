@@ -0,0 +1,204 @@
+package miner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+)
+
+// readConcurrency bounds the number of challenged files read at once.
+const readConcurrency = 8
+
+// PositionError is the failure to read a single position.
+type PositionError struct {
+	Position int64
+	Err      error
+}
+
+func (e *PositionError) Error() string {
+	return fmt.Sprintf("position %d: %v", e.Position, e.Err)
+}
+
+func (e *PositionError) Unwrap() error {
+	return e.Err
+}
+
+// PositionErrors lists the positions of a file that could not be read.
+type PositionErrors []*PositionError
+
+func (e PositionErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, pe := range e {
+		msgs[i] = pe.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Is reports whether any position failed with target.
+func (e PositionErrors) Is(target error) bool {
+	for _, pe := range e {
+		if errors.Is(pe.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Positions returns the positions that could not be read.
+func (e PositionErrors) Positions() []int64 {
+	out := make([]int64, len(e))
+	for i, pe := range e {
+		out[i] = pe.Position
+	}
+	return out
+}
+
+// positionRead is a position to read and the index of its byte in the
+// result.
+type positionRead struct {
+	index int
+	pos   int64
+}
+
+// readPositions returns the bytes of the UnixFS file root at positions.
+// Positions are sorted and resolved to leaf blocks through the block sizes
+// of the file nodes, so that every block is fetched once. If some positions
+// can not be read, their bytes are left zero and the error is a
+// PositionErrors listing them.
+func readPositions(ctx context.Context, ng ipld.NodeGetter, root cid.Cid, positions []int64) ([]byte, error) {
+	reads := make([]positionRead, len(positions))
+	for i, pos := range positions {
+		reads[i] = positionRead{index: i, pos: pos}
+	}
+	sort.Slice(reads, func(i, j int) bool {
+		return reads[i].pos < reads[j].pos
+	})
+
+	r := &positionReader{ng: ng, data: make([]byte, len(positions))}
+	// Negative positions sort first.
+	n := sort.Search(len(reads), func(i int) bool { return reads[i].pos >= 0 })
+	r.fail(reads[:n], ErrOutOfRange)
+	r.read(ctx, root, 0, reads[n:], true)
+
+	if len(r.errs) > 0 {
+		sort.Slice(r.errs, func(i, j int) bool {
+			return r.errs[i].Position < r.errs[j].Position
+		})
+		return r.data, r.errs
+	}
+	return r.data, nil
+}
+
+type positionReader struct {
+	ng   ipld.NodeGetter
+	data []byte
+	errs PositionErrors
+}
+
+func (r *positionReader) fail(reads []positionRead, err error) {
+	for _, pr := range reads {
+		r.errs = append(r.errs, &PositionError{Position: pr.pos, Err: err})
+	}
+}
+
+// read fills the bytes of reads, which are sorted and lie in the node c
+// starting at file offset base.
+func (r *positionReader) read(ctx context.Context, c cid.Cid, base int64, reads []positionRead, isRoot bool) {
+	nd, err := r.ng.Get(ctx, c)
+	if err != nil {
+		r.fail(reads, err)
+		return
+	}
+
+	var data []byte
+	var pn *merkledag.ProtoNode
+	var fsn *unixfs.FSNode
+	switch n := nd.(type) {
+	case *merkledag.RawNode:
+		data = n.RawData()
+	case *merkledag.ProtoNode:
+		fsn, err = unixfs.FSNodeFromBytes(n.Data())
+		if err != nil {
+			r.fail(reads, err)
+			return
+		}
+		if fsn.Type() != unixfs.TFile && fsn.Type() != unixfs.TRaw {
+			r.fail(reads, ErrUnsupportedBlock)
+			return
+		}
+		if fsn.NumChildren() != len(n.Links()) {
+			r.fail(reads, ErrUnsupportedBlock)
+			return
+		}
+		if isRoot {
+			end := sort.Search(len(reads), func(i int) bool {
+				return uint64(reads[i].pos) >= fsn.FileSize()
+			})
+			r.fail(reads[end:], ErrOutOfRange)
+			reads = reads[:end]
+		}
+		data = fsn.Data()
+		pn = n
+	default:
+		r.fail(reads, ErrUnsupportedBlock)
+		return
+	}
+
+	// Positions in the node's own data.
+	i := 0
+	for ; i < len(reads) && reads[i].pos-base < int64(len(data)); i++ {
+		r.data[reads[i].index] = data[reads[i].pos-base]
+	}
+	reads = reads[i:]
+	if len(reads) == 0 {
+		return
+	}
+	if pn == nil {
+		r.fail(reads, ErrOutOfRange)
+		return
+	}
+
+	// Positions in children, each child read once for all of its
+	// positions.
+	start := base + int64(len(data))
+	for j, link := range pn.Links() {
+		end := start + int64(fsn.BlockSize(j))
+		n := sort.Search(len(reads), func(i int) bool { return reads[i].pos >= end })
+		if n > 0 {
+			r.read(ctx, link.Cid, start, reads[:n], false)
+			reads = reads[n:]
+		}
+		if len(reads) == 0 {
+			return
+		}
+		start = end
+	}
+	r.fail(reads, ErrOutOfRange)
+}
+
+// forEachLimited calls f for every index below n, running at most limit
+// calls at once.
+func forEachLimited(n, limit int, f func(i int)) {
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,94 @@
+package miner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	ipld "github.com/ipfs/go-ipld-format"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	"github.com/ipfs/go-unixfs/importer"
+)
+
+// countingGetter counts the fetches of every block.
+type countingGetter struct {
+	ipld.NodeGetter
+	lk   sync.Mutex
+	gets map[cid.Cid]int
+}
+
+func (g *countingGetter) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	g.lk.Lock()
+	g.gets[c]++
+	g.lk.Unlock()
+	return g.NodeGetter.Get(ctx, c)
+}
+
+func TestReadPositions(t *testing.T) {
+	ctx := context.Background()
+	dserv := mdtest.Mock()
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(3)).Read(data)
+	root, err := importer.BuildDagFromReader(dserv, chunker.NewSizeSplitter(bytes.NewReader(data), 512))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	positions := make([]int64, 2000)
+	rng := rand.New(rand.NewSource(4))
+	for i := range positions {
+		positions[i] = rng.Int63n(int64(len(data)))
+	}
+	positions = append(positions, 0, positions[0], int64(len(data)-1))
+
+	ng := &countingGetter{NodeGetter: dserv, gets: make(map[cid.Cid]int)}
+	got, err := readPositions(ctx, ng, root.Cid(), positions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, pos := range positions {
+		if got[i] != data[pos] {
+			t.Fatalf("position %d: got %x, want %x", pos, got[i], data[pos])
+		}
+	}
+	for c, n := range ng.gets {
+		if n != 1 {
+			t.Errorf("block %v fetched %d times", c, n)
+		}
+	}
+}
+
+func TestReadPositionsErrors(t *testing.T) {
+	ctx := context.Background()
+	dserv := mdtest.Mock()
+
+	data := make([]byte, 8*1024)
+	rand.New(rand.NewSource(5)).Read(data)
+	root, err := importer.BuildDagFromReader(dserv, chunker.NewSizeSplitter(bytes.NewReader(data), 512))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	positions := []int64{10, int64(len(data)), -1, 20}
+	got, err := readPositions(ctx, dserv, root.Cid(), positions)
+	var perr PositionErrors
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected PositionErrors, got %v", err)
+	}
+	if !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("expected ErrOutOfRange, got %v", err)
+	}
+	failed := perr.Positions()
+	if len(failed) != 2 || failed[0] != -1 || failed[1] != int64(len(data)) {
+		t.Errorf("unexpected failed positions: %v", failed)
+	}
+	if got[0] != data[10] || got[3] != data[20] {
+		t.Error("readable positions should still be read")
+	}
+}
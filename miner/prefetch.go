@@ -0,0 +1,47 @@
+package miner
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	minerconfig "github.com/ipfs/go-ipfs/miner/config"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// prefetch walks the DAG under root breadth first, requesting up to batch
+// blocks at a time, until every block is in the local blockstore. progress is
+// called with the total size of the blocks fetched so far.
+func prefetch(ctx context.Context, ng ipld.NodeGetter, root cid.Cid, batch int, progress func(uint64)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if batch <= 0 {
+		batch = minerconfig.DefaultPrefetchBatch
+	}
+
+	seen := cid.NewSet()
+	seen.Add(root)
+	queue := []cid.Cid{root}
+	var fetched uint64
+	for len(queue) > 0 {
+		n := batch
+		if n > len(queue) {
+			n = len(queue)
+		}
+		cids := queue[:n]
+		queue = queue[n:]
+
+		for opt := range ng.GetMany(ctx, cids) {
+			if opt.Err != nil {
+				return opt.Err
+			}
+			fetched += uint64(len(opt.Node.RawData()))
+			progress(fetched)
+			for _, l := range opt.Node.Links() {
+				if seen.Visit(l.Cid) {
+					queue = append(queue, l.Cid)
+				}
+			}
+		}
+	}
+	return nil
+}
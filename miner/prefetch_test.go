@@ -0,0 +1,59 @@
+package miner
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	ipld "github.com/ipfs/go-ipld-format"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	"github.com/ipfs/go-unixfs/importer"
+)
+
+func TestPrefetch(t *testing.T) {
+	ctx := context.Background()
+	dserv := mdtest.Mock()
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	root, err := importer.BuildDagFromReader(dserv, chunker.NewSizeSplitter(bytes.NewReader(data), 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var total uint64
+	var blocks int
+	var walk func(nd ipld.Node) error
+	walk = func(nd ipld.Node) error {
+		total += uint64(len(nd.RawData()))
+		blocks++
+		for _, l := range nd.Links() {
+			child, err := dserv.Get(ctx, l.Cid)
+			if err != nil {
+				return err
+			}
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(root); err != nil {
+		t.Fatal(err)
+	}
+
+	var fetched uint64
+	calls := 0
+	err = prefetch(ctx, dserv, root.Cid(), 8, func(n uint64) {
+		fetched = n
+		calls++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched != total || calls != blocks {
+		t.Errorf("fetched %d bytes in %d blocks, want %d bytes in %d blocks", fetched, calls, total, blocks)
+	}
+}
@@ -0,0 +1,170 @@
+package miner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipfs/miner/proto"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+)
+
+var (
+	ErrOutOfRange       = errors.New("position out of range")
+	ErrProofMismatch    = errors.New("proof block does not match expected cid")
+	ErrProofTruncated   = errors.New("proof does not reach a leaf")
+	ErrProofTooLong     = errors.New("proof has blocks after the leaf")
+	ErrUnsupportedBlock = errors.New("unsupported block type in proof")
+)
+
+// ProvePositions builds a Merkle proof for each position of the file rooted
+// at root, fetching the blocks on each path through ng.
+func ProvePositions(ctx context.Context, ng ipld.NodeGetter, root cid.Cid, positions []int64) ([]proto.PositionProof, error) {
+	proofs := make([]proto.PositionProof, len(positions))
+	for i, pos := range positions {
+		proof, err := provePosition(ctx, ng, root, pos)
+		if err != nil {
+			return nil, fmt.Errorf("position %d: %w", pos, err)
+		}
+		proofs[i] = proof
+	}
+	return proofs, nil
+}
+
+func provePosition(ctx context.Context, ng ipld.NodeGetter, root cid.Cid, pos int64) (proto.PositionProof, error) {
+	proof := proto.PositionProof{Position: pos}
+	if pos < 0 {
+		return proof, ErrOutOfRange
+	}
+	c, offset := root, pos
+	for depth := 0; ; depth++ {
+		nd, err := ng.Get(ctx, c)
+		if err != nil {
+			return proof, err
+		}
+		proof.Blocks = append(proof.Blocks, nd.RawData())
+
+		switch n := nd.(type) {
+		case *merkledag.RawNode:
+			if offset >= int64(len(n.RawData())) {
+				return proof, ErrOutOfRange
+			}
+			return proof, nil
+		case *merkledag.ProtoNode:
+			next, rest, leaf, err := stepProtoNode(n, offset, depth == 0)
+			if err != nil {
+				return proof, err
+			}
+			if leaf {
+				return proof, nil
+			}
+			c, offset = next, rest
+		default:
+			return proof, ErrUnsupportedBlock
+		}
+	}
+}
+
+// VerifyPositionProof checks proof against the file root CID alone and
+// returns the proven byte.
+func VerifyPositionProof(root cid.Cid, proof proto.PositionProof) (byte, error) {
+	if proof.Position < 0 {
+		return 0, ErrOutOfRange
+	}
+	expected, offset := root, proof.Position
+	for i, raw := range proof.Blocks {
+		c, err := expected.Prefix().Sum(raw)
+		if err != nil {
+			return 0, err
+		}
+		if !c.Equals(expected) {
+			return 0, ErrProofMismatch
+		}
+		last := i == len(proof.Blocks)-1
+
+		switch expected.Type() {
+		case cid.Raw:
+			if offset >= int64(len(raw)) {
+				return 0, ErrOutOfRange
+			}
+			if !last {
+				return 0, ErrProofTooLong
+			}
+			return raw[offset], nil
+		case cid.DagProtobuf:
+			pn, err := merkledag.DecodeProtobuf(raw)
+			if err != nil {
+				return 0, err
+			}
+			next, rest, leaf, err := stepProtoNode(pn, offset, i == 0)
+			if err != nil {
+				return 0, err
+			}
+			if leaf {
+				if !last {
+					return 0, ErrProofTooLong
+				}
+				fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+				if err != nil {
+					return 0, err
+				}
+				return fsn.Data()[offset], nil
+			}
+			expected, offset = next, rest
+		default:
+			return 0, ErrUnsupportedBlock
+		}
+	}
+	return 0, ErrProofTruncated
+}
+
+// VerifyWindowPostProof verifies every proof of item and returns the proven
+// bytes in the order of item.Proofs.
+func VerifyWindowPostProof(item proto.WindowPostProofRespItem) ([]byte, error) {
+	data := make([]byte, len(item.Proofs))
+	for i, proof := range item.Proofs {
+		b, err := VerifyPositionProof(item.FileCid, proof)
+		if err != nil {
+			return nil, fmt.Errorf("position %d: %w", proof.Position, err)
+		}
+		data[i] = b
+	}
+	return data, nil
+}
+
+// stepProtoNode locates offset inside a UnixFS file node. If the offset lies
+// in the node's own data, leaf is true. Otherwise it returns the child CID
+// holding the offset and the offset relative to that child.
+func stepProtoNode(pn *merkledag.ProtoNode, offset int64, isRoot bool) (next cid.Cid, rest int64, leaf bool, err error) {
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return cid.Undef, 0, false, err
+	}
+	if fsn.Type() != unixfs.TFile && fsn.Type() != unixfs.TRaw {
+		return cid.Undef, 0, false, ErrUnsupportedBlock
+	}
+	if isRoot && uint64(offset) >= fsn.FileSize() {
+		return cid.Undef, 0, false, ErrOutOfRange
+	}
+	data := int64(len(fsn.Data()))
+	if offset < data {
+		return cid.Undef, 0, true, nil
+	}
+	offset -= data
+
+	links := pn.Links()
+	if fsn.NumChildren() != len(links) {
+		return cid.Undef, 0, false, ErrUnsupportedBlock
+	}
+	for i := range links {
+		bs := int64(fsn.BlockSize(i))
+		if offset < bs {
+			return links[i].Cid, offset, false, nil
+		}
+		offset -= bs
+	}
+	return cid.Undef, 0, false, ErrOutOfRange
+}
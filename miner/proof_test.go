@@ -0,0 +1,58 @@
+package miner
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	"github.com/ipfs/go-ipfs/miner/proto"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	"github.com/ipfs/go-unixfs/importer"
+)
+
+func TestProveAndVerifyPositions(t *testing.T) {
+	ctx := context.Background()
+	dserv := mdtest.Mock()
+
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	root, err := importer.BuildDagFromReader(dserv, chunker.NewSizeSplitter(bytes.NewReader(data), 512))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	positions := []int64{0, 1, 511, 512, 40000, int64(len(data) - 1)}
+	proofs, err := ProvePositions(ctx, dserv, root.Cid(), positions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := VerifyWindowPostProof(proto.WindowPostProofRespItem{FileCid: root.Cid(), Proofs: proofs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, pos := range positions {
+		if got[i] != data[pos] {
+			t.Errorf("position %d: got %x, want %x", pos, got[i], data[pos])
+		}
+	}
+
+	if _, err := ProvePositions(ctx, dserv, root.Cid(), []int64{int64(len(data))}); err == nil {
+		t.Error("expected out of range error")
+	}
+
+	tampered := proofs[0]
+	leaf := append([]byte{}, tampered.Blocks[len(tampered.Blocks)-1]...)
+	leaf[len(leaf)-1] ^= 0xff
+	tampered.Blocks = append(append([][]byte{}, tampered.Blocks[:len(tampered.Blocks)-1]...), leaf)
+	if _, err := VerifyPositionProof(root.Cid(), tampered); err == nil {
+		t.Error("expected tampered proof to fail")
+	}
+
+	truncated := proto.PositionProof{Position: proofs[0].Position, Blocks: proofs[0].Blocks[:1]}
+	if _, err := VerifyPositionProof(root.Cid(), truncated); err != ErrProofTruncated {
+		t.Errorf("expected ErrProofTruncated, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package miner
+
+import (
+	"sync"
+
+	minerapi "github.com/ipfs/go-ipfs/miner/api"
+)
+
+// proofLogSize bounds the number of remembered WindowPost answers.
+const proofLogSize = 128
+
+// proofLog keeps the most recently answered WindowPost challenges.
+type proofLog struct {
+	lk      sync.Mutex
+	entries []minerapi.Proof
+	next    int
+}
+
+func newProofLog(size int) *proofLog {
+	return &proofLog{entries: make([]minerapi.Proof, 0, size)}
+}
+
+func (l *proofLog) Add(p minerapi.Proof) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, p)
+		return
+	}
+	l.entries[l.next] = p
+	l.next = (l.next + 1) % len(l.entries)
+}
+
+// List returns the entries oldest first.
+func (l *proofLog) List() []minerapi.Proof {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	out := make([]minerapi.Proof, 0, len(l.entries))
+	out = append(out, l.entries[l.next:]...)
+	return append(out, l.entries[:l.next]...)
+}
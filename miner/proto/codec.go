@@ -0,0 +1,206 @@
+package proto
+
+import (
+	"encoding/gob"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+)
+
+// Wire versions. The version selects the encoding of a message on the wire
+// and a miner always answers in the version of the request.
+const (
+	// WireVersionGob is the legacy base64 wrapped gob encoding.
+	WireVersionGob = 1
+	// WireVersionCBOR is a single version byte followed by a DAG-CBOR
+	// Envelope.
+	WireVersionCBOR = 2
+)
+
+// Envelope is the DAG-CBOR form of a Message. Its IPLD schema is:
+//
+//	type Envelope struct {
+//		Version   Int
+//		Type      String
+//		Nonce     String
+//		Timestamp Int
+//		PubKey    Bytes
+//		Signature Bytes
+//		Payload   Bytes
+//	}
+//
+// The keys of the envelope and payload maps are the field names with their
+// first letter lowercased, such as "pubKey". Type discriminates Payload,
+// which holds the DAG-CBOR encoding of the
+// struct registered for that type with RegisterPayload. The signature covers
+// the DAG-CBOR array [Version, Type, Nonce, Timestamp, PubKey, Payload], so
+// that it does not depend on the order of the keys of the envelope.
+type Envelope struct {
+	Version   int
+	Type      string
+	Nonce     string
+	Timestamp int64
+	PubKey    []byte
+	Signature []byte
+	Payload   []byte
+}
+
+var (
+	payloadLk    sync.RWMutex
+	payloadTypes = make(map[string]reflect.Type)
+)
+
+// RegisterPayload binds the message type msgType to the payload struct of v
+// and registers v with both the gob and the DAG-CBOR codecs. Nested structs
+// used by v must be registered with RegisterType.
+func RegisterPayload(msgType string, v interface{}) {
+	payloadLk.Lock()
+	defer payloadLk.Unlock()
+	payloadTypes[msgType] = reflect.TypeOf(v)
+	registerType(v)
+}
+
+// PayloadRegistered reports whether a payload struct is registered for
+// msgType.
+func PayloadRegistered(msgType string) bool {
+	payloadLk.RLock()
+	defer payloadLk.RUnlock()
+	_, ok := payloadTypes[msgType]
+	return ok
+}
+
+// RegisterType registers a struct used inside a payload with the codecs.
+func RegisterType(v interface{}) {
+	payloadLk.Lock()
+	defer payloadLk.Unlock()
+	registerType(v)
+}
+
+func registerType(v interface{}) {
+	gob.Register(v)
+	cbor.RegisterCborType(v)
+}
+
+func init() {
+	cbor.RegisterCborType(Envelope{})
+
+	RegisterType(WindowPostReqItem{})
+	RegisterType(WindowPostRespItem{})
+	RegisterType(PositionProof{})
+	RegisterType(WindowPostProofRespItem{})
+
+	RegisterPayload(MsgFetchFile, FetchFileReq{})
+	RegisterPayload(MsgFetchFileResponse, FetchFileResp{})
+	RegisterPayload(MsgFetchFileProgress, FetchFileProgress{})
+	RegisterPayload(MsgWindowPost, WindowPostReq{})
+	RegisterPayload(MsgWindowPostResponse, WindowPostResp{})
+	RegisterPayload(MsgWindowPostProof, WindowPostProofReq{})
+	RegisterPayload(MsgWindowPostProofResponse, WindowPostProofResp{})
+	RegisterPayload(MsgReleaseFile, ReleaseFileReq{})
+	RegisterPayload(MsgReleaseFileResponse, ReleaseFileResp{})
+	RegisterPayload(MsgRenewFile, RenewFileReq{})
+	RegisterPayload(MsgRenewFileResponse, RenewFileResp{})
+	RegisterPayload(MsgMinerHeartBeat, MinerHartBeat{})
+}
+
+func (m Message) toEnvelope() (Envelope, error) {
+	payload, err := cbor.DumpObject(m.Data)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		Version:   WireVersionCBOR,
+		Type:      m.Type,
+		Nonce:     m.Nonce,
+		Timestamp: m.Timestamp,
+		PubKey:    m.PubKey,
+		Signature: m.Signature,
+		Payload:   payload,
+	}, nil
+}
+
+func (e Envelope) toMessage() (Message, error) {
+	payloadLk.RLock()
+	t, ok := payloadTypes[e.Type]
+	payloadLk.RUnlock()
+	if !ok {
+		return Message{}, fmt.Errorf("unknown message type: %s", e.Type)
+	}
+	data := reflect.New(t)
+	if err := cbor.DecodeInto(e.Payload, data.Interface()); err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:      e.Type,
+		Nonce:     e.Nonce,
+		Data:      data.Elem().Interface(),
+		Version:   WireVersionCBOR,
+		Timestamp: e.Timestamp,
+		PubKey:    e.PubKey,
+		Signature: e.Signature,
+		payload:   e.Payload,
+	}, nil
+}
+
+func encodeCBOR(m Message) ([]byte, error) {
+	env, err := m.toEnvelope()
+	if err != nil {
+		return nil, err
+	}
+	data, err := cbor.DumpObject(env)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{WireVersionCBOR}, data...), nil
+}
+
+func decodeCBOR(data []byte) (Message, error) {
+	var env Envelope
+	if err := cbor.DecodeInto(data[1:], &env); err != nil {
+		return Message{}, err
+	}
+	if env.Version != WireVersionCBOR {
+		return Message{}, fmt.Errorf("envelope version %d does not match wire version %d", env.Version, WireVersionCBOR)
+	}
+	return env.toMessage()
+}
+
+// cborSigningBytes returns the DAG-CBOR array of the envelope fields covered
+// by the signature of a WireVersionCBOR message.
+func cborSigningBytes(msgType, nonce string, timestamp int64, pubKey, payload []byte) []byte {
+	buf := cborHead(nil, 4, 6)
+	buf = cborHead(buf, 0, WireVersionCBOR)
+	buf = append(cborHead(buf, 3, uint64(len(msgType))), msgType...)
+	buf = append(cborHead(buf, 3, uint64(len(nonce))), nonce...)
+	if timestamp < 0 {
+		buf = cborHead(buf, 1, uint64(-1-timestamp))
+	} else {
+		buf = cborHead(buf, 0, uint64(timestamp))
+	}
+	buf = append(cborHead(buf, 2, uint64(len(pubKey))), pubKey...)
+	return append(cborHead(buf, 2, uint64(len(payload))), payload...)
+}
+
+// cborHead appends the shortest CBOR head of major type major and argument n
+// to buf.
+func cborHead(buf []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(buf, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return append(buf, major|25, byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		return append(buf, major|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	buf = append(buf, major|27)
+	for shift := 56; shift >= 0; shift -= 8 {
+		buf = append(buf, byte(n>>uint(shift)))
+	}
+	return buf
+}
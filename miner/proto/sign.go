@@ -0,0 +1,94 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"time"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var (
+	ErrUnsigned       = errors.New("message is not signed")
+	ErrBadSignature   = errors.New("invalid message signature")
+	ErrSignerMismatch = errors.New("message signer does not match sender")
+)
+
+// signingBytes returns the bytes covered by the signature, which depend on
+// the wire version so that non-Go peers never need to produce gob. For
+// WireVersionCBOR they are the DAG-CBOR array
+//
+//	[Version, Type, Nonce, Timestamp, PubKey, Payload]
+//
+// of the envelope fields, with Payload the payload bytes as carried in the
+// envelope. They never depend on how a peer orders the keys of a map, and
+// received messages are verified over the payload bytes they arrived with.
+func (m Message) signingBytes() ([]byte, error) {
+	if m.Version == WireVersionCBOR {
+		payload := m.payload
+		if payload == nil {
+			var err error
+			if payload, err = cbor.DumpObject(m.Data); err != nil {
+				return nil, err
+			}
+		}
+		return cborSigningBytes(m.Type, m.Nonce, m.Timestamp, m.PubKey, payload), nil
+	}
+	m.Signature = nil
+	m.Version = 0
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(m)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Sign stamps the message with the current time and signs it with key.
+func (m *Message) Sign(key crypto.PrivKey) error {
+	pub, err := crypto.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return err
+	}
+	m.Timestamp = time.Now().Unix()
+	m.PubKey = pub
+	m.Signature = nil
+	// Sign what Data holds now.
+	m.payload = nil
+
+	data, err := m.signingBytes()
+	if err != nil {
+		return err
+	}
+	m.Signature, err = key.Sign(data)
+	return err
+}
+
+// Verify checks that the message was signed by the identity key of from.
+func (m Message) Verify(from peer.ID) error {
+	if len(m.Signature) == 0 || len(m.PubKey) == 0 {
+		return ErrUnsigned
+	}
+	pub, err := crypto.UnmarshalPublicKey(m.PubKey)
+	if err != nil {
+		return err
+	}
+	if !from.MatchesPublicKey(pub) {
+		return ErrSignerMismatch
+	}
+	data, err := m.signingBytes()
+	if err != nil {
+		return err
+	}
+	ok, err := pub.Verify(data, m.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrBadSignature
+	}
+	return nil
+}
@@ -4,23 +4,74 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/gob"
+	"fmt"
 	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+const (
+	// V1ProtocolID is the libp2p protocol for point-to-point request/response
+	// messages. Pubsub is only used for broadcasts.
+	V1ProtocolID = protocol.ID("/ipfc/miner/1.0.0")
 )
 
 const (
 	V1                   = "v1"
 	MsgFetchFile         = "FetchFile"
 	MsgFetchFileResponse = "FetchFileResp"
+	MsgFetchFileProgress = "FetchFileProgress"
 
 	MsgWindowPost         = "WindowPost"
 	MsgWindowPostResponse = "WindowPostResp"
 
+	MsgWindowPostProof         = "WindowPostProof"
+	MsgWindowPostProofResponse = "WindowPostProofResp"
+
+	MsgReleaseFile         = "ReleaseFile"
+	MsgReleaseFileResponse = "ReleaseFileResp"
+	MsgRenewFile           = "RenewFile"
+	MsgRenewFileResponse   = "RenewFileResp"
+
 	MsgMinerHeartBeat = "MinerHeartBeat"
 )
 
 const (
 	StatusOK             = 0
 	StatusFetchFileError = 1
+	// StatusFetchFileCanceled is returned when the miner operator canceled
+	// the fetch job.
+	StatusFetchFileCanceled = 2
+	// StatusFileNotStored is returned when releasing or renewing a file
+	// the miner does not store.
+	StatusFileNotStored = 3
+	// StatusNotRequester is returned when a file is released or renewed
+	// by another peer than the one that assigned it.
+	StatusNotRequester = 4
+	// StatusInvalidDeadline is returned for a deadline in the past.
+	StatusInvalidDeadline = 5
+	// StatusReleaseError is returned when the file could not be unpinned.
+	StatusReleaseError = 6
+	// StatusFetchFilePartial is returned when blocks of the fetched DAG
+	// are still missing locally.
+	StatusFetchFilePartial = 7
+	// StatusFetchFileOversized is returned when the content is larger or
+	// has more blocks than the request expected.
+	StatusFetchFileOversized = 8
+	// StatusFetchFileCorrupt is returned when a block does not match its
+	// CID, or the content is smaller than the request expected.
+	StatusFetchFileCorrupt = 9
+	// StatusRateLimited is returned when the requester sent more requests
+	// than the miner accepts from a single peer.
+	StatusRateLimited = 10
+	// StatusFileTooLarge is returned when the file exceeds the largest
+	// file size the miner accepts.
+	StatusFileTooLarge = 11
+	// StatusQuotaExceeded is returned when storing the file would exceed
+	// the storage quota of the requester.
+	StatusQuotaExceeded = 12
+	// StatusNotAllowed is returned when the requester is not one of the
+	// inspectors the miner accepts requests from.
+	StatusNotAllowed = 13
 )
 
 type (
@@ -28,14 +79,71 @@ type (
 		Type  string
 		Nonce string
 		Data  interface{}
+
+		// Version is the wire version the message is encoded with. Zero
+		// means WireVersionGob.
+		Version int
+		// Timestamp is the unix time in seconds at which the message was signed.
+		Timestamp int64
+		// PubKey is the marshalled libp2p public key of the sender.
+		PubKey []byte
+		// Signature covers bytes that depend on the wire version: the gob
+		// encoding of the message with Signature unset for
+		// WireVersionGob, and the DAG-CBOR array [Version, Type, Nonce,
+		// Timestamp, PubKey, Payload] of the envelope fields, with Payload
+		// as carried in the envelope, for WireVersionCBOR.
+		Signature []byte
+
+		// payload is the payload of a message received in
+		// WireVersionCBOR, as it arrived.
+		payload []byte
 	}
 	FetchFileReq struct {
 		Cid cid.Cid
+		// Export asks the miner to also write the file to its configured
+		// export directory.
+		Export bool
+		// Deadline is the unix time in seconds until which the file must
+		// be stored. The miner unpins the file once it passes. Zero means
+		// no deadline.
+		Deadline int64
+		// ExpectedSize is the size of the file content and ExpectedBlocks
+		// the number of distinct blocks of the DAG. The miner checks the
+		// fetched content against them when they are not zero.
+		ExpectedSize   uint64
+		ExpectedBlocks uint64
 	}
 	FetchFileResp struct {
 		Cid    cid.Cid
 		Status int
 	}
+	// FetchFileProgress is sent to the requester while a FetchFile job is
+	// running. It carries the nonce of the request.
+	FetchFileProgress struct {
+		Cid          cid.Cid
+		BytesFetched uint64
+		Attempt      int
+	}
+	// ReleaseFileReq asks the miner to stop storing a file it was assigned
+	// by the sender.
+	ReleaseFileReq struct {
+		Cid cid.Cid
+	}
+	ReleaseFileResp struct {
+		Cid    cid.Cid
+		Status int
+	}
+	// RenewFileReq moves the storage deadline of a file assigned by the
+	// sender. A zero Deadline removes the deadline.
+	RenewFileReq struct {
+		Cid      cid.Cid
+		Deadline int64
+	}
+	RenewFileResp struct {
+		Cid      cid.Cid
+		Status   int
+		Deadline int64
+	}
 	WindowPostReqItem struct {
 		FileCid   cid.Cid
 		Positions []int64
@@ -48,26 +156,89 @@ type (
 		FileCid   cid.Cid
 		Positions []int64
 		Data      []byte
+		// Failed lists the positions that could not be read. Their
+		// bytes in Data are zero.
+		Failed []int64
 	}
 	WindowPostResp struct {
 		Items []WindowPostRespItem
 	}
 
+	WindowPostProofReq struct {
+		Items []WindowPostReqItem
+	}
+
+	// PositionProof proves possession of the byte at Position. Blocks holds
+	// the raw blocks on the path from the file root down to the leaf that
+	// contains Position, root first.
+	PositionProof struct {
+		Position int64
+		Blocks   [][]byte
+	}
+	WindowPostProofRespItem struct {
+		FileCid cid.Cid
+		Proofs  []PositionProof
+	}
+	WindowPostProofResp struct {
+		Items []WindowPostProofRespItem
+	}
+
 	MinerHartBeat struct {
 		Role int
+		// Seq increases with every heartbeat of a miner, across restarts,
+		// so that receivers can discard stale heartbeats.
+		Seq           uint64
+		Version       string
+		Addrs         []string
+		WalletAddress string
+
+		// RepoSize is the used repo space and StorageMax its limit, both in
+		// bytes. FreeSpace is zero when the repo has no limit.
+		RepoSize   uint64
+		StorageMax uint64
+		FreeSpace  uint64
+		// PinnedBytes is the size of the files pinned for FetchFile
+		// requests and PendingJobs the number of unfinished ones.
+		PinnedBytes uint64
+		PendingJobs int
+		// FreedBytes is the size of the files released or expired since
+		// the previous heartbeat. The space is reclaimed by the next
+		// garbage collection.
+		FreedBytes uint64
+		// Offline is set on the last heartbeat of a miner shutting down
+		// for planned maintenance. It is not challenged until its next
+		// heartbeat.
+		Offline bool
 	}
 )
 
 func init() {
 	gob.Register(Message{})
-	gob.Register(FetchFileReq{})
-	gob.Register(FetchFileResp{})
-	gob.Register(WindowPostReq{})
-	gob.Register(WindowPostResp{})
-	gob.Register(MinerHartBeat{})
 }
 
+// EncodeMessage encodes the message in the wire version set on it.
 func (m Message) EncodeMessage() ([]byte, error) {
+	switch m.Version {
+	case 0, WireVersionGob:
+		return encodeGob(m)
+	case WireVersionCBOR:
+		return encodeCBOR(m)
+	default:
+		return nil, fmt.Errorf("unsupported wire version: %d", m.Version)
+	}
+}
+
+// DecodeMessage decodes a message in any supported wire version. The
+// returned message carries the version it was received in.
+func DecodeMessage(data []byte) (Message, error) {
+	if len(data) > 0 && data[0] == WireVersionCBOR {
+		return decodeCBOR(data)
+	}
+	return decodeGob(data)
+}
+
+func encodeGob(m Message) ([]byte, error) {
+	m.Version = 0
 	var buffer bytes.Buffer
 	enc := gob.NewEncoder(&buffer)
 	err := enc.Encode(m)
@@ -77,7 +248,7 @@ func (m Message) EncodeMessage() ([]byte, error) {
 	return []byte(base64.RawStdEncoding.EncodeToString(buffer.Bytes())), nil
 }
 
-func DecodeMessage(data []byte) (Message, error) {
+func decodeGob(data []byte) (Message, error) {
 	rawData, err := base64.RawStdEncoding.DecodeString(string(data))
 	if err != nil {
 		return Message{}, err
@@ -88,21 +259,39 @@ func DecodeMessage(data []byte) (Message, error) {
 	if err != nil {
 		return Message{}, err
 	}
+	v.Version = WireVersionGob
 	return v, nil
 }
 
+// InternalTopic is the topic on which the miner id receives requests.
+func InternalTopic(prefix, id string) string {
+	return prefix + "/internal/" + id
+}
+
+func IpfcTopic(prefix, id string) string {
+	return prefix + "/ipfc/" + id
+}
+
+func InspectorTopic(prefix, id string) string {
+	return prefix + "/inspector/" + id
+}
+
+func MinerHeartBeatTopic(prefix string) string {
+	return prefix + "/miner/heartbeat"
+}
+
 func V1InternalTopic(id string) string {
-	return V1 + "/internal/" + id
+	return InternalTopic(V1, id)
 }
 
 func V1IpfcTopic(id string) string {
-	return V1 + "/ipfc/" + id
+	return IpfcTopic(V1, id)
 }
 
 func V1InspectorTopic(id string) string {
-	return V1 + "/inspector/" + id
+	return InspectorTopic(V1, id)
 }
 
 func V1MinerHeartBeatTopic() string {
-	return V1 + "/miner/heartbeat"
+	return MinerHeartBeatTopic(V1)
 }
@@ -3,6 +3,8 @@ package proto
 import (
 	"encoding/hex"
 	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"testing"
 )
 
@@ -55,3 +57,160 @@ func TestDecodeMessage2(t *testing.T) {
 	t.Logf("msg2: %+v", msg2)
 
 }
+
+func TestSignMessage(t *testing.T) {
+	priv, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := cid.Decode("bafybeickencdqw37dpz3ha36ewrh4undfjt2do52chtcky4rxkj447qhdm")
+	msg := Message{
+		Type:  MsgFetchFile,
+		Nonce: "cccc",
+		Data: FetchFileReq{
+			Cid: c,
+		},
+	}
+	if err := msg.Verify(id); err != ErrUnsigned {
+		t.Errorf("expected ErrUnsigned, got %v", err)
+	}
+	if err := msg.Sign(priv); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := msg.EncodeMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg2, err := DecodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg2.Verify(id); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+
+	other, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+	otherID, _ := peer.IDFromPrivateKey(other)
+	if err := msg2.Verify(otherID); err != ErrSignerMismatch {
+		t.Errorf("expected ErrSignerMismatch, got %v", err)
+	}
+
+	msg2.Nonce = "dddd"
+	if err := msg2.Verify(id); err != ErrBadSignature {
+		t.Errorf("expected ErrBadSignature, got %v", err)
+	}
+}
+
+func TestDecodeMessageCBOR(t *testing.T) {
+	priv, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := peer.IDFromPrivateKey(priv)
+	c, _ := cid.Decode("bafybeickencdqw37dpz3ha36ewrh4undfjt2do52chtcky4rxkj447qhdm")
+	msg := Message{
+		Type:    MsgWindowPost,
+		Nonce:   "eeee",
+		Version: WireVersionCBOR,
+		Data: WindowPostReq{
+			Items: []WindowPostReqItem{{FileCid: c, Positions: []int64{1, 2, 3}}},
+		},
+	}
+	if err := msg.Sign(priv); err != nil {
+		t.Fatal(err)
+	}
+	data, err := msg.EncodeMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != WireVersionCBOR {
+		t.Fatalf("unexpected version byte: %d", data[0])
+	}
+
+	msg2, err := DecodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg2.Version != WireVersionCBOR {
+		t.Errorf("expected version %d, got %d", WireVersionCBOR, msg2.Version)
+	}
+	req, ok := msg2.Data.(WindowPostReq)
+	if !ok {
+		t.Fatalf("data type error: %T", msg2.Data)
+	}
+	if len(req.Items) != 1 || !req.Items[0].FileCid.Equals(c) || len(req.Items[0].Positions) != 3 {
+		t.Errorf("unexpected payload: %+v", req)
+	}
+	if err := msg2.Verify(id); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+
+	gobMsg, err := DecodeMessage(mustEncode(t, Message{Type: MsgFetchFile, Nonce: "ffff", Data: FetchFileReq{Cid: c}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gobMsg.Version != WireVersionGob {
+		t.Errorf("expected version %d, got %d", WireVersionGob, gobMsg.Version)
+	}
+}
+
+func mustEncode(t *testing.T, msg Message) []byte {
+	data, err := msg.EncodeMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestVerifyCBORVector checks a message built by hand as another
+// implementation would, byte by byte, and signed over the array of envelope
+// fields. The key is the ed25519 key of the seed 0x00, 0x01, ..., 0x1f.
+func TestVerifyCBORVector(t *testing.T) {
+	const (
+		pubKey  = "0801122003a107bff3ce10be1d70dd18e74bc09967e4d6309ba50d5f1ddc8664125531b8"
+		signing = "86026b52656c6561736546696c6566766563746f721a6553f100582408011220" +
+			"03a107bff3ce10be1d70dd18e74bc09967e4d6309ba50d5f1ddc8664125531b8" +
+			"4da163636964d82a450001550000"
+		message = "02a764747970656b52656c6561736546696c65656e6f6e636566766563746f72" +
+			"667075624b657958240801122003a107bff3ce10be1d70dd18e74bc09967e4d6" +
+			"309ba50d5f1ddc8664125531b8677061796c6f61644da163636964d82a450001" +
+			"5500006776657273696f6e02697369676e617475726558407998a4755aa6f605" +
+			"82ff7d23310991b0a23e96c0d576e782eb48a55ce3c7b56d32c7c16c85d76e32" +
+			"6d3d22ff902ed50eef7b470d6e1212568f42efbce965ff036974696d65737461" +
+			"6d701a6553f100"
+	)
+	data, _ := hex.DecodeString(message)
+	msg, err := DecodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, ok := msg.Data.(ReleaseFileReq)
+	if !ok || req.Cid.String() != "bafkqaaa" || msg.Nonce != "vector" || msg.Timestamp != 1700000000 {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	if got, err := msg.signingBytes(); err != nil || hex.EncodeToString(got) != signing {
+		t.Errorf("unexpected signing bytes %x: %v", got, err)
+	}
+
+	raw, _ := hex.DecodeString(pubKey)
+	pub, err := crypto.UnmarshalPublicKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Verify(id); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+	msg.Nonce = "other"
+	if err := msg.Verify(id); err != ErrBadSignature {
+		t.Errorf("expected ErrBadSignature, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package miner
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-ipfs/miner/proto"
+	"github.com/ipfs/interface-go-ipfs-core"
+)
+
+// HandlerEnv is what the constructor of a registered handler can use to serve
+// and answer messages.
+type HandlerEnv struct {
+	API       iface.CoreAPI
+	Sender    MessageSender
+	Datastore datastore.Datastore
+}
+
+// HandlerConstructor builds the HandleFunc of a message type when the miner
+// starts.
+type HandlerConstructor func(env HandlerEnv) (HandleFunc, error)
+
+// HandlerRegistry holds the handlers of message types added to the miner,
+// usually by plugins. Registered handlers are only given authenticated
+// messages.
+type HandlerRegistry struct {
+	lk           sync.Mutex
+	constructors map[string]HandlerConstructor
+}
+
+// DefaultHandlerRegistry is the registry the miner takes handlers from.
+var DefaultHandlerRegistry = NewHandlerRegistry()
+
+func NewHandlerRegistry() *HandlerRegistry {
+	return &HandlerRegistry{constructors: make(map[string]HandlerConstructor)}
+}
+
+// Register adds a handler for the new message type msgType, whose payload is
+// the struct of payload. Registering a type that already has a payload, such
+// as a built-in type, fails.
+func (r *HandlerRegistry) Register(msgType string, payload interface{}, c HandlerConstructor) error {
+	if c == nil {
+		return fmt.Errorf("no handler given for message type %s", msgType)
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if err := r.registerPayload(msgType, payload); err != nil {
+		return err
+	}
+	r.constructors[msgType] = c
+	return nil
+}
+
+// RegisterPayload registers the payload of a new message type the miner
+// sends but does not handle, such as the response of a registered handler.
+func (r *HandlerRegistry) RegisterPayload(msgType string, payload interface{}) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.registerPayload(msgType, payload)
+}
+
+func (r *HandlerRegistry) registerPayload(msgType string, payload interface{}) error {
+	if msgType == "" || payload == nil {
+		return errors.New("message type and payload are required")
+	}
+	if proto.PayloadRegistered(msgType) {
+		return fmt.Errorf("message type %s is already registered", msgType)
+	}
+	proto.RegisterPayload(msgType, payload)
+	return nil
+}
+
+// RegisterType registers a struct used inside the payload of a registered
+// message type.
+func (r *HandlerRegistry) RegisterType(v interface{}) {
+	proto.RegisterType(v)
+}
+
+// handlers builds the registered handlers for env. Handlers whose constructor
+// fails are left out.
+func (r *HandlerRegistry) handlers(env HandlerEnv) map[string]HandleFunc {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	out := make(map[string]HandleFunc, len(r.constructors))
+	for msgType, c := range r.constructors {
+		f, err := c(env)
+		if err != nil {
+			log.Errorf("failed to create handler for %s: %v", msgType, err)
+			continue
+		}
+		out[msgType] = f
+	}
+	return out
+}
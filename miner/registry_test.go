@@ -0,0 +1,63 @@
+package miner
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-ipfs/miner/proto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+type statsReq struct {
+	Detail bool
+}
+
+func TestHandlerRegistry(t *testing.T) {
+	r := NewHandlerRegistry()
+
+	if err := r.Register(proto.MsgFetchFile, proto.FetchFileReq{}, nil); err == nil {
+		t.Fatal("registering without a handler should fail")
+	}
+	noop := func(HandlerEnv) (HandleFunc, error) {
+		return func(context.Context, peer.ID, *proto.Message) error { return nil }, nil
+	}
+	if err := r.Register(proto.MsgFetchFile, proto.FetchFileReq{}, noop); err == nil {
+		t.Fatal("registering a built-in message type should fail")
+	}
+
+	var got *proto.Message
+	err := r.Register("TestStats", statsReq{}, func(env HandlerEnv) (HandleFunc, error) {
+		return func(ctx context.Context, from peer.ID, msg *proto.Message) error {
+			got = msg
+			return nil
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("TestStats", statsReq{}, noop); err == nil {
+		t.Fatal("registering a message type twice should fail")
+	}
+
+	msg := proto.Message{Type: "TestStats", Nonce: "n", Data: statsReq{Detail: true}, Version: proto.WireVersionCBOR}
+	data, err := msg.EncodeMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := proto.DecodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handlers := r.handlers(HandlerEnv{})
+	f, ok := handlers["TestStats"]
+	if !ok {
+		t.Fatal("registered handler missing")
+	}
+	if err := f(context.Background(), "", &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if req, ok := got.Data.(statsReq); !ok || !req.Detail {
+		t.Fatalf("unexpected payload: %#v", got.Data)
+	}
+}
@@ -0,0 +1,257 @@
+package miner
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-ipfs/miner/proto"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// sweepInterval is how often stored files are checked for expiry.
+const sweepInterval = 10 * time.Minute
+
+var freedKey = datastore.NewKey("/miner/heartbeat/freed")
+
+// freedCounter persists the size of the files released since the last
+// heartbeat.
+type freedCounter struct {
+	lk sync.Mutex
+	ds datastore.Datastore
+}
+
+func (f *freedCounter) get() (uint64, error) {
+	data, err := f.ds.Get(freedKey)
+	if err == datastore.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil || len(data) != 8 {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+func (f *freedCounter) put(n uint64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	return f.ds.Put(freedKey, buf[:])
+}
+
+// Get returns the bytes freed since the last call to Sub.
+func (f *freedCounter) Get() (uint64, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	return f.get()
+}
+
+func (f *freedCounter) Add(n uint64) error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	cur, err := f.get()
+	if err != nil {
+		return err
+	}
+	return f.put(cur + n)
+}
+
+// Sub removes n reported bytes from the counter.
+func (f *freedCounter) Sub(n uint64) error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	cur, err := f.get()
+	if err != nil {
+		return err
+	}
+	if n > cur {
+		n = cur
+	}
+	return f.put(cur - n)
+}
+
+// ReleaseFile unpins a file at the request of the peer that assigned it.
+func (h *V1Handler) ReleaseFile(ctx context.Context, receivedFrom peer.ID, msg *proto.Message) error {
+	req, _ := msg.Data.(proto.ReleaseFileReq)
+	status := h.releaseFile(ctx, receivedFrom, req.Cid)
+	msgResp := proto.Message{
+		Type:    proto.MsgReleaseFileResponse,
+		Nonce:   msg.Nonce,
+		Data:    proto.ReleaseFileResp{Cid: req.Cid, Status: status},
+		Version: msg.Version,
+	}
+	err := h.sender.SendMessage(ctx, receivedFrom, &msgResp)
+	if err != nil {
+		log.Errorf("failed to send:%v", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (h *V1Handler) releaseFile(ctx context.Context, requester peer.ID, c cid.Cid) int {
+	h.releaseLk.Lock()
+	defer h.releaseLk.Unlock()
+	f, status := h.assignedFile(requester, c)
+	if status != proto.StatusOK {
+		return status
+	}
+	if err := h.release(ctx, f); err != nil {
+		log.Errorf("failed to release %v: %v", c, err)
+		return proto.StatusReleaseError
+	}
+	log.Infof("released %v at the request of %v", c, requester)
+	return proto.StatusOK
+}
+
+// RenewFile moves the storage deadline of a file at the request of the peer
+// that assigned it.
+func (h *V1Handler) RenewFile(ctx context.Context, receivedFrom peer.ID, msg *proto.Message) error {
+	req, _ := msg.Data.(proto.RenewFileReq)
+	resp := proto.RenewFileResp{
+		Cid:      req.Cid,
+		Status:   h.renewFile(receivedFrom, req.Cid, req.Deadline),
+		Deadline: req.Deadline,
+	}
+	msgResp := proto.Message{
+		Type:    proto.MsgRenewFileResponse,
+		Nonce:   msg.Nonce,
+		Data:    resp,
+		Version: msg.Version,
+	}
+	err := h.sender.SendMessage(ctx, receivedFrom, &msgResp)
+	if err != nil {
+		log.Errorf("failed to send:%v", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (h *V1Handler) renewFile(requester peer.ID, c cid.Cid, deadline int64) int {
+	var d time.Time
+	if deadline != 0 {
+		d = time.Unix(deadline, 0)
+		if !d.After(time.Now()) {
+			return proto.StatusInvalidDeadline
+		}
+	}
+
+	h.releaseLk.Lock()
+	defer h.releaseLk.Unlock()
+	f, status := h.assignedFile(requester, c)
+	if status != proto.StatusOK {
+		return status
+	}
+	f.Deadline = d
+	if err := h.files.Put(f); err != nil {
+		log.Errorf("failed to renew %v: %v", c, err)
+		return proto.StatusReleaseError
+	}
+	return proto.StatusOK
+}
+
+// assignedFile returns the stored file c if requester assigned it.
+func (h *V1Handler) assignedFile(requester peer.ID, c cid.Cid) (*StoredFile, int) {
+	f, err := h.files.Get(c, requester)
+	if err == nil {
+		return f, proto.StatusOK
+	}
+	if err != datastore.ErrNotFound {
+		log.Errorf("failed to look up %v: %v", c, err)
+		return nil, proto.StatusReleaseError
+	}
+	others, err := h.files.Assignments(c)
+	if err != nil {
+		log.Errorf("failed to look up %v: %v", c, err)
+		return nil, proto.StatusReleaseError
+	}
+	if len(others) > 0 {
+		return nil, proto.StatusNotRequester
+	}
+	return nil, proto.StatusFileNotStored
+}
+
+// release removes the assignment f from the file index and unpins the file
+// once no other requester has it assigned, unless the pin was not added by a
+// fetch. The size of an unpinned file is reported as freed with the next
+// heartbeat. The caller must hold releaseLk.
+func (h *V1Handler) release(ctx context.Context, f *StoredFile) error {
+	all, err := h.files.Assignments(f.Cid)
+	if err != nil {
+		return err
+	}
+	for _, other := range all {
+		if other.Requester != f.Requester {
+			log.Infof("keeping %v pinned, still assigned by %v", f.Cid, other.Requester)
+			return h.files.Delete(f.Cid, f.Requester)
+		}
+	}
+	owned, err := h.files.MinerPin(f.Cid)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		log.Infof("keeping %v pinned by the operator", f.Cid)
+		return h.files.Delete(f.Cid, f.Requester)
+	}
+
+	p := path.IpfsPath(f.Cid)
+	if err := h.api.Pin().Rm(ctx, p); err != nil {
+		// The operator may have unpinned the file already.
+		_, pinned, perr := h.api.Pin().IsPinned(ctx, p, options.Pin.IsPinned.Recursive())
+		if perr != nil || pinned {
+			return err
+		}
+	}
+	if err := h.files.Delete(f.Cid, f.Requester); err != nil {
+		return err
+	}
+	if err := h.files.ClearMinerPin(f.Cid); err != nil {
+		return err
+	}
+	return h.freed.Add(f.Size)
+}
+
+// sweep releases expired files every sweepInterval until ctx is done.
+func (h *V1Handler) sweep(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		h.sweepExpired(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *V1Handler) sweepExpired(ctx context.Context) {
+	all, err := h.files.List()
+	if err != nil {
+		log.Errorf("failed to list stored files: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, f := range all {
+		if !f.expired(now) {
+			continue
+		}
+		h.releaseLk.Lock()
+		// Reload under the lock, the file may have been renewed.
+		cur, err := h.files.Get(f.Cid, f.Requester)
+		if err == nil && cur.expired(now) {
+			err = h.release(ctx, cur)
+			if err == nil {
+				log.Infof("released expired file %v", f.Cid)
+			}
+		}
+		h.releaseLk.Unlock()
+		if err != nil && err != datastore.ErrNotFound {
+			log.Errorf("failed to release expired file %v: %v", f.Cid, err)
+		}
+	}
+}
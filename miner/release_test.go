@@ -0,0 +1,147 @@
+package miner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/go-ipfs/miner/proto"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/libp2p/go-libp2p-core/peer"
+	testutil "github.com/libp2p/go-libp2p-core/test"
+)
+
+func TestFreedCounter(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	f := &freedCounter{ds: ds}
+	if n, err := f.Get(); err != nil || n != 0 {
+		t.Fatalf("expected empty counter, got %d, %v", n, err)
+	}
+	if err := f.Add(100); err != nil {
+		t.Fatal(err)
+	}
+	reported, _ := f.Get()
+	// A file released while the heartbeat is published.
+	if err := f.Add(50); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sub(reported); err != nil {
+		t.Fatal(err)
+	}
+
+	// The counter survives a restart.
+	f = &freedCounter{ds: ds}
+	if n, err := f.Get(); err != nil || n != 50 {
+		t.Errorf("expected 50 bytes left to report, got %d, %v", n, err)
+	}
+}
+
+func TestStoredFileExpired(t *testing.T) {
+	now := time.Now()
+	if (&StoredFile{}).expired(now) {
+		t.Error("a file without deadline never expires")
+	}
+	if (&StoredFile{Deadline: now.Add(time.Minute)}).expired(now) {
+		t.Error("file expired before its deadline")
+	}
+	if !(&StoredFile{Deadline: now.Add(-time.Minute)}).expired(now) {
+		t.Error("file should expire after its deadline")
+	}
+}
+
+func TestReleaseSharedFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tp := newTestPair(t, ctx)
+	h := tp.handler
+
+	p, err := tp.minerAPI.Unixfs().Add(ctx, files.NewBytesFile([]byte("shared")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.pin(ctx, p.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	first, second, stranger := testutil.RandPeerIDFatal(t), testutil.RandPeerIDFatal(t), testutil.RandPeerIDFatal(t)
+	for _, r := range []peer.ID{first, second} {
+		if err := h.files.Put(&StoredFile{Cid: p.Cid(), Requester: r, Size: 6}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pinned := func() bool {
+		t.Helper()
+		_, ok, err := tp.minerAPI.Pin().IsPinned(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if status := h.renewFile(stranger, p.Cid(), 0); status != proto.StatusNotRequester {
+		t.Errorf("renewed by another peer: status %d", status)
+	}
+	if status := h.renewFile(second, p.Cid(), time.Now().Add(time.Hour).Unix()); status != proto.StatusOK {
+		t.Errorf("failed to renew: status %d", status)
+	}
+	if f, err := h.files.Get(p.Cid(), first); err != nil || !f.Deadline.IsZero() {
+		t.Errorf("renewal changed the assignment of another requester: %+v, %v", f, err)
+	}
+
+	if status := h.releaseFile(ctx, first, p.Cid()); status != proto.StatusOK {
+		t.Fatalf("failed to release: status %d", status)
+	}
+	if !pinned() {
+		t.Fatal("file unpinned while still assigned by another requester")
+	}
+	if status := h.releaseFile(ctx, first, p.Cid()); status != proto.StatusNotRequester {
+		t.Errorf("released twice: status %d", status)
+	}
+	if status := h.releaseFile(ctx, second, p.Cid()); status != proto.StatusOK {
+		t.Fatalf("failed to release: status %d", status)
+	}
+	if pinned() {
+		t.Error("file still pinned after its last assignment was released")
+	}
+	if status := h.releaseFile(ctx, second, p.Cid()); status != proto.StatusFileNotStored {
+		t.Errorf("released a file no longer stored: status %d", status)
+	}
+	if n, _ := h.freed.Get(); n != 6 {
+		t.Errorf("expected 6 freed bytes, got %d", n)
+	}
+}
+
+func TestReleaseOperatorPin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tp := newTestPair(t, ctx)
+	h := tp.handler
+
+	// The operator pinned the file before it was assigned.
+	p, err := tp.minerAPI.Unixfs().Add(ctx, files.NewBytesFile([]byte("operator")), options.Unixfs.Pin(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.pin(ctx, p.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	requester := testutil.RandPeerIDFatal(t)
+	if err := h.files.Put(&StoredFile{Cid: p.Cid(), Requester: requester, Size: 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := h.releaseFile(ctx, requester, p.Cid()); status != proto.StatusOK {
+		t.Fatalf("failed to release: status %d", status)
+	}
+	if _, pinned, err := tp.minerAPI.Pin().IsPinned(ctx, p); err != nil || !pinned {
+		t.Errorf("release removed the pin of the operator: %v", err)
+	}
+	if status := h.releaseFile(ctx, requester, p.Cid()); status != proto.StatusFileNotStored {
+		t.Errorf("released twice: status %d", status)
+	}
+	if n, _ := h.freed.Get(); n != 0 {
+		t.Errorf("expected no freed bytes, got %d", n)
+	}
+}
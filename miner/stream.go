@@ -0,0 +1,200 @@
+package miner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime/debug"
+	"time"
+
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/miner/proto"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// streamTimeout bounds reading or writing a single message on a stream.
+	streamTimeout = time.Minute
+	// handleTimeout bounds handling a request of a type without a timeout
+	// of its own in messageTimeouts.
+	handleTimeout = 30 * time.Minute
+	// maxMessageSize is the largest message frame accepted on a stream.
+	maxMessageSize = 4 << 20
+)
+
+var ErrMessageTooLarge = errors.New("message exceeds maximum size")
+
+type streamReplyKey struct{}
+
+// streamReply routes responses back over the stream the request arrived on.
+type streamReply struct {
+	peer   peer.ID
+	stream network.Stream
+}
+
+// detachReply returns ctx without the stream of the request it belongs to,
+// so that messages sent with it open a new stream.
+func detachReply(ctx context.Context) context.Context {
+	return context.WithValue(ctx, streamReplyKey{}, (*streamReply)(nil))
+}
+
+func writeMessage(w io.Writer, data []byte) error {
+	if len(data) > maxMessageSize {
+		return ErrMessageTooLarge
+	}
+	buf := make([]byte, binary.MaxVarintLen64+len(data))
+	n := binary.PutUvarint(buf, uint64(len(data)))
+	n += copy(buf[n:], data)
+	_, err := w.Write(buf[:n])
+	return err
+}
+
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// handleStream serves a single request on a proto.V1ProtocolID stream. The
+// response is written back on the same stream.
+func (m *Miner) handleStream(s network.Stream) {
+	if !m.track() {
+		s.Reset()
+		return
+	}
+	defer m.inflight.Done()
+	serveStream(m.ctx, s, m.handler)
+}
+
+// SendMessage delivers msg to peer to over a proto.V1ProtocolID stream. When
+// ctx belongs to a request received on a stream from the same peer, the
+// message is written back on that stream instead of opening a new one.
+func (m *Miner) SendMessage(ctx context.Context, to peer.ID, msg *proto.Message) error {
+	return sendMessage(ctx, m.node, to, msg)
+}
+
+// serveStream reads a single request from s and passes it to h. Messages sent
+// with sendMessage while handling the request are written back on s.
+func serveStream(ctx context.Context, s network.Stream, h MessageHandler) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("%v", string(debug.Stack()))
+			s.Reset()
+		}
+	}()
+	remote := s.Conn().RemotePeer()
+
+	_ = s.SetReadDeadline(time.Now().Add(streamTimeout))
+	data, err := readMessage(bufio.NewReader(s))
+	if err != nil {
+		log.Errorf("failed to read message from %v: %v", remote, err)
+		s.Reset()
+		return
+	}
+	_ = s.SetReadDeadline(time.Time{})
+
+	msg, err := proto.DecodeMessage(data)
+	if err != nil {
+		log.Errorf("failed to decode message: %v", err)
+		s.Reset()
+		return
+	}
+	log.Infof("received stream message from %v: %v", remote, msg.Type)
+
+	ctx = context.WithValue(ctx, streamReplyKey{}, &streamReply{peer: remote, stream: s})
+	err = handleMessage(ctx, h, remote, &msg, transportStream)
+	if err != nil {
+		log.Errorf("failed to handler message: %v", err)
+		s.Reset()
+		return
+	}
+	s.Close()
+}
+
+func signAndEncode(node *core.IpfsNode, msg *proto.Message) ([]byte, error) {
+	err := msg.Sign(node.PrivateKey)
+	if err != nil {
+		log.Errorf("failed to sign message: %v", err)
+		return nil, err
+	}
+	data, err := msg.EncodeMessage()
+	if err != nil {
+		log.Errorf("failed to encode message: %v", err)
+		return nil, err
+	}
+	return data, nil
+}
+
+// sendMessage signs msg with the identity of node and delivers it to peer to.
+// See Miner.SendMessage.
+func sendMessage(ctx context.Context, node *core.IpfsNode, to peer.ID, msg *proto.Message) error {
+	data, err := signAndEncode(node, msg)
+	if err != nil {
+		return err
+	}
+
+	if r, ok := ctx.Value(streamReplyKey{}).(*streamReply); ok && r != nil && r.peer == to {
+		_ = r.stream.SetWriteDeadline(time.Now().Add(streamTimeout))
+		return writeMessage(r.stream, data)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, streamTimeout)
+	defer cancel()
+	s, err := node.PeerHost.NewStream(ctx, to, proto.V1ProtocolID)
+	if err != nil {
+		log.Errorf("failed to open stream to %v: %v", to, err)
+		return err
+	}
+	_ = s.SetWriteDeadline(time.Now().Add(streamTimeout))
+	err = writeMessage(s, data)
+	if err != nil {
+		log.Errorf("failed to send message to %v: %v", to, err)
+		s.Reset()
+		return err
+	}
+	return s.Close()
+}
+
+// roundTrip sends msg to peer to and waits until ctx is done for the first
+// message written back on the stream.
+func roundTrip(ctx context.Context, node *core.IpfsNode, to peer.ID, msg *proto.Message) (proto.Message, error) {
+	data, err := signAndEncode(node, msg)
+	if err != nil {
+		return proto.Message{}, err
+	}
+	s, err := node.PeerHost.NewStream(ctx, to, proto.V1ProtocolID)
+	if err != nil {
+		return proto.Message{}, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+	if err := writeMessage(s, data); err != nil {
+		s.Reset()
+		return proto.Message{}, err
+	}
+	if err := s.CloseWrite(); err != nil {
+		s.Reset()
+		return proto.Message{}, err
+	}
+	data, err = readMessage(bufio.NewReader(s))
+	if err != nil {
+		s.Reset()
+		return proto.Message{}, err
+	}
+	s.Close()
+	return proto.DecodeMessage(data)
+}
@@ -0,0 +1,119 @@
+package miner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreapi"
+	minerconfig "github.com/ipfs/go-ipfs/miner/config"
+	"github.com/ipfs/go-ipfs/miner/proto"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// testPair is a miner and an inspector node connected on a mock network.
+// The miner serves proto.V1ProtocolID streams with handler and the inspector
+// with inspector.
+type testPair struct {
+	miner     *core.IpfsNode
+	minerAPI  iface.CoreAPI
+	handler   *V1Handler
+	inspector *Inspector
+}
+
+func newTestPair(t *testing.T, ctx context.Context) *testPair {
+	t.Helper()
+	mn := mocknet.New(ctx)
+	newNode := func() *core.IpfsNode {
+		nd, err := core.NewNode(ctx, &core.BuildCfg{
+			Online: true,
+			Host: func(ctx context.Context, id peer.ID, ps peerstore.Peerstore, _ ...libp2p.Option) (host.Host, error) {
+				return mn.AddPeerWithPeerstore(id, ps)
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd
+	}
+	minerNode, inspectorNode := newNode(), newNode()
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+
+	minerAPI, err := coreapi.NewCoreAPI(minerNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewV1Handler(minerAPI, &Miner{node: minerNode}, minerNode.Repo.Datastore(), FetchOptions{})
+	minerNode.PeerHost.SetStreamHandler(proto.V1ProtocolID, func(s network.Stream) {
+		serveStream(ctx, s, handler)
+	})
+
+	inspectorAPI, err := coreapi.NewCoreAPI(inspectorNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &Inspector{
+		ctx:         ctx,
+		node:        inspectorNode,
+		api:         inspectorAPI,
+		cfg:         minerconfig.Inspector{},
+		miners:      dssync.MutexWrap(datastore.NewMapDatastore()),
+		assignments: dssync.MutexWrap(datastore.NewMapDatastore()),
+	}
+	inspectorNode.PeerHost.SetStreamHandler(proto.V1ProtocolID, i.handleStream)
+
+	t.Cleanup(func() {
+		minerNode.Close()
+		inspectorNode.Close()
+	})
+	return &testPair{miner: minerNode, minerAPI: minerAPI, handler: handler, inspector: i}
+}
+
+func TestAssignRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tp := newTestPair(t, ctx)
+	tp.handler.setLimits(Limits{MaxFileSize: 100})
+
+	p, err := tp.inspector.api.Unixfs().Add(ctx, files.NewBytesFile(make([]byte, 1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tp.inspector.Assign(ctx, tp.miner.Identity, p.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rejection reaches the inspector on a stream of its own.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		all, err := tp.inspector.Assignments(tp.miner.Identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 1 {
+			t.Fatalf("got %d assignments, want 1", len(all))
+		}
+		if all[0].State == AssignmentFailed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("assignment still %s after the miner rejected it", all[0].State)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,151 @@
+package miner
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-ipfs/miner/proto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+)
+
+// Transports a message can arrive on.
+const (
+	transportStream = "stream"
+	transportPubSub = "pubsub"
+)
+
+const (
+	// challengeBaseTimeout and positionTimeout bound answering a challenge:
+	// a base for the request plus the time to read each position, up to
+	// challengeTimeout, after which the inspector stops waiting.
+	challengeBaseTimeout = 30 * time.Second
+	positionTimeout      = 5 * time.Second
+
+	// fetchBaseTimeout and minFetchRate bound a fetch attempt of a file of
+	// known size: a base plus the time to transfer it at minFetchRate
+	// bytes per second.
+	fetchBaseTimeout = 5 * time.Minute
+	minFetchRate     = 64 << 10
+)
+
+// messageTimeouts bounds handling a message of each type whose timeout does
+// not depend on its content. Other types get handleTimeout. FetchFile only
+// queues a job, which runs in the context of the fetch queue.
+var messageTimeouts = map[string]time.Duration{
+	proto.MsgFetchFile:   time.Minute,
+	proto.MsgReleaseFile: 5 * time.Minute,
+	proto.MsgRenewFile:   time.Minute,
+}
+
+// messageTimeout returns how long msg may be handled. Challenges get time
+// for the positions they ask for.
+func messageTimeout(msg *proto.Message) time.Duration {
+	switch req := msg.Data.(type) {
+	case proto.WindowPostReq:
+		return challengeDuration(req.Items)
+	case proto.WindowPostProofReq:
+		return challengeDuration(req.Items)
+	}
+	if d, ok := messageTimeouts[msg.Type]; ok {
+		return d
+	}
+	return handleTimeout
+}
+
+// challengeDuration returns how long answering a challenge of items may take.
+func challengeDuration(items []proto.WindowPostReqItem) time.Duration {
+	d := challengeBaseTimeout
+	for _, item := range items {
+		d += time.Duration(len(item.Positions)) * positionTimeout
+		if d >= challengeTimeout {
+			return challengeTimeout
+		}
+	}
+	return d
+}
+
+// fetchDeadline returns when an attempt of job must be done: in time to
+// transfer the expected size at minFetchRate and before the stored file
+// expires. ok is false when the job has neither.
+func fetchDeadline(job *FetchJob, now time.Time) (deadline time.Time, ok bool) {
+	if job.ExpectedSize > 0 {
+		deadline = now.Add(fetchBaseTimeout + time.Duration(job.ExpectedSize/minFetchRate)*time.Second)
+		ok = true
+	}
+	if !job.Deadline.IsZero() && (!ok || job.Deadline.Before(deadline)) {
+		deadline = job.Deadline
+		ok = true
+	}
+	return deadline, ok
+}
+
+// handleMessage passes msg to h in a context derived from ctx that expires
+// with the timeout of the message and carries a span of the handling.
+// The span is recorded by the tracer installed by a tracer plugin.
+func handleMessage(ctx context.Context, h MessageHandler, from peer.ID, msg *proto.Message, transport string) error {
+	ctx, cancel := context.WithTimeout(ctx, messageTimeout(msg))
+	defer cancel()
+
+	span, ctx := startSpan(ctx, "Handle")
+	span.SetTag("miner.type", msg.Type)
+	span.SetTag("miner.peer", from.String())
+	span.SetTag("miner.nonce", msg.Nonce)
+	span.SetTag("miner.transport", transport)
+	span.SetTag("miner.wire_version", msg.Version)
+
+	err := h.Handle(ctx, from, msg)
+	finishSpan(span, err)
+	return err
+}
+
+// startSpan starts a span named operation as a child of the span in ctx.
+func startSpan(ctx context.Context, operation string) (opentracing.Span, context.Context) {
+	return opentracing.StartSpanFromContext(ctx, "miner."+operation)
+}
+
+// spanCarrier returns the context of the span in ctx in a form that is
+// persisted with fetch jobs, or nil when ctx has no span.
+func spanCarrier(ctx context.Context) map[string]string {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return nil
+	}
+	carrier := make(map[string]string)
+	err := span.Tracer().Inject(span.Context(), opentracing.TextMap, opentracing.TextMapCarrier(carrier))
+	if err != nil {
+		log.Debugf("failed to inject span context: %v", err)
+		return nil
+	}
+	return carrier
+}
+
+// startSpanFollowing starts a span named operation that follows from the
+// span whose context spanCarrier put in carrier. Jobs outlive the request
+// that queued them, so their spans follow from the request span instead of
+// being its children.
+func startSpanFollowing(ctx context.Context, operation string, carrier map[string]string) (opentracing.Span, context.Context) {
+	var opts []opentracing.StartSpanOption
+	if carrier != nil {
+		tracer := opentracing.GlobalTracer()
+		from, err := tracer.Extract(opentracing.TextMap, opentracing.TextMapCarrier(carrier))
+		if err == nil {
+			opts = append(opts, opentracing.FollowsFrom(from))
+		} else if err != opentracing.ErrSpanContextNotFound {
+			log.Debugf("failed to extract span context: %v", err)
+		}
+	}
+	span := opentracing.StartSpan("miner."+operation, opts...)
+	return span, opentracing.ContextWithSpan(ctx, span)
+}
+
+// finishSpan records err on span and finishes it.
+func finishSpan(span opentracing.Span, err error) {
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogFields(otlog.Error(err))
+	}
+	span.Finish()
+}
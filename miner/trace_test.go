@@ -0,0 +1,157 @@
+package miner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-ipfs/miner/proto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	testutil "github.com/libp2p/go-libp2p-core/test"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+type handlerFunc func(ctx context.Context, from peer.ID, msg *proto.Message) error
+
+func (f handlerFunc) Handle(ctx context.Context, from peer.ID, msg *proto.Message) error {
+	return f(ctx, from, msg)
+}
+
+func TestHandleMessage(t *testing.T) {
+	tracer := mocktracer.New()
+	prev := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(prev)
+
+	failed := errors.New("failed")
+	h := handlerFunc(func(ctx context.Context, from peer.ID, msg *proto.Message) error {
+		deadline, ok := ctx.Deadline()
+		if !ok || time.Until(deadline) > messageTimeout(msg) {
+			t.Errorf("%s: unexpected deadline %v", msg.Type, deadline)
+		}
+		if opentracing.SpanFromContext(ctx) == nil {
+			t.Errorf("%s: no span in context", msg.Type)
+		}
+		if msg.Type == proto.MsgWindowPost {
+			return failed
+		}
+		return nil
+	})
+
+	parent, cancel := context.WithCancel(context.Background())
+	msg := &proto.Message{Type: proto.MsgFetchFile, Nonce: "a"}
+	if err := handleMessage(parent, h, "peer", msg, transportStream); err != nil {
+		t.Fatal(err)
+	}
+	msg = &proto.Message{Type: proto.MsgWindowPost, Nonce: "b"}
+	if err := handleMessage(parent, h, "peer", msg, transportPubSub); err != failed {
+		t.Fatalf("expected handler error, got %v", err)
+	}
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 finished spans, got %d", len(spans))
+	}
+	if spans[0].Tag("miner.type") != proto.MsgFetchFile || spans[0].Tag("miner.transport") != transportStream {
+		t.Errorf("unexpected tags: %v", spans[0].Tags())
+	}
+	if spans[0].Tag("error") != nil || spans[1].Tag("error") != true {
+		t.Error("only the failed handling should be marked as an error")
+	}
+
+	cancel()
+	h = handlerFunc(func(ctx context.Context, from peer.ID, msg *proto.Message) error {
+		return ctx.Err()
+	})
+	if err := handleMessage(parent, h, "peer", msg, transportStream); err != context.Canceled {
+		t.Fatalf("cancelling the parent should cancel handling, got %v", err)
+	}
+}
+
+func TestMessageTimeout(t *testing.T) {
+	c := proto.WindowPostReqItem{Positions: []int64{1, 2, 3}}
+	small := &proto.Message{Type: proto.MsgWindowPost, Data: proto.WindowPostReq{Items: []proto.WindowPostReqItem{c}}}
+	if d := messageTimeout(small); d != challengeBaseTimeout+3*positionTimeout {
+		t.Errorf("unexpected timeout of a small challenge: %v", d)
+	}
+	items := make([]proto.WindowPostReqItem, 100)
+	for i := range items {
+		items[i] = c
+	}
+	large := &proto.Message{Type: proto.MsgWindowPostProof, Data: proto.WindowPostProofReq{Items: items}}
+	if d := messageTimeout(large); d != challengeTimeout {
+		t.Errorf("challenge timeout should be capped, got %v", d)
+	}
+	if d := messageTimeout(&proto.Message{Type: proto.MsgFetchFile}); d != time.Minute {
+		t.Errorf("unexpected FetchFile timeout: %v", d)
+	}
+}
+
+func TestFetchDeadline(t *testing.T) {
+	now := time.Now()
+	if _, ok := fetchDeadline(&FetchJob{}, now); ok {
+		t.Error("a job without size or deadline should not have a fetch deadline")
+	}
+	job := &FetchJob{ExpectedSize: 100 * minFetchRate}
+	deadline, ok := fetchDeadline(job, now)
+	if !ok || !deadline.Equal(now.Add(fetchBaseTimeout+100*time.Second)) {
+		t.Errorf("unexpected deadline for the expected size: %v", deadline)
+	}
+	job.Deadline = now.Add(time.Minute)
+	if deadline, _ := fetchDeadline(job, now); !deadline.Equal(job.Deadline) {
+		t.Errorf("an earlier file deadline should bound the fetch, got %v", deadline)
+	}
+	job.Deadline = now.Add(time.Hour)
+	if deadline, _ := fetchDeadline(job, now); !deadline.Equal(now.Add(fetchBaseTimeout + 100*time.Second)) {
+		t.Errorf("a later file deadline should not extend the fetch, got %v", deadline)
+	}
+}
+
+func TestJobSpanFollowsRequest(t *testing.T) {
+	tracer := mocktracer.New()
+	prev := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(prev)
+
+	var carrier map[string]string
+	h := handlerFunc(func(ctx context.Context, from peer.ID, msg *proto.Message) error {
+		carrier = spanCarrier(ctx)
+		return nil
+	})
+	msg := &proto.Message{Type: proto.MsgFetchFile, Nonce: "a"}
+	if err := handleMessage(context.Background(), h, "peer", msg, transportStream); err != nil {
+		t.Fatal(err)
+	}
+	if carrier == nil {
+		t.Fatal("no span context carried")
+	}
+	// Round trip through JSON as the job is persisted.
+	data, err := json.Marshal(&FetchJob{Requester: testutil.RandPeerIDFatal(t), Trace: carrier})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job FetchJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		t.Fatal(err)
+	}
+	span, _ := startSpanFollowing(context.Background(), "FetchJob", job.Trace)
+	span.Finish()
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 finished spans, got %d", len(spans))
+	}
+	handle, fetch := spans[0], spans[1]
+	if fetch.ParentID != handle.SpanContext.SpanID || fetch.SpanContext.TraceID != handle.SpanContext.TraceID {
+		t.Errorf("job span %v does not follow from the request span %v", fetch, handle)
+	}
+
+	span, _ = startSpanFollowing(context.Background(), "FetchJob", nil)
+	span.Finish()
+	if orphan := tracer.FinishedSpans()[2]; orphan.ParentID != 0 {
+		t.Errorf("a job without a carried span should start a trace, got parent %d", orphan.ParentID)
+	}
+}
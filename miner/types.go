@@ -15,3 +15,7 @@ type MessageHandler interface {
 type MessagePublisher interface {
 	PublishMessage(ctx context.Context, topic string, msg *proto.Message) error
 }
+
+type MessageSender interface {
+	SendMessage(ctx context.Context, to peer.ID, msg *proto.Message) error
+}
@@ -3,100 +3,537 @@ package miner
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
 	files "github.com/ipfs/go-ipfs-files"
+	minerapi "github.com/ipfs/go-ipfs/miner/api"
 	"github.com/ipfs/go-ipfs/miner/proto"
 	"github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
 	"github.com/ipfs/interface-go-ipfs-core/path"
 	"github.com/libp2p/go-libp2p-core/peer"
-	"io"
-	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// nonceCacheSize bounds the number of unexpired request nonces
+	// remembered for a single peer.
+	nonceCacheSize = 16384
+	// maxMessageAge is how long a signed request stays acceptable. Nonces of
+	// older messages no longer need to be remembered.
+	maxMessageAge = 10 * time.Minute
+)
+
+var (
+	ErrStaleMessage    = errors.New("message timestamp outside of accepted window")
+	ErrMissingNonce    = errors.New("message has no nonce")
+	ErrReplayedMessage = errors.New("message nonce already seen")
 )
 
 type V1Handler struct {
 	api        iface.CoreAPI
 	handleFunc map[string]HandleFunc
-	publisher  MessagePublisher
+	sender     MessageSender
+	nonces     *nonceCache
+	jobs       *FetchQueue
+	files      *fileIndex
+	freed      *freedCounter
+	proofs     *proofLog
+	limits     *requestLimiter
+
+	// releaseLk serializes releasing and renewing stored files.
+	releaseLk sync.Mutex
+
+	optsLk sync.RWMutex
+	opts   FetchOptions
 }
 
-func NewV1Handler(api iface.CoreAPI, publisher MessagePublisher) *V1Handler {
+// FetchOptions tunes how FetchFile requests are served.
+type FetchOptions struct {
+	// Workers bounds the number of fetch jobs running at once.
+	Workers int
+	// PrefetchBatch is the number of blocks requested at once while
+	// walking a DAG.
+	PrefetchBatch int
+	// ExportDir receives a copy of the files whose request asks for
+	// export. Export is disabled when empty.
+	ExportDir string
+}
+
+func NewV1Handler(api iface.CoreAPI, sender MessageSender, ds datastore.Datastore, opts FetchOptions) *V1Handler {
 	h := &V1Handler{
 		api:        api,
+		opts:       opts,
 		handleFunc: make(map[string]HandleFunc),
-		publisher:  publisher,
+		sender:     sender,
+		nonces:     newNonceCache(nonceCacheSize),
+		files:      newFileIndex(ds),
+		freed:      &freedCounter{ds: ds},
+		proofs:     newProofLog(proofLogSize),
+		limits:     newRequestLimiter(Limits{}),
 	}
+	h.jobs = NewFetchQueue(ds, opts.Workers, h.fetchJob, h.reportJob)
 	h.handleFunc[proto.MsgFetchFile] = h.FetchFile
 	h.handleFunc[proto.MsgWindowPost] = h.WindowPost
+	h.handleFunc[proto.MsgWindowPostProof] = h.WindowPostProof
+	h.handleFunc[proto.MsgReleaseFile] = h.ReleaseFile
+	h.handleFunc[proto.MsgRenewFile] = h.RenewFile
+
+	env := HandlerEnv{API: api, Sender: sender, Datastore: ds}
+	for msgType, f := range DefaultHandlerRegistry.handlers(env) {
+		if _, ok := h.handleFunc[msgType]; ok {
+			continue
+		}
+		h.handleFunc[msgType] = f
+		log.Infof("registered handler for %s", msgType)
+	}
 	return h
 }
 
+// Start resumes unfinished fetch jobs, starts the fetch workers and the
+// sweeper releasing expired files.
+func (h *V1Handler) Start(ctx context.Context) error {
+	if err := h.files.migrate(); err != nil {
+		return err
+	}
+	if err := h.jobs.Start(ctx); err != nil {
+		return err
+	}
+	go h.sweep(ctx)
+	return nil
+}
+
+func (h *V1Handler) options() FetchOptions {
+	h.optsLk.RLock()
+	defer h.optsLk.RUnlock()
+	return h.opts
+}
+
+// setOptions updates the options used by subsequent fetches. Workers only
+// takes effect on restart.
+func (h *V1Handler) setOptions(opts FetchOptions) {
+	h.optsLk.Lock()
+	h.opts = opts
+	h.optsLk.Unlock()
+}
+
+// setLimits replaces the limits applied to requests.
+func (h *V1Handler) setLimits(l Limits) {
+	h.limits.SetLimits(l)
+}
+
 func (h *V1Handler) Handle(ctx context.Context, receivedFrom peer.ID, msg *proto.Message) error {
-	if f, ok := h.handleFunc[msg.Type]; ok {
-		return f(ctx, receivedFrom, msg)
+	if err := authenticate(h.nonces, receivedFrom, msg); err != nil {
+		handlerErrorsMetric.WithLabelValues("unauthenticated").Inc()
+		log.Warnf("drop message %v from %v: %v", msg.Type, receivedFrom, err)
+		return err
+	}
+	if err := h.limits.Allow(receivedFrom, time.Now()); err != nil {
+		status := proto.StatusRateLimited
+		label := "rate_limited"
+		if err == ErrNotAllowed {
+			status = proto.StatusNotAllowed
+			label = "not_allowed"
+		}
+		handlerErrorsMetric.WithLabelValues(label).Inc()
+		log.Warnf("reject message %v from %v: %v", msg.Type, receivedFrom, err)
+		h.reject(ctx, receivedFrom, msg, status)
+		return err
+	}
+	f, ok := h.handleFunc[msg.Type]
+	if !ok {
+		messagesReceivedMetric.WithLabelValues("unknown").Inc()
+		log.Warnf("message type not register: %v", msg.Type)
+		return nil
+	}
+	messagesReceivedMetric.WithLabelValues(msg.Type).Inc()
+	err := f(ctx, receivedFrom, msg)
+	if err != nil {
+		handlerErrorsMetric.WithLabelValues(msg.Type).Inc()
+	}
+	return err
+}
+
+// authenticate rejects unsigned, forged, stale and replayed messages. Seen
+// nonces are remembered in nonces until the message is stale.
+func authenticate(nonces *nonceCache, receivedFrom peer.ID, msg *proto.Message) error {
+	if err := verifyFresh(receivedFrom, msg); err != nil {
+		return err
+	}
+	if msg.Nonce == "" {
+		return ErrMissingNonce
+	}
+	expires := time.Unix(msg.Timestamp, 0).Add(maxMessageAge)
+	return nonces.Add(receivedFrom, msg.Nonce, expires, time.Now())
+}
+
+// verifyFresh rejects unsigned, forged and stale messages.
+func verifyFresh(receivedFrom peer.ID, msg *proto.Message) error {
+	if err := msg.Verify(receivedFrom); err != nil {
+		return err
+	}
+	age := time.Since(time.Unix(msg.Timestamp, 0))
+	if age > maxMessageAge || age < -maxMessageAge {
+		return ErrStaleMessage
 	}
-	log.Warnf("message type not register: %v", msg.Type)
 	return nil
 }
 
+// reject answers a FetchFile request with status without serving it. Other
+// requests are dropped silently.
+func (h *V1Handler) reject(ctx context.Context, receivedFrom peer.ID, msg *proto.Message, status int) {
+	fmsg, ok := msg.Data.(proto.FetchFileReq)
+	if msg.Type != proto.MsgFetchFile || !ok {
+		return
+	}
+	h.reportJob(ctx, FetchJob{
+		Cid:       fmsg.Cid,
+		Requester: receivedFrom,
+		Nonce:     msg.Nonce,
+		Version:   msg.Version,
+		State:     JobFailed,
+		Status:    status,
+	})
+}
+
+// FetchFile queues a job fetching and pinning the requested file. Progress
+// and the final FetchFileResp are sent to the requester by the job.
 func (h *V1Handler) FetchFile(ctx context.Context, receivedFrom peer.ID, msg *proto.Message) error {
 	fmsg, _ := msg.Data.(proto.FetchFileReq)
-	resp := proto.FetchFileResp{
-		Cid:    fmsg.Cid,
-		Status: proto.StatusOK,
+	if err := h.checkRequest(receivedFrom, fmsg); err != nil {
+		log.Warnf("reject fetch of %v for %v: %v", fmsg.Cid, receivedFrom, err)
+		h.reject(ctx, receivedFrom, msg, fetchStatus(err))
+		return err
+	}
+	job := &FetchJob{
+		Cid:       fmsg.Cid,
+		Requester: receivedFrom,
+		Nonce:     msg.Nonce,
+		Version:   msg.Version,
+		Export:    fmsg.Export,
+
+		ExpectedSize:   fmsg.ExpectedSize,
+		ExpectedBlocks: fmsg.ExpectedBlocks,
+		Trace:          spanCarrier(ctx),
+	}
+	if fmsg.Deadline != 0 {
+		job.Deadline = time.Unix(fmsg.Deadline, 0)
+	}
+	job, err := h.jobs.Enqueue(job)
+	if err != nil {
+		log.Errorf("failed to queue fetch job:%v", err.Error())
+		h.reportJob(ctx, FetchJob{
+			Cid:       fmsg.Cid,
+			Requester: receivedFrom,
+			Nonce:     msg.Nonce,
+			Version:   msg.Version,
+			State:     JobFailed,
+		})
+		return err
+	}
+	log.Infof("queued fetch job %s for %s", job.ID, job.Cid)
+	return nil
+}
+
+// checkRequest checks the size the requester expects against the limits.
+func (h *V1Handler) checkRequest(requester peer.ID, req proto.FetchFileReq) error {
+	limits := h.limits.Limits()
+	if limits.MaxFileSize == 0 && limits.RequesterQuota == 0 {
+		return nil
+	}
+	stored, err := h.files.RequesterSize(requester, req.Cid)
+	if err != nil {
+		return err
+	}
+	return limits.checkFileSize(req.ExpectedSize, stored)
+}
+
+// fetchLimit checks the size of the file of job, read from its root block,
+// against the limits and returns the limit of its fetch.
+func (h *V1Handler) fetchLimit(ctx context.Context, job *FetchJob) (fetchLimit, error) {
+	limits := h.limits.Limits()
+	if limits.MaxFileSize == 0 && limits.RequesterQuota == 0 {
+		return fetchLimit{}, nil
+	}
+	stored, err := h.files.RequesterSize(job.Requester, job.Cid)
+	if err != nil {
+		return fetchLimit{}, err
+	}
+	size, err := fileSize(ctx, h.api.Dag(), job.Cid)
+	switch {
+	case err == ErrUnsupportedBlock:
+		// The size is unknown, the fetch stops once over the limit.
+		size = 0
+	case err != nil:
+		return fetchLimit{}, err
+	}
+	if err := limits.checkFileSize(size, stored); err != nil {
+		return fetchLimit{}, err
+	}
+	return limits.fetchLimit(stored), nil
+}
+
+func (h *V1Handler) fetchJob(ctx context.Context, job *FetchJob, progress func(uint64)) (err error) {
+	span, ctx := startSpanFollowing(ctx, "FetchJob", job.Trace)
+	span.SetTag("miner.job", job.ID)
+	span.SetTag("miner.cid", job.Cid.String())
+	span.SetTag("miner.peer", job.Requester.String())
+	span.SetTag("miner.nonce", job.Nonce)
+	span.SetTag("miner.attempt", job.Attempts)
+	defer func() { finishSpan(span, err) }()
+
+	start := time.Now()
+	if !job.Deadline.IsZero() && !start.Before(job.Deadline) {
+		return fmt.Errorf("%w: file expired at %v", ErrPermanent, job.Deadline)
+	}
+	if deadline, ok := fetchDeadline(job, start); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
 	}
-	err := h.doFetchFile(ctx, fmsg)
+	expect := contentExpectation{Size: job.ExpectedSize, Blocks: job.ExpectedBlocks}
+	limit, err := h.fetchLimit(ctx, job)
+	if err == nil {
+		err = h.doFetchFile(ctx, job.Cid, job.Export, expect, limit, progress)
+	}
+	job.Status = fetchStatus(err)
+	status := "ok"
+	if err != nil {
+		status = "error"
+	} else {
+		fetchSizeMetric.Observe(float64(job.BytesFetched))
+	}
+	fetchDurationMetric.WithLabelValues(status).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return err
+	}
+	return h.indexFile(ctx, job)
+}
+
+// indexFile records the file of a pinned job in the file index.
+func (h *V1Handler) indexFile(ctx context.Context, job *FetchJob) error {
+	size, err := fileSize(ctx, h.api.Dag(), job.Cid)
 	if err != nil {
-		resp.Status = proto.StatusFetchFileError
+		return err
+	}
+	h.releaseLk.Lock()
+	defer h.releaseLk.Unlock()
+	return h.files.Put(&StoredFile{
+		Cid:       job.Cid,
+		Requester: job.Requester,
+		JobID:     job.ID,
+		Assigned:  job.Created,
+		Size:      size,
+		Deadline:  job.Deadline,
+	})
+}
+
+// isStored reports whether the miner stores c, which must be pinned
+// recursively. Files of the file index are checked too, the operator may
+// have unpinned them. api must be offline, so that the lookup never fetches
+// the file.
+func (h *V1Handler) isStored(ctx context.Context, api iface.CoreAPI, c cid.Cid) (bool, error) {
+	_, pinned, err := api.Pin().IsPinned(ctx, path.IpfsPath(c), options.Pin.IsPinned.Recursive())
+	if err != nil || pinned {
+		return pinned, err
+	}
+	assigned, err := h.files.Assignments(c)
+	if err == nil && len(assigned) > 0 {
+		log.Warnf("assigned file %v is no longer pinned", c)
 	}
+	return false, nil
+}
+
+// offlineAPI returns the API answering challenges, which only reads the
+// local blockstore. A miner that lost the data of a file must fail its
+// challenges instead of fetching the data while proving.
+func (h *V1Handler) offlineAPI() (iface.CoreAPI, error) {
+	return h.api.WithOptions(options.Api.Offline(true))
+}
 
+// reportJob sends progress of a running job, or the FetchFileResp of a
+// finished one, to its requester. Reports are always sent on a new stream,
+// requesters do not wait for them on the stream of their request.
+func (h *V1Handler) reportJob(ctx context.Context, job FetchJob) {
+	ctx = detachReply(ctx)
 	msgResp := proto.Message{
-		Type:  proto.MsgFetchFileResponse,
-		Nonce: msg.Nonce,
-		Data:  resp,
+		Nonce:   job.Nonce,
+		Version: job.Version,
+	}
+	switch job.State {
+	case JobFetching:
+		msgResp.Type = proto.MsgFetchFileProgress
+		msgResp.Data = proto.FetchFileProgress{
+			Cid:          job.Cid,
+			BytesFetched: job.BytesFetched,
+			Attempt:      job.Attempts,
+		}
+	case JobPinned, JobFailed, JobCanceled:
+		resp := proto.FetchFileResp{
+			Cid:    job.Cid,
+			Status: proto.StatusOK,
+		}
+		switch job.State {
+		case JobFailed:
+			resp.Status = proto.StatusFetchFileError
+			if job.Status != proto.StatusOK {
+				resp.Status = job.Status
+			}
+		case JobCanceled:
+			resp.Status = proto.StatusFetchFileCanceled
+		}
+		msgResp.Type = proto.MsgFetchFileResponse
+		msgResp.Data = resp
+	default:
+		return
 	}
-	err = h.publisher.PublishMessage(ctx, proto.V1IpfcTopic(receivedFrom.String()), &msgResp)
+	err := h.sender.SendMessage(ctx, job.Requester, &msgResp)
 	if err != nil {
-		log.Errorf("failed to publish:%v", err.Error())
+		log.Errorf("failed to send:%v", err.Error())
+	}
+}
+
+// fetchStatus maps a fetch error to the status of the FetchFileResp.
+func fetchStatus(err error) int {
+	switch {
+	case err == nil:
+		return proto.StatusOK
+	case errors.Is(err, ErrContentPartial):
+		return proto.StatusFetchFilePartial
+	case errors.Is(err, ErrContentOversized):
+		return proto.StatusFetchFileOversized
+	case errors.Is(err, ErrContentCorrupt):
+		return proto.StatusFetchFileCorrupt
+	case errors.Is(err, ErrFileTooLarge):
+		return proto.StatusFileTooLarge
+	case errors.Is(err, ErrQuotaExceeded):
+		return proto.StatusQuotaExceeded
+	default:
+		return proto.StatusFetchFileError
+	}
+}
+
+// doFetchFile pulls the DAG of c into the blockstore, checks that it is
+// complete and matches expect, and pins it. The fetch stops once it exceeds
+// limit. The file is only written to disk when export is requested and an
+// export directory is configured.
+func (h *V1Handler) doFetchFile(ctx context.Context, c cid.Cid, export bool, expect contentExpectation, limit fetchLimit, progress func(uint64)) error {
+	cidPath := path.New("/ipfs/" + c.String())
+	opts := h.options()
+
+	err := h.prefetch(ctx, c, opts.PrefetchBatch, limit, progress)
+	if err != nil {
+		log.Errorf("failed to fetch dag:%v", err.Error())
 		return err
 	}
+	offline, err := h.offlineAPI()
+	if err != nil {
+		return err
+	}
+	span, vctx := startSpan(ctx, "Verify")
+	err = verifyContent(vctx, offline.Dag(), c, expect)
+	finishSpan(span, err)
+	if err != nil {
+		log.Errorf("fetched content of %v failed verification: %v", c, err)
+		return err
+	}
+	span, pctx := startSpan(ctx, "Pin")
+	err = h.pin(pctx, c)
+	finishSpan(span, err)
+	if err != nil {
+		log.Errorf("failed to add pin:%v", err.Error())
+		return err
+	}
+	if export && opts.ExportDir != "" {
+		return h.exportFile(ctx, cidPath, filepath.Join(opts.ExportDir, c.String()))
+	}
 	return nil
 }
 
-func (h *V1Handler) doFetchFile(ctx context.Context, fmsg proto.FetchFileReq) error {
-	cidPath := path.New("/ipfs/" + fmsg.Cid.String())
+// pin pins c recursively and records that the miner pinned it. A file
+// already pinned by the operator keeps the pin of the operator.
+func (h *V1Handler) pin(ctx context.Context, c cid.Cid) error {
+	p := path.IpfsPath(c)
+	_, pinned, err := h.api.Pin().IsPinned(ctx, p, options.Pin.IsPinned.Recursive())
+	if err != nil || pinned {
+		return err
+	}
+	if err := h.api.Pin().Add(ctx, p); err != nil {
+		return err
+	}
+	return h.files.MarkMinerPin(c)
+}
+
+// prefetch pulls the DAG of c into the blockstore and fails once it exceeds
+// limit.
+func (h *V1Handler) prefetch(ctx context.Context, c cid.Cid, batch int, limit fetchLimit, progress func(uint64)) (err error) {
+	span, ctx := startSpan(ctx, "Prefetch")
+	defer func() { finishSpan(span, err) }()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var fetched uint64
+	var exceeded bool
+	err = prefetch(ctx, h.api.Dag(), c, batch, func(n uint64) {
+		fetched = n
+		if limit.exceeded(n) {
+			exceeded = true
+			cancel()
+		}
+		progress(n)
+	})
+	span.SetTag("miner.bytes_fetched", fetched)
+	if exceeded {
+		return fmt.Errorf("%w: fetched more than %d bytes", limit.Err, maxFetchBytes(limit.Size))
+	}
+	return err
+}
+
+func (h *V1Handler) exportFile(ctx context.Context, p path.Path, fpath string) (err error) {
+	span, ctx := startSpan(ctx, "Export")
+	defer func() { finishSpan(span, err) }()
 
-	fileNode, err := h.api.Unixfs().Get(ctx, cidPath)
+	fileNode, err := h.api.Unixfs().Get(ctx, p)
 	if err != nil {
 		log.Errorf("failed to get:%v", err.Error())
 		return err
 	}
 	defer fileNode.Close()
-	err = files.WriteTo(fileNode, os.TempDir()+"/"+fmsg.Cid.String())
+	err = files.WriteTo(fileNode, fpath)
 	if err != nil {
 		log.Errorf("failed to write file:%v", err.Error())
 		return err
 	}
-	err = h.api.Pin().Add(ctx, cidPath)
-	if err != nil {
-		log.Errorf("failed to add pin:%v", err.Error())
-		return err
-	}
 	return nil
 }
 
 func (h *V1Handler) WindowPost(ctx context.Context, receivedFrom peer.ID, msg *proto.Message) error {
+	start := time.Now()
 	respItems := h.doWindowPost(ctx, msg)
+	windowPostChallengesMetric.WithLabelValues(msg.Type).Inc()
+	windowPostDurationMetric.WithLabelValues(msg.Type).Observe(time.Since(start).Seconds())
 	resp := proto.WindowPostResp{
 		Items: respItems,
 	}
+	failed := 0
+	for _, item := range respItems {
+		if item.Data == nil || len(item.Failed) > 0 {
+			failed++
+		}
+	}
+	h.recordProof(receivedFrom, msg, len(respItems), failed)
 	msgResp := proto.Message{
-		Type:  proto.MsgWindowPostResponse,
-		Nonce: msg.Nonce,
-		Data:  resp,
+		Type:    proto.MsgWindowPostResponse,
+		Nonce:   msg.Nonce,
+		Data:    resp,
+		Version: msg.Version,
 	}
-	err := h.publisher.PublishMessage(ctx, proto.V1InspectorTopic(receivedFrom.String()), &msgResp)
+	err := h.sender.SendMessage(ctx, receivedFrom, &msgResp)
 	if err != nil {
-		log.Errorf("failed to publish:%v", err.Error())
+		log.Errorf("failed to send:%v", err.Error())
 		return err
 	}
 	return nil
@@ -105,72 +542,122 @@ func (h *V1Handler) WindowPost(ctx context.Context, receivedFrom peer.ID, msg *p
 func (h *V1Handler) doWindowPost(ctx context.Context, msg *proto.Message) []proto.WindowPostRespItem {
 	req, _ := msg.Data.(proto.WindowPostReq)
 	items := make([]proto.WindowPostRespItem, len(req.Items))
-
-	pins, err := accPins(h.api.Pin().Ls(ctx))
+	api, err := h.offlineAPI()
 	if err != nil {
-		log.Errorf("failed to get pins:%v", err.Error())
+		log.Errorf("failed to create offline api: %v", err)
+		for i, item := range req.Items {
+			items[i] = proto.WindowPostRespItem{FileCid: item.FileCid, Positions: item.Positions}
+		}
 		return items
 	}
-	for i, item := range req.Items {
+
+	forEachLimited(len(req.Items), readConcurrency, func(i int) {
+		item := req.Items[i]
 		respItem := proto.WindowPostRespItem{
 			FileCid:   item.FileCid,
 			Positions: item.Positions,
 		}
-		if _, exist := pins[item.FileCid.String()]; !exist {
+		stored, err := h.isStored(ctx, api, item.FileCid)
+		if err != nil {
+			proofFailuresMetric.WithLabelValues(failureOther).Inc()
+			log.Errorf("failed to look up %v: %v", item.FileCid, err)
+		} else if !stored {
+			proofFailuresMetric.WithLabelValues(failureNotPinned).Inc()
 			log.Warnf("file not exist: %v", item.FileCid)
 		} else {
-			data, err := h.getFileDataAtFixedPosition(ctx, item.FileCid, item.Positions)
-			if err != nil {
-				log.Warnf("failed to get file data: %v", err)
-			} else {
+			data, err := readPositions(ctx, api.Dag(), item.FileCid, item.Positions)
+			var perr PositionErrors
+			switch {
+			case err == nil:
+				respItem.Data = data
+			case errors.As(err, &perr):
+				proofFailuresMetric.WithLabelValues(proofFailure(err)).Inc()
+				log.Warnf("failed to read %d positions of %v: %v", len(perr), item.FileCid, err)
 				respItem.Data = data
+				respItem.Failed = perr.Positions()
+			default:
+				proofFailuresMetric.WithLabelValues(proofFailure(err)).Inc()
+				log.Warnf("failed to get file data: %v", err)
 			}
 		}
 		items[i] = respItem
-	}
+	})
 	return items
 }
 
-func accPins(pins <-chan iface.Pin, err error) (map[string]iface.Pin, error) {
-	if err != nil {
-		return nil, err
+func (h *V1Handler) WindowPostProof(ctx context.Context, receivedFrom peer.ID, msg *proto.Message) error {
+	start := time.Now()
+	resp := proto.WindowPostProofResp{
+		Items: h.doWindowPostProof(ctx, msg),
 	}
-	result := make(map[string]iface.Pin)
-	for pin := range pins {
-		if pin.Err() != nil {
-			return nil, pin.Err()
+	windowPostChallengesMetric.WithLabelValues(msg.Type).Inc()
+	windowPostDurationMetric.WithLabelValues(msg.Type).Observe(time.Since(start).Seconds())
+	failed := 0
+	for _, item := range resp.Items {
+		if item.Proofs == nil {
+			failed++
 		}
-		result[pin.Path().Cid().String()] = pin
 	}
-	return result, nil
+	h.recordProof(receivedFrom, msg, len(resp.Items), failed)
+	msgResp := proto.Message{
+		Type:    proto.MsgWindowPostProofResponse,
+		Nonce:   msg.Nonce,
+		Data:    resp,
+		Version: msg.Version,
+	}
+	err := h.sender.SendMessage(ctx, receivedFrom, &msgResp)
+	if err != nil {
+		log.Errorf("failed to send:%v", err.Error())
+		return err
+	}
+	return nil
 }
 
-func (h *V1Handler) getFileDataAtFixedPosition(ctx context.Context, fileCid cid.Cid, positions []int64) ([]byte, error) {
-	cidPath := path.New("/ipfs/" + fileCid.String())
-
-	fileNode, err := h.api.Unixfs().Get(ctx, cidPath)
+func (h *V1Handler) doWindowPostProof(ctx context.Context, msg *proto.Message) []proto.WindowPostProofRespItem {
+	req, _ := msg.Data.(proto.WindowPostProofReq)
+	items := make([]proto.WindowPostProofRespItem, len(req.Items))
+	api, err := h.offlineAPI()
 	if err != nil {
-		log.Errorf("failed to get:%v", err.Error())
-		return nil, err
-	}
-	defer fileNode.Close()
-	file, ok := fileNode.(files.File)
-	if !ok {
-		log.Warnf("file type error")
-		return nil, errors.New("file type error")
+		log.Errorf("failed to create offline api: %v", err)
+		for i, item := range req.Items {
+			items[i] = proto.WindowPostProofRespItem{FileCid: item.FileCid}
+		}
+		return items
 	}
 
-	size, _ := file.Size()
-	data := make([]byte, len(positions))
-	for i, pos := range positions {
-		if pos < 0 || pos >= size {
-			log.Warnf("out of range: %v %v %v", fileCid.String(), size, pos)
-			return data, errors.New("out off range")
+	forEachLimited(len(req.Items), readConcurrency, func(i int) {
+		item := req.Items[i]
+		respItem := proto.WindowPostProofRespItem{
+			FileCid: item.FileCid,
 		}
-		file.Seek(pos, io.SeekStart)
-		var buf [1]byte
-		file.Read(buf[:])
-		data[i] = buf[0]
-	}
-	return data, nil
+		stored, err := h.isStored(ctx, api, item.FileCid)
+		if err != nil {
+			proofFailuresMetric.WithLabelValues(failureOther).Inc()
+			log.Errorf("failed to look up %v: %v", item.FileCid, err)
+		} else if !stored {
+			proofFailuresMetric.WithLabelValues(failureNotPinned).Inc()
+			log.Warnf("file not exist: %v", item.FileCid)
+		} else {
+			proofs, err := ProvePositions(ctx, api.Dag(), item.FileCid, item.Positions)
+			if err != nil {
+				proofFailuresMetric.WithLabelValues(proofFailure(err)).Inc()
+				log.Warnf("failed to build proof: %v", err)
+			} else {
+				respItem.Proofs = proofs
+			}
+		}
+		items[i] = respItem
+	})
+	return items
+}
+
+func (h *V1Handler) recordProof(receivedFrom peer.ID, msg *proto.Message, files, failed int) {
+	h.proofs.Add(minerapi.Proof{
+		Type:      msg.Type,
+		Requester: receivedFrom.String(),
+		Nonce:     msg.Nonce,
+		Files:     files,
+		Failed:    failed,
+		Time:      time.Now(),
+	})
 }
@@ -0,0 +1,72 @@
+package miner
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/go-ipfs/miner/proto"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+)
+
+func TestWindowPostLostData(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tp := newTestPair(t, ctx)
+	h := tp.handler
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(4)).Read(data)
+	p, err := tp.minerAPI.Unixfs().Add(ctx, files.NewReaderFile(bytes.NewReader(data)), options.Unixfs.Pin(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The data stays available from the inspector.
+	if _, err := tp.inspector.api.Unixfs().Add(ctx, files.NewReaderFile(bytes.NewReader(data)), options.Unixfs.Pin(true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.files.Put(&StoredFile{Cid: p.Cid(), Requester: tp.inspector.node.Identity, Size: uint64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+
+	prove := func() []proto.PositionProof {
+		t.Helper()
+		msg := &proto.Message{Data: proto.WindowPostProofReq{Items: []proto.WindowPostReqItem{
+			{FileCid: p.Cid(), Positions: []int64{0, int64(len(data)) - 1}},
+		}}}
+		items := h.doWindowPostProof(ctx, msg)
+		if len(items) != 1 {
+			t.Fatalf("got %d items, want 1", len(items))
+		}
+		return items[0].Proofs
+	}
+	if prove() == nil {
+		t.Fatal("failed to prove stored file")
+	}
+
+	// A miner that lost a block fails instead of fetching it.
+	nd, err := tp.minerAPI.Dag().Get(ctx, p.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := nd.Links()[len(nd.Links())-1].Cid
+	if err := tp.miner.Blockstore.DeleteBlock(last); err != nil {
+		t.Fatal(err)
+	}
+	if prove() != nil {
+		t.Error("proved a file with a missing block")
+	}
+	if has, _ := tp.miner.Blockstore.Has(last); has {
+		t.Error("missing block fetched while proving")
+	}
+
+	// So does a miner that unpinned an assigned file.
+	if err := tp.minerAPI.Pin().Rm(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := h.isStored(ctx, tp.minerAPI, p.Cid()); err != nil || stored {
+		t.Errorf("unpinned file reported stored: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package miner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+)
+
+var (
+	// ErrContentPartial is returned when blocks of a fetched DAG are not
+	// in the local blockstore.
+	ErrContentPartial = errors.New("content is missing blocks")
+	// ErrContentOversized is returned when a fetched DAG is larger or has
+	// more blocks than the requester expected.
+	ErrContentOversized = fmt.Errorf("%w: content larger than expected", ErrPermanent)
+	// ErrContentCorrupt is returned when a block does not match its CID or
+	// does not decode, or the content is smaller than expected.
+	ErrContentCorrupt = fmt.Errorf("%w: content is corrupt", ErrPermanent)
+)
+
+// contentExpectation is what a requester expects of a fetched DAG. Zero
+// fields are not checked.
+type contentExpectation struct {
+	// Size is the size of the UnixFS file content.
+	Size uint64
+	// Blocks is the number of distinct blocks in the DAG.
+	Blocks uint64
+}
+
+// verifyContent walks the DAG under root through ng, which must only read
+// the local blockstore. Every block is rehashed against its CID and the DAG
+// is checked against expect.
+func verifyContent(ctx context.Context, ng ipld.NodeGetter, root cid.Cid, expect contentExpectation) error {
+	seen := cid.NewSet()
+	seen.Add(root)
+	queue := []cid.Cid{root}
+	var blocks, missing uint64
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+
+		nd, err := ng.Get(ctx, c)
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, ipld.ErrNotFound):
+			missing++
+			continue
+		default:
+			return fmt.Errorf("%w: block %v: %v", ErrContentCorrupt, c, err)
+		}
+		sum, err := c.Prefix().Sum(nd.RawData())
+		if err != nil || !sum.Equals(c) {
+			return fmt.Errorf("%w: block %v does not match its hash", ErrContentCorrupt, c)
+		}
+
+		blocks++
+		if expect.Blocks != 0 && blocks > expect.Blocks {
+			return fmt.Errorf("%w: more than %d blocks", ErrContentOversized, expect.Blocks)
+		}
+		for _, l := range nd.Links() {
+			if seen.Visit(l.Cid) {
+				queue = append(queue, l.Cid)
+			}
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%w: %d of %d blocks missing", ErrContentPartial, missing, missing+blocks)
+	}
+	if expect.Blocks != 0 && blocks < expect.Blocks {
+		return fmt.Errorf("%w: %d blocks, expected %d", ErrContentCorrupt, blocks, expect.Blocks)
+	}
+
+	if expect.Size != 0 {
+		size, err := unixfsFileSize(ctx, ng, root)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrContentCorrupt, err)
+		}
+		switch {
+		case size > expect.Size:
+			return fmt.Errorf("%w: %d bytes, expected %d", ErrContentOversized, size, expect.Size)
+		case size < expect.Size:
+			return fmt.Errorf("%w: %d bytes, expected %d", ErrContentCorrupt, size, expect.Size)
+		}
+	}
+	return nil
+}
+
+// unixfsFileSize is like fileSize but fails for roots that are not UnixFS
+// files.
+func unixfsFileSize(ctx context.Context, ng ipld.NodeGetter, root cid.Cid) (uint64, error) {
+	nd, err := ng.Get(ctx, root)
+	if err != nil {
+		return 0, err
+	}
+	if pn, ok := nd.(*merkledag.ProtoNode); ok {
+		fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+		if err != nil {
+			return 0, err
+		}
+		if fsn.Type() != unixfs.TFile && fsn.Type() != unixfs.TRaw {
+			return 0, ErrNotAFile
+		}
+	}
+	return fileSize(ctx, ng, root)
+}
@@ -0,0 +1,81 @@
+package miner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs/importer"
+)
+
+func TestVerifyContent(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	data := make([]byte, 8*1024)
+	rand.New(rand.NewSource(6)).Read(data)
+	root, err := importer.BuildDagFromReader(dserv, chunker.NewSizeSplitter(bytes.NewReader(data), 512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 16 leaves and the root.
+	const numBlocks = 17
+
+	exact := contentExpectation{Size: uint64(len(data)), Blocks: numBlocks}
+	if err := verifyContent(ctx, dserv, root.Cid(), exact); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyContent(ctx, dserv, root.Cid(), contentExpectation{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		expect contentExpectation
+		err    error
+	}{
+		{contentExpectation{Size: uint64(len(data)) - 1}, ErrContentOversized},
+		{contentExpectation{Blocks: numBlocks - 1}, ErrContentOversized},
+		{contentExpectation{Size: uint64(len(data)) + 1}, ErrContentCorrupt},
+		{contentExpectation{Blocks: numBlocks + 1}, ErrContentCorrupt},
+	} {
+		if err := verifyContent(ctx, dserv, root.Cid(), c.expect); !errors.Is(err, c.err) {
+			t.Errorf("%+v: expected %v, got %v", c.expect, c.err, err)
+		}
+	}
+
+	leaf := root.Links()[3].Cid
+	orig, err := bs.Get(leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bs.DeleteBlock(leaf); err != nil {
+		t.Fatal(err)
+	}
+	err = verifyContent(ctx, dserv, root.Cid(), exact)
+	if !errors.Is(err, ErrContentPartial) || errors.Is(err, ErrPermanent) {
+		t.Errorf("expected a retryable ErrContentPartial, got %v", err)
+	}
+
+	garbage := append([]byte{}, orig.RawData()...)
+	garbage[len(garbage)-1] ^= 0xff
+	corrupt, _ := blocks.NewBlockWithCid(garbage, leaf)
+	if err := bs.Put(corrupt); err != nil {
+		t.Fatal(err)
+	}
+	err = verifyContent(ctx, dserv, root.Cid(), exact)
+	if !errors.Is(err, ErrContentCorrupt) || !errors.Is(err, ErrPermanent) {
+		t.Errorf("expected a permanent ErrContentCorrupt, got %v", err)
+	}
+}
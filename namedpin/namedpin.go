@@ -0,0 +1,330 @@
+// Package namedpin stores names and metadata of pins in the repo datastore.
+//
+// Names are labels on top of the pins of the pinner, which has no names: a
+// pin may have several names, and removing the last name of a pin removes
+// the pin if it exists only for its names. A pin that was also pinned without
+// a name is kept. The pinner returned by NewPinner keeps the names in sync
+// with the pins added, removed and updated without them.
+package namedpin
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	cid "github.com/ipfs/go-cid"
+	dstore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	ipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log"
+)
+
+var log = logging.Logger("namedpin")
+
+var namesPrefix = dstore.NewKey("/local/pins/names")
+
+// maxNameLength is the length of the longest name in bytes.
+const maxNameLength = 255
+
+var (
+	// ErrNotFound is returned for a name no pin has.
+	ErrNotFound = errors.New("no pin has this name")
+	// ErrNameExists is returned when adding a name another pin has.
+	ErrNameExists = errors.New("a pin already has this name")
+	// ErrInvalidName is returned for empty, too long or unprintable names.
+	ErrInvalidName = errors.New("pin names must be printable and 1 to 255 bytes long")
+)
+
+// Pin is a named pin.
+type Pin struct {
+	Name      string
+	Cid       cid.Cid
+	Recursive bool
+	Meta      map[string]string `json:",omitempty"`
+	// Owned is set when the pin exists only for its names, so that
+	// removing its last name removes it. All names of a pin agree on it.
+	Owned bool `json:",omitempty"`
+}
+
+// ValidateName checks that name can name a pin.
+func ValidateName(name string) error {
+	if name == "" || len(name) > maxNameLength {
+		return ErrInvalidName
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return ErrInvalidName
+		}
+	}
+	return nil
+}
+
+// ParseMeta parses key=value pairs into metadata. Later pairs replace earlier
+// ones with the same key.
+func ParseMeta(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	meta := make(map[string]string, len(pairs))
+	for _, kv := range pairs {
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid metadata %q, expected key=value", kv)
+		}
+		meta[kv[:i]] = kv[i+1:]
+	}
+	return meta, nil
+}
+
+// Store persists named pins in a datastore.
+type Store struct {
+	ds dstore.Datastore
+	lk sync.Mutex
+}
+
+// NewStore opens the named pins stored in ds.
+func NewStore(ds dstore.Datastore) *Store {
+	return &Store{ds: ds}
+}
+
+func nameKey(name string) dstore.Key {
+	return namesPrefix.ChildString(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte(name)))
+}
+
+// Get returns the pin named name.
+func (s *Store) Get(name string) (Pin, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.get(name)
+}
+
+func (s *Store) get(name string) (Pin, error) {
+	var p Pin
+	data, err := s.ds.Get(nameKey(name))
+	if err == dstore.ErrNotFound {
+		return p, ErrNotFound
+	}
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, fmt.Errorf("invalid pin named %q: %w", name, err)
+	}
+	return p, nil
+}
+
+// Put stores p, replacing the pin with the same name.
+func (s *Store) Put(p Pin) error {
+	if err := ValidateName(p.Name); err != nil {
+		return err
+	}
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.put(p)
+}
+
+func (s *Store) put(p Pin) error {
+	data, err := json.Marshal(&p)
+	if err != nil {
+		return err
+	}
+	return s.ds.Put(nameKey(p.Name), data)
+}
+
+// Create stores p, unless a pin has its name.
+func (s *Store) Create(p Pin) error {
+	if err := ValidateName(p.Name); err != nil {
+		return err
+	}
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if _, err := s.get(p.Name); err != ErrNotFound {
+		if err == nil {
+			return ErrNameExists
+		}
+		return err
+	}
+	return s.put(p)
+}
+
+// Delete removes the name of a pin.
+func (s *Store) Delete(name string) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if _, err := s.get(name); err != nil {
+		return err
+	}
+	return s.ds.Delete(nameKey(name))
+}
+
+// List returns the pins whose name starts with prefix, sorted by name.
+func (s *Store) List(prefix string) ([]Pin, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.list(func(p Pin) bool {
+		return strings.HasPrefix(p.Name, prefix)
+	})
+}
+
+// Owned reports whether the names of the recursive or direct pin of k own
+// it. It is false when the pin has no name.
+func (s *Store) Owned(k cid.Cid, recursive bool) (bool, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	pins, err := s.list(func(p Pin) bool {
+		return p.Cid.Equals(k) && p.Recursive == recursive && p.Owned
+	})
+	return len(pins) > 0, err
+}
+
+// Names returns the named pins of k.
+func (s *Store) Names(k cid.Cid) ([]Pin, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.list(func(p Pin) bool {
+		return p.Cid.Equals(k)
+	})
+}
+
+func (s *Store) list(filter func(Pin) bool) ([]Pin, error) {
+	res, err := s.ds.Query(query.Query{Prefix: namesPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	var pins []Pin
+	for _, e := range entries {
+		var p Pin
+		if err := json.Unmarshal(e.Value, &p); err != nil {
+			log.Warnf("skipping invalid named pin %s: %v", e.Key, err)
+			continue
+		}
+		if filter(p) {
+			pins = append(pins, p)
+		}
+	}
+	sort.Slice(pins, func(i, j int) bool {
+		return pins[i].Name < pins[j].Name
+	})
+	return pins, nil
+}
+
+// update rewrites the named pins of k that match.
+func (s *Store) update(k cid.Cid, match func(Pin) bool, update func(*Pin) bool) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	pins, err := s.list(func(p Pin) bool {
+		return p.Cid.Equals(k) && match(p)
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range pins {
+		var err error
+		if update(&p) {
+			err = s.put(p)
+		} else {
+			err = s.ds.Delete(nameKey(p.Name))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type namedPinner struct {
+	pin.Pinner
+	s *Store
+}
+
+// NewPinner wraps pn so that the names of s follow the pins removed from and
+// updated in pn.
+func NewPinner(pn pin.Pinner, s *Store) pin.Pinner {
+	return &namedPinner{Pinner: pn, s: s}
+}
+
+// setOwned sets whether the names of the recursive or direct pin of k own it.
+func (p *namedPinner) setOwned(k cid.Cid, recursive, owned bool) error {
+	return p.s.update(k, func(np Pin) bool {
+		return np.Recursive == recursive && np.Owned != owned
+	}, func(np *Pin) bool {
+		np.Owned = owned
+		return true
+	})
+}
+
+func (p *namedPinner) forget(ctx context.Context, k cid.Cid) {
+	// The names of the pins of k that are gone.
+	_, recursive, err := p.Pinner.IsPinnedWithType(ctx, k, pin.Recursive)
+	if err != nil {
+		log.Errorf("failed to check pins of %s: %v", k, err)
+		return
+	}
+	_, direct, err := p.Pinner.IsPinnedWithType(ctx, k, pin.Direct)
+	if err != nil {
+		log.Errorf("failed to check pins of %s: %v", k, err)
+		return
+	}
+	gone := func(np Pin) bool {
+		if np.Recursive {
+			return !recursive
+		}
+		return !direct
+	}
+	if err := p.s.update(k, gone, func(*Pin) bool { return false }); err != nil {
+		log.Errorf("failed to remove names of %s: %v", k, err)
+	}
+}
+
+func (p *namedPinner) Pin(ctx context.Context, node ipld.Node, recursive bool) error {
+	if err := p.Pinner.Pin(ctx, node, recursive); err != nil {
+		return err
+	}
+	// The pin no longer exists only for its names.
+	if err := p.setOwned(node.Cid(), recursive, false); err != nil {
+		log.Errorf("failed to update names of %s: %v", node.Cid(), err)
+	}
+	return nil
+}
+
+func (p *namedPinner) Unpin(ctx context.Context, c cid.Cid, recursive bool) error {
+	if err := p.Pinner.Unpin(ctx, c, recursive); err != nil {
+		return err
+	}
+	p.forget(ctx, c)
+	return nil
+}
+
+func (p *namedPinner) Update(ctx context.Context, from, to cid.Cid, unpin bool) error {
+	if err := p.Pinner.Update(ctx, from, to, unpin); err != nil {
+		return err
+	}
+	if !unpin || from.Equals(to) {
+		return nil
+	}
+	recursive := func(np Pin) bool { return np.Recursive }
+	err := p.s.update(from, recursive, func(np *Pin) bool {
+		np.Cid = to
+		return true
+	})
+	if err != nil {
+		log.Errorf("failed to move names of %s to %s: %v", from, to, err)
+	}
+	return nil
+}
+
+func (p *namedPinner) RemovePinWithMode(c cid.Cid, mode pin.Mode) {
+	p.Pinner.RemovePinWithMode(c, mode)
+	p.forget(context.Background(), c)
+}
@@ -0,0 +1,147 @@
+package namedpin
+
+import (
+	"context"
+	"testing"
+
+	bserv "github.com/ipfs/go-blockservice"
+	dstore "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	"github.com/ipfs/go-ipfs-pinner/dspinner"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+func TestStore(t *testing.T) {
+	s := NewStore(dssync.MutexWrap(dstore.NewMapDatastore()))
+	nd := dag.NodeWithData([]byte("data"))
+
+	for _, name := range []string{"dataset/b", "dataset/a", "other"} {
+		if err := s.Create(Pin{Name: name, Cid: nd.Cid(), Recursive: true, Meta: map[string]string{"owner": name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Create(Pin{Name: "other", Cid: nd.Cid()}); err != ErrNameExists {
+		t.Errorf("created a name twice: %v", err)
+	}
+	if err := s.Create(Pin{Name: "", Cid: nd.Cid()}); err != ErrInvalidName {
+		t.Errorf("created an empty name: %v", err)
+	}
+
+	pins, err := s.List("dataset/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 2 || pins[0].Name != "dataset/a" || pins[1].Name != "dataset/b" || pins[0].Meta["owner"] != "dataset/a" {
+		t.Errorf("unexpected pins: %+v", pins)
+	}
+
+	if err := s.Delete("other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("other"); err != ErrNotFound {
+		t.Errorf("deleted name found: %v", err)
+	}
+	if err := s.Delete("other"); err != ErrNotFound {
+		t.Errorf("deleted a name twice: %v", err)
+	}
+}
+
+func TestParseMeta(t *testing.T) {
+	meta, err := ParseMeta([]string{"owner=alice", "note=a=b", "owner=bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta) != 2 || meta["owner"] != "bob" || meta["note"] != "a=b" {
+		t.Errorf("unexpected metadata: %v", meta)
+	}
+	for _, bad := range []string{"owner", "=alice"} {
+		if _, err := ParseMeta([]string{bad}); err == nil {
+			t.Errorf("expected %q to be invalid", bad)
+		}
+	}
+}
+
+func TestPinner(t *testing.T) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(dstore.NewMapDatastore())
+	bs := bstore.NewBlockstore(ds)
+	dserv := dag.NewDAGService(bserv.New(bs, offline.Exchange(bs)))
+	inner, err := dspinner.New(ctx, ds, dserv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStore(ds)
+	pn := NewPinner(inner, s)
+
+	from := dag.NodeWithData([]byte("from"))
+	to := dag.NodeWithData([]byte("to"))
+	direct := dag.NodeWithData([]byte("direct"))
+	if err := dserv.AddMany(ctx, []ipld.Node{from, to, direct}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pn.Pin(ctx, from, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := pn.Pin(ctx, direct, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []Pin{
+		{Name: "a", Cid: from.Cid(), Recursive: true},
+		{Name: "b", Cid: from.Cid(), Recursive: true},
+		{Name: "c", Cid: direct.Cid(), Owned: true},
+	} {
+		if err := s.Create(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pn.Update(ctx, from.Cid(), to.Cid(), true); err != nil {
+		t.Fatal(err)
+	}
+	if pins, err := s.Names(to.Cid()); err != nil || len(pins) != 2 {
+		t.Errorf("names not moved by the update: %+v, %v", pins, err)
+	}
+
+	if err := pn.Unpin(ctx, direct.Cid(), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("c"); err != ErrNotFound {
+		t.Errorf("name of a removed pin kept: %v", err)
+	}
+	if pins, err := s.List(""); err != nil || len(pins) != 2 {
+		t.Errorf("unexpected names: %+v, %v", pins, err)
+	}
+
+	// Pinning without a name takes the pin from its names.
+	for _, name := range []string{"a", "b"} {
+		np, err := s.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		np.Owned = true
+		if err := s.Put(np); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pn.Pin(ctx, to, true); err != nil {
+		t.Fatal(err)
+	}
+	if owned, err := s.Owned(to.Cid(), true); err != nil || owned {
+		t.Errorf("names own a pin added without a name: %v", err)
+	}
+
+	// Removing the pin removes it with its names.
+	if err := pn.Unpin(ctx, to.Cid(), true); err != nil {
+		t.Fatal(err)
+	}
+	if _, pinned, err := pn.IsPinnedWithType(ctx, to.Cid(), pin.Recursive); err != nil || pinned {
+		t.Errorf("pin kept for its names: %v", err)
+	}
+	if pins, err := s.List(""); err != nil || len(pins) != 0 {
+		t.Errorf("names of a removed pin kept: %+v, %v", pins, err)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/core/coreapi"
 	coredag "github.com/ipfs/go-ipfs/core/coredag"
+	miner "github.com/ipfs/go-ipfs/miner"
 	plugin "github.com/ipfs/go-ipfs/plugin"
 	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
 
@@ -262,6 +263,13 @@ func (loader *PluginLoader) Inject() error {
 				return err
 			}
 		}
+		if pl, ok := pl.(plugin.PluginMinerHandler); ok {
+			err := injectMinerHandlerPlugin(pl)
+			if err != nil {
+				loader.state = loaderFailed
+				return err
+			}
+		}
 	}
 
 	return loader.transition(loaderInjecting, loaderInjected)
@@ -350,3 +358,7 @@ func injectTracerPlugin(pl plugin.PluginTracer) error {
 	opentracing.SetGlobalTracer(tracer)
 	return nil
 }
+
+func injectMinerHandlerPlugin(pl plugin.PluginMinerHandler) error {
+	return pl.RegisterMinerHandlers(miner.DefaultHandlerRegistry)
+}
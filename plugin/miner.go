@@ -0,0 +1,13 @@
+package plugin
+
+import (
+	"github.com/ipfs/go-ipfs/miner"
+)
+
+// PluginMinerHandler is an interface that can be implemented to add handlers
+// for new miner message types
+type PluginMinerHandler interface {
+	Plugin
+
+	RegisterMinerHandlers(r *miner.HandlerRegistry) error
+}
@@ -1,10 +1,26 @@
 package common
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
 
+// ErrKeyNotFound matches the error returned by MapGetKV for a missing key.
+var ErrKeyNotFound = errors.New("key not found")
+
+type keyNotFoundError struct {
+	sofar string
+}
+
+func (e keyNotFoundError) Error() string {
+	return fmt.Sprintf("%s key has no attributes", e.sofar)
+}
+
+func (e keyNotFoundError) Is(target error) bool {
+	return target == ErrKeyNotFound
+}
+
 func MapGetKV(v map[string]interface{}, key string) (interface{}, error) {
 	var ok bool
 	var mcursor map[string]interface{}
@@ -21,7 +37,7 @@ func MapGetKV(v map[string]interface{}, key string) (interface{}, error) {
 
 		cursor, ok = mcursor[part]
 		if !ok {
-			return nil, fmt.Errorf("%s key has no attributes", sofar)
+			return nil, keyNotFoundError{sofar: sofar}
 		}
 	}
 	return cursor, nil
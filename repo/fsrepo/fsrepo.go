@@ -64,7 +64,9 @@ func (err NoRepoError) Error() string {
 }
 
 const apiFile = "api"
-const swarmKeyFile = "swarm.key"
+
+// SwarmKeyFile is the name of the swarm key file in the repo.
+const SwarmKeyFile = "swarm.key"
 
 const specFn = "datastore_spec"
 
@@ -665,14 +667,59 @@ func (r *FSRepo) GetStorageUsage() (uint64, error) {
 	return ds.DiskUsage(r.Datastore())
 }
 
+// SwarmKeySource returns where the swarm key comes from, resolving the
+// default source to the repo file or the embedded key.
+func (r *FSRepo) SwarmKeySource() (string, error) {
+	source := repo.SwarmKeyAuto
+	v, err := r.GetConfigKey(repo.SwarmKeySourceKey)
+	switch {
+	case errors.Is(err, common.ErrKeyNotFound):
+	case err != nil:
+		return "", err
+	default:
+		s, ok := v.(string)
+		if !ok || !repo.ValidSwarmKeySource(s) {
+			return "", repo.ErrInvalidSwarmKeySource
+		}
+		source = s
+	}
+	if source != repo.SwarmKeyAuto {
+		return source, nil
+	}
+
+	_, err = os.Stat(r.swarmKeyPath())
+	switch {
+	case err == nil:
+		return repo.SwarmKeyRepo, nil
+	case !os.IsNotExist(err):
+		return "", err
+	case build.SwarmKey() == nil:
+		return repo.SwarmKeyPublic, nil
+	default:
+		return repo.SwarmKeyEmbedded, nil
+	}
+}
+
 func (r *FSRepo) SwarmKey() ([]byte, error) {
-	repoPath := filepath.Clean(r.path)
-	spath := filepath.Join(repoPath, swarmKeyFile)
+	source, err := r.SwarmKeySource()
+	if err != nil {
+		return nil, err
+	}
+	switch source {
+	case repo.SwarmKeyPublic:
+		return nil, nil
+	case repo.SwarmKeyEmbedded:
+		key := build.SwarmKey()
+		if key == nil {
+			return nil, errors.New("no swarm key is embedded in this binary")
+		}
+		return key, nil
+	}
 
-	f, err := os.Open(spath)
+	f, err := os.Open(r.swarmKeyPath())
 	if err != nil {
 		if os.IsNotExist(err) {
-			return build.SwarmKey(), nil
+			return nil, fmt.Errorf("%s is %q but the repo has no %s", repo.SwarmKeySourceKey, source, SwarmKeyFile)
 		}
 		return nil, err
 	}
@@ -681,6 +728,10 @@ func (r *FSRepo) SwarmKey() ([]byte, error) {
 	return ioutil.ReadAll(f)
 }
 
+func (r *FSRepo) swarmKeyPath() string {
+	return filepath.Join(filepath.Clean(r.path), SwarmKeyFile)
+}
+
 var _ io.Closer = &FSRepo{}
 var _ repo.Repo = &FSRepo{}
 
@@ -7,6 +7,7 @@ import (
 	keystore "github.com/ipfs/go-ipfs-keystore"
 
 	config "github.com/ipfs/go-ipfs-config"
+	"github.com/ipfs/go-ipfs/repo/common"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
@@ -38,7 +39,11 @@ func (m *Mock) SetConfigKey(key string, value interface{}) error {
 }
 
 func (m *Mock) GetConfigKey(key string) (interface{}, error) {
-	return nil, errTODO
+	cfg, err := config.ToMap(&m.C)
+	if err != nil {
+		return nil, err
+	}
+	return common.MapGetKV(cfg, key)
 }
 
 func (m *Mock) Datastore() Datastore { return m.D }
@@ -55,4 +60,8 @@ func (m *Mock) SwarmKey() ([]byte, error) {
 	return nil, nil
 }
 
+func (m *Mock) SwarmKeySource() (string, error) {
+	return SwarmKeyPublic, nil
+}
+
 func (m *Mock) FileManager() *filestore.FileManager { return m.F }
@@ -53,6 +53,10 @@ type Repo interface {
 	// SwarmKey returns the configured shared symmetric key for the private networks feature.
 	SwarmKey() ([]byte, error)
 
+	// SwarmKeySource returns where the key returned by SwarmKey comes
+	// from: SwarmKeyRepo, SwarmKeyEmbedded or SwarmKeyPublic.
+	SwarmKeySource() (string, error)
+
 	io.Closer
 }
 
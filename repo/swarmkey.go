@@ -0,0 +1,31 @@
+package repo
+
+import "errors"
+
+// SwarmKeySourceKey is the config key selecting where the swarm key of the
+// private network comes from.
+const SwarmKeySourceKey = "SwarmKeySource"
+
+// Swarm key sources.
+const (
+	// SwarmKeyAuto uses the swarm.key file of the repo when it exists and
+	// the key embedded in the binary otherwise.
+	SwarmKeyAuto = ""
+	// SwarmKeyEmbedded uses the key embedded in the binary.
+	SwarmKeyEmbedded = "embedded"
+	// SwarmKeyRepo uses the swarm.key file of the repo.
+	SwarmKeyRepo = "repo"
+	// SwarmKeyPublic joins the public network without a swarm key.
+	SwarmKeyPublic = "public"
+)
+
+var ErrInvalidSwarmKeySource = errors.New(`SwarmKeySource must be "embedded", "repo" or "public"`)
+
+// ValidSwarmKeySource reports whether source is a known swarm key source.
+func ValidSwarmKeySource(source string) bool {
+	switch source {
+	case SwarmKeyAuto, SwarmKeyEmbedded, SwarmKeyRepo, SwarmKeyPublic:
+		return true
+	}
+	return false
+}